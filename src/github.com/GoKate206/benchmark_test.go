@@ -0,0 +1,127 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+var benchmarkSizes = []struct {
+	name string
+	cfg  func(NetworkConfig) NetworkConfig
+}{
+	{"small", func(c NetworkConfig) NetworkConfig {
+		c.Stops, c.Routes, c.StopsPerRoute = 20, 2, 8
+		return c
+	}},
+	{"medium", func(c NetworkConfig) NetworkConfig {
+		c.Stops, c.Routes, c.StopsPerRoute = 100, 6, 12
+		return c
+	}},
+	{"large", func(c NetworkConfig) NetworkConfig {
+		c.Stops, c.Routes, c.StopsPerRoute, c.Days = 400, 12, 16, 2
+		return c
+	}},
+}
+
+func benchmarkNetwork(b *testing.B, apply func(NetworkConfig) NetworkConfig) (string, time.Time) {
+	start, _ := time.Parse(dateLayout, "Jul 05 2021")
+	csv, err := generateNetwork(apply(defaultNetworkConfig(start)))
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	return csv, start
+}
+
+// benchmarkStore opens a store holding a generated network
+func benchmarkStore(b *testing.B, csv string) *Store {
+	store := initTestStore(b)
+	if err := store.csvHandler(csv); err != nil {
+		b.Fatal(err)
+	}
+
+	return store
+}
+
+func BenchmarkReadCsv(b *testing.B) {
+	for _, size := range benchmarkSizes {
+		csv, _ := benchmarkNetwork(b, size.cfg)
+		b.Run(size.name, func(b *testing.B) {
+			b.SetBytes(int64(len(csv)))
+			for i := 0; i < b.N; i++ {
+				if _, err := readCsv(csv, defaultTrainIDRules()); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkInsertSchedules(b *testing.B) {
+	for _, size := range benchmarkSizes {
+		csv, _ := benchmarkNetwork(b, size.cfg)
+		schedules, err := readCsv(csv, defaultTrainIDRules())
+		if err != nil {
+			b.Fatal(err)
+		}
+
+		b.Run(fmt.Sprintf("%s/%d", size.name, len(schedules)), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				b.StopTimer()
+				store := initTestStore(b)
+				b.StartTimer()
+
+				if err := store.insertSchedules(schedules); err != nil {
+					b.Fatal(err)
+				}
+
+				b.StopTimer()
+				tearDownStore(store)
+				b.StartTimer()
+			}
+		})
+	}
+}
+
+func BenchmarkGetScheduleByDate(b *testing.B) {
+	for _, size := range benchmarkSizes {
+		csv, start := benchmarkNetwork(b, size.cfg)
+		store := benchmarkStore(b, csv)
+		date := start.Add(12 * time.Hour)
+
+		b.Run(size.name, func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				if _, err := store.getScheduleByDate(date); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+		tearDownStore(store)
+	}
+}
+
+func BenchmarkGetTrainsByStopAndTime(b *testing.B) {
+	for _, size := range benchmarkSizes {
+		csv, _ := benchmarkNetwork(b, size.cfg)
+		schedules, err := readCsv(csv, defaultTrainIDRules())
+		if err != nil {
+			b.Fatal(err)
+		}
+		store := benchmarkStore(b, csv)
+		// query a train the network has, mid-way through the generated rows
+		train := schedules[len(schedules)/2]
+
+		b.Run(size.name, func(b *testing.B) {
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					if _, err := store.getTrainsByStopAndTime(train.StopID, train.Time); err != nil {
+						b.Error(err)
+						return
+					}
+				}
+			})
+		})
+		tearDownStore(store)
+	}
+}
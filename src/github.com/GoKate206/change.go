@@ -0,0 +1,190 @@
+package main
+
+import (
+	"encoding/json"
+	"sort"
+	"time"
+)
+
+// change events, published after a write to the store is committed
+const (
+	changeImported            = "schedules.imported"
+	changeReplaced            = "schedules.replaced"
+	changeUpdated             = "schedules.updated"
+	changeDeleted             = "schedules.deleted"
+	changeOverrideAdded       = "override.added"
+	changeOverrideRemoved     = "override.removed"
+	changeTimetableActivated  = "timetable.activated"
+	changeTimetableRolledBack = "timetable.rolledback"
+	changeAlertAdded          = "alert.added"
+	changeAlertRemoved        = "alert.removed"
+	changeStopSaved           = "stop.saved"
+)
+
+// ChangeEvent describes a committed change and the stops, routes and
+// trains it touched. An event without stops or routes touched the
+// whole network, like a timetable version being activated
+type ChangeEvent struct {
+	Event string `json:"event"`
+	// Collection is the override collection for override events
+	Collection string   `json:"collection,omitempty"`
+	StopIDs    []int64  `json:"stopIDs,omitempty"`
+	Routes     []string `json:"routes,omitempty"`
+	TrainIDs   []string `json:"trainIDs,omitempty"`
+	Count      int      `json:"count"`
+	OccurredAt string   `json:"occurredAt"`
+}
+
+// changeOf is an event touching the stops, routes and trains of schedules
+func changeOf(event string, schedules []Schedule) ChangeEvent {
+	change := ChangeEvent{Event: event, Count: len(schedules)}
+	stops, routes, trains := map[int64]bool{}, map[string]bool{}, map[string]bool{}
+	for _, schedule := range schedules {
+		if !stops[schedule.StopID] {
+			stops[schedule.StopID] = true
+			change.StopIDs = append(change.StopIDs, schedule.StopID)
+		}
+		if !routes[schedule.Route] {
+			routes[schedule.Route] = true
+			change.Routes = append(change.Routes, schedule.Route)
+		}
+		if !trains[schedule.TrainID] {
+			trains[schedule.TrainID] = true
+			change.TrainIDs = append(change.TrainIDs, schedule.TrainID)
+		}
+	}
+	sort.Slice(change.StopIDs, func(i, j int) bool { return change.StopIDs[i] < change.StopIDs[j] })
+	sort.Strings(change.Routes)
+	sort.Strings(change.TrainIDs)
+
+	return change
+}
+
+// affects tells if the change touched any of the stops and any of the
+// routes, an empty list matches everything
+func (c ChangeEvent) affects(stopIDs []int64, routes []string) bool {
+	if len(stopIDs) > 0 && len(c.StopIDs) > 0 {
+		found := false
+		for _, stopID := range stopIDs {
+			for _, changed := range c.StopIDs {
+				found = found || stopID == changed
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+
+	if len(routes) > 0 && len(c.Routes) > 0 {
+		found := false
+		for _, route := range routes {
+			found = found || containsString(c.Routes, route)
+		}
+		if !found {
+			return false
+		}
+	}
+
+	return true
+}
+
+// alertChange is an event touching what an alert affects
+func alertChange(event string, alert ServiceAlert) ChangeEvent {
+	return ChangeEvent{Event: event, StopIDs: alert.StopIDs, Routes: alert.Routes, TrainIDs: alert.TrainIDs, Count: 1}
+}
+
+// onChange calls listen after every committed change. Listeners run
+// with the store locked, they must hand the event off and not query
+// the store. The returned func stops listening
+func (s *Store) onChange(listen func(ChangeEvent)) func() {
+	s.listenMu.Lock()
+	defer s.listenMu.Unlock()
+
+	if s.listeners == nil {
+		s.listeners = map[int]func(ChangeEvent){}
+	}
+	s.nextListener++
+	id := s.nextListener
+	s.listeners[id] = listen
+
+	return func() {
+		s.listenMu.Lock()
+		defer s.listenMu.Unlock()
+		delete(s.listeners, id)
+	}
+}
+
+func (s *Store) publishLocked(change ChangeEvent) {
+	change.OccurredAt = timeNow().Format(layout)
+
+	s.listenMu.Lock()
+	defer s.listenMu.Unlock()
+	for _, listen := range s.listeners {
+		listen(change)
+	}
+}
+
+// trainCallsLocked returns where a train calls on a service day,
+// for changes that only name the train
+func (s *Store) trainCallsLocked(trainID string, serviceDay string) []Schedule {
+	calls := []Schedule{}
+	date, err := time.Parse(dateLayout, serviceDay)
+	if err != nil {
+		return calls
+	}
+
+	day, err := s.dayLocked(date.Add(time.Duration(serviceDayRolloverHour) * time.Hour))
+	if err != nil {
+		return calls
+	}
+
+	for _, schedule := range day.all() {
+		if schedule.TrainID == trainID {
+			calls = append(calls, schedule)
+		}
+	}
+
+	return calls
+}
+
+// publishOverrideLocked publishes an override being added or removed
+func (s *Store) publishOverrideLocked(event string, collection string, override interface{}) {
+	raw, err := json.Marshal(override)
+	if err != nil {
+		return
+	}
+
+	s.publishLocked(s.overrideChangeLocked(event, collection, raw))
+}
+
+// overrideChangeLocked describes adding or removing a stored override,
+// read back as raw JSON as every override names its train the same way
+func (s *Store) overrideChangeLocked(event string, collection string, raw json.RawMessage) ChangeEvent {
+	override := struct {
+		TrainID    string `json:"trainID"`
+		ServiceDay string `json:"serviceDay"`
+		StopID     *int64 `json:"stopID"`
+		Route      string `json:"route"`
+	}{}
+	json.Unmarshal(raw, &override)
+
+	calls := []Schedule{}
+	for _, call := range s.trainCallsLocked(override.TrainID, override.ServiceDay) {
+		if override.StopID == nil || *override.StopID == call.StopID {
+			calls = append(calls, call)
+		}
+	}
+	// extras and frequencies say where they run themselves
+	if len(calls) == 0 && override.StopID != nil {
+		calls = append(calls, Schedule{StopID: *override.StopID, Route: override.Route, TrainID: override.TrainID})
+	}
+
+	change := changeOf(event, calls)
+	change.Collection = collection
+	change.Count = 1
+	if len(change.TrainIDs) == 0 && override.TrainID != "" {
+		change.TrainIDs = []string{override.TrainID}
+	}
+
+	return change
+}
@@ -0,0 +1,280 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"unicode/utf8"
+)
+
+var (
+	mappingDbName = "csv-mappings"
+	// autoMapping is the mapping name that detects columns and delimiter
+	autoMapping = "auto"
+	// headerAliases are the column names recognised for each of
+	// expectedHeaders and optionalColumns, compared without case, spaces, dashes or underscores
+	headerAliases = map[string][]string{
+		"stopID":  {"stopid", "stop", "stationid", "station"},
+		"route":   {"route", "routeid", "routeshortname", "routename", "line"},
+		"trainID": {"trainid", "train", "trainnumber", "trainno", "tripid", "trip"},
+		"time":    {"time", "arrivaltime", "arrival", "departuretime", "departure"},
+		// optional columns
+		"wheelchair": {"wheelchair", "wheelchairaccessible", "accessible"},
+		"platform":   {"platform", "platformcode", "platformnumber", "plat"},
+		"track":      {"track", "tracknumber"},
+		"direction":  {"direction", "directionid"},
+		"headsign":   {"headsign", "tripheadsign", "destination"},
+	}
+	delimiters   = []string{",", ";", "\t", "|"}
+	providerName = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+)
+
+// CsvMapping reads a provider's CSV into the upload format. Columns maps
+// each of expectedHeaders to the provider's column, unmapped ones are found
+// through headerAliases. An empty Delimiter is detected from the header
+type CsvMapping struct {
+	Provider  string            `json:"provider"`
+	Delimiter string            `json:"delimiter,omitempty"`
+	Columns   map[string]string `json:"columns,omitempty"`
+	// TrainIDRules are the provider's train number format,
+	// the store's rules are used when not given
+	TrainIDRules *TrainIDRules `json:"trainIDRules,omitempty"`
+}
+
+func (m CsvMapping) validate() error {
+	if !providerName.MatchString(m.Provider) || m.Provider == autoMapping {
+		return fmt.Errorf("Provider must be letters, digits, dashes or underscores and not %s, got: %s", autoMapping, m.Provider)
+	}
+
+	if m.Delimiter != "" && utf8.RuneCountInString(m.Delimiter) != 1 {
+		return fmt.Errorf("Delimiter must be a single character, got: %q", m.Delimiter)
+	}
+
+	for field := range m.Columns {
+		if _, ok := headerAliases[field]; !ok {
+			return fmt.Errorf("Unknown column %s, expected one of %s", field, strings.Join(append(append([]string{}, expectedHeaders...), optionalHeaders()...), ", "))
+		}
+	}
+
+	if m.TrainIDRules != nil {
+		return m.TrainIDRules.compile()
+	}
+
+	return nil
+}
+
+// optionalHeaders lists optionalColumns in a stable order
+func optionalHeaders() []string {
+	headers := []string{}
+	for header := range optionalColumns {
+		headers = append(headers, header)
+	}
+	sort.Strings(headers)
+
+	return headers
+}
+
+func canonicalHeader(header string) string {
+	return strings.NewReplacer("_", "", "-", "", " ", "").Replace(strings.ToLower(strings.TrimSpace(header)))
+}
+
+// detectDelimiter picks the delimiter used most in the header line
+func detectDelimiter(givenCsv string) string {
+	header := strings.SplitN(givenCsv, "\n", 2)[0]
+	best, bestCount := ",", 0
+	for _, delimiter := range delimiters {
+		if count := strings.Count(header, delimiter); count > bestCount {
+			best, bestCount = delimiter, count
+		}
+	}
+
+	return best
+}
+
+// column finds the index of a field in headers, by its mapped column
+// or its aliases, -1 when it is not there
+func (m CsvMapping) column(headers []string, field string) (int, error) {
+	if column, ok := m.Columns[field]; ok {
+		for i, header := range headers {
+			if strings.EqualFold(strings.TrimSpace(header), column) {
+				return i, nil
+			}
+		}
+		return -1, fmt.Errorf("Mapped column %s for %s not found, Got: %s", column, field, strings.Join(headers, ", "))
+	}
+
+	for _, alias := range headerAliases[field] {
+		for i, header := range headers {
+			if canonicalHeader(header) == alias {
+				return i, nil
+			}
+		}
+	}
+
+	return -1, nil
+}
+
+// columns returns the fields found in headers and their indexes,
+// every one of expectedHeaders then the optional columns there are
+func (m CsvMapping) columns(headers []string) ([]string, []int, error) {
+	fields, indexes := []string{}, []int{}
+	for _, field := range append(append([]string{}, expectedHeaders...), optionalHeaders()...) {
+		index, err := m.column(headers, field)
+		if err != nil {
+			return nil, nil, err
+		}
+		if index < 0 {
+			if _, optional := optionalColumns[field]; optional {
+				continue
+			}
+			return nil, nil, fmt.Errorf("No column found for %s, Got: %s", field, strings.Join(headers, ", "))
+		}
+
+		fields = append(fields, field)
+		indexes = append(indexes, index)
+	}
+
+	return fields, indexes, nil
+}
+
+// normalize rewrites a provider's CSV into the upload format, extra
+// columns are dropped and the rows keep their line numbers
+func (m CsvMapping) normalize(givenCsv string) (string, error) {
+	givenCsv = strings.TrimPrefix(givenCsv, "\ufeff")
+	if strings.TrimSpace(givenCsv) == "" {
+		return givenCsv, nil
+	}
+
+	delimiter := m.Delimiter
+	if delimiter == "" {
+		delimiter = detectDelimiter(givenCsv)
+	}
+
+	r := csv.NewReader(strings.NewReader(givenCsv))
+	r.Comma, _ = utf8.DecodeRuneInString(delimiter)
+	r.LazyQuotes = true
+	records, err := r.ReadAll()
+	if err != nil {
+		return "", err
+	}
+
+	fields, indexes, err := m.columns(records[0])
+	if err != nil {
+		return "", err
+	}
+
+	var b strings.Builder
+	w := csv.NewWriter(&b)
+	w.Write(fields)
+	for _, record := range records[1:] {
+		row := []string{}
+		for _, index := range indexes {
+			row = append(row, strings.TrimSpace(record[index]))
+		}
+		w.Write(row)
+	}
+	w.Flush()
+
+	return strings.TrimSuffix(b.String(), "\n"), w.Error()
+}
+
+// normalizeCsv applies the mapping saved for a provider, or detects the
+// columns for auto, an empty name leaves the CSV as it is. The train ID
+// rules returned are the mapping's, or the store's when it has none
+func (s *Store) normalizeCsv(givenCsv string, name string) (string, TrainIDRules, error) {
+	if name == "" {
+		return givenCsv, s.trainIDRules, nil
+	}
+
+	mapping := CsvMapping{Provider: autoMapping}
+	if name != autoMapping {
+		var err error
+		if mapping, err = s.getMapping(name); err != nil {
+			return "", s.trainIDRules, err
+		}
+	}
+
+	rules := s.trainIDRules
+	if mapping.TrainIDRules != nil {
+		// the compiled pattern is not stored with the mapping
+		rules = *mapping.TrainIDRules
+		if err := rules.compile(); err != nil {
+			return "", rules, err
+		}
+	}
+
+	normalized, err := mapping.normalize(givenCsv)
+	return normalized, rules, err
+}
+
+func (s *Store) saveMapping(mapping CsvMapping) error {
+	if err := mapping.validate(); err != nil {
+		return err
+	}
+
+	if err := s.lock(); err != nil {
+		return err
+	}
+	defer s.mu.Unlock()
+
+	return s.driver.Write(mappingDbName, mapping.Provider, &mapping)
+}
+
+func (s *Store) getMapping(provider string) (CsvMapping, error) {
+	mapping := CsvMapping{}
+	if !providerName.MatchString(provider) {
+		return mapping, fmt.Errorf("Mapping not found: %s", provider)
+	}
+
+	if err := s.rlock(); err != nil {
+		return mapping, err
+	}
+	defer s.mu.RUnlock()
+
+	if err := s.driver.Read(mappingDbName, provider, &mapping); err != nil {
+		return mapping, fmt.Errorf("Mapping not found: %s", provider)
+	}
+
+	return mapping, nil
+}
+
+func (s *Store) getMappings() ([]CsvMapping, error) {
+	mappings := []CsvMapping{}
+	if err := s.rlock(); err != nil {
+		return mappings, err
+	}
+	defer s.mu.RUnlock()
+
+	bytes, err := s.driver.ReadAll(mappingDbName)
+	// ReadAll will error if there are no rows,
+	// only error if there are rows
+	if len(bytes) > 0 && err != nil {
+		return mappings, err
+	}
+
+	for _, b := range bytes {
+		mapping := CsvMapping{}
+		if err := json.Unmarshal(b, &mapping); err != nil {
+			return mappings, err
+		}
+		mappings = append(mappings, mapping)
+	}
+
+	return mappings, nil
+}
+
+func (s *Store) deleteMapping(provider string) error {
+	if _, err := s.getMapping(provider); err != nil {
+		return err
+	}
+
+	if err := s.lock(); err != nil {
+		return err
+	}
+	defer s.mu.Unlock()
+
+	return s.driver.Delete(mappingDbName, provider)
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCsvMapping(t *testing.T) {
+	t.Run("when a CSV uses common column names in any order", func(t *testing.T) {
+		csv, err := CsvMapping{}.normalize("Arrival_Time;notes;Train ID;stop_id;route_short_name\nJul 04 2021 07:42;x;865a;1;C\n")
+		require.Nil(t, err)
+
+		t.Run("it will detect the delimiter and columns and drop the rest", func(t *testing.T) {
+			assert.EqualValues(t, "stopID,route,trainID,time\n1,C,865a,Jul 04 2021 07:42", csv)
+			schedules, err := readCsv(csv, defaultTrainIDRules())
+			require.Nil(t, err)
+			assert.Len(t, schedules, 1)
+		})
+	})
+
+	t.Run("when a mapping names the columns", func(t *testing.T) {
+		mapping := CsvMapping{Provider: "acme", Delimiter: "\t", Columns: map[string]string{"trainID": "Service", "time": "Departs"}}
+		csv, err := mapping.normalize("Station\tService\tLine\tArrives\tDeparts\n1\t865a\tC\tJul 04 2021 07:40\tJul 04 2021 07:42")
+		require.Nil(t, err)
+
+		t.Run("it will use them before the aliases", func(t *testing.T) {
+			assert.EqualValues(t, "stopID,route,trainID,time\n1,C,865a,Jul 04 2021 07:42", csv)
+		})
+
+		t.Run("it will say when a mapped column is missing", func(t *testing.T) {
+			_, err := mapping.normalize("Station\tLine\tDeparts\n1\tC\tJul 04 2021 07:42")
+			require.Error(t, err)
+			assert.EqualValues(t, "Mapped column Service for trainID not found, Got: Station, Line, Departs", err.Error())
+		})
+	})
+
+	t.Run("when a CSV has an optional column", func(t *testing.T) {
+		csv, err := CsvMapping{}.normalize("stop_id,route_id,trip_id,arrival_time,wheelchair_accessible\n1,C,865a,Jul 04 2021 07:42,1")
+		require.Nil(t, err)
+
+		t.Run("it will keep it", func(t *testing.T) {
+			assert.EqualValues(t, "stopID,route,trainID,time,wheelchair\n1,C,865a,Jul 04 2021 07:42,1", csv)
+		})
+	})
+
+	t.Run("when no column can be found for a field", func(t *testing.T) {
+		_, err := CsvMapping{}.normalize("stop,route,time\n1,C,Jul 04 2021 07:42")
+
+		t.Run("it will return an error", func(t *testing.T) {
+			require.Error(t, err)
+			assert.EqualValues(t, "No column found for trainID, Got: stop, route, time", err.Error())
+		})
+	})
+
+	t.Run("when a mapping is invalid", func(t *testing.T) {
+		cases := map[string]CsvMapping{
+			"Provider must be letters, digits, dashes or underscores and not auto, got: ../x":                                      {Provider: "../x"},
+			`Delimiter must be a single character, got: ";;"`:                                                                      {Provider: "acme", Delimiter: ";;"},
+			"Unknown column notes, expected one of stopID, route, trainID, time, direction, headsign, platform, track, wheelchair": {Provider: "acme", Columns: map[string]string{"notes": "Remarks"}},
+			"Train Id length range is invalid: 5 - 2":                                                                              {Provider: "acme", TrainIDRules: &TrainIDRules{MinLength: 5, MaxLength: 2, Classes: []string{"digit"}}},
+		}
+
+		for expected, mapping := range cases {
+			err := mapping.validate()
+			require.Error(t, err)
+			assert.EqualValues(t, expected, err.Error())
+		}
+	})
+}
+
+func TestMappingProfiles(t *testing.T) {
+	store := initTestStore(t)
+	defer tearDownStore(store)
+	srv := httptest.NewServer(newServer(store))
+	defer srv.Close()
+
+	t.Run("when a provider mapping is saved", func(t *testing.T) {
+		req, _ := http.NewRequest(http.MethodPut, srv.URL+"/mappings/acme", strings.NewReader(`{"delimiter": "|", "columns": {"stopID": "Halt"}}`))
+		res, err := http.DefaultClient.Do(req)
+		require.Nil(t, err)
+		res.Body.Close()
+		require.EqualValues(t, http.StatusOK, res.StatusCode)
+
+		t.Run("imports can use it by name", func(t *testing.T) {
+			res, err := http.Post(srv.URL+"/schedules?mapping=acme", "text/csv", strings.NewReader(`Halt|Route|Train|Time|Notes
+1|C|865a|Jul 04 2021 07:42|
+2|C|865a|Jul 04 2021 07:50|`))
+			require.Nil(t, err)
+			res.Body.Close()
+			assert.EqualValues(t, http.StatusCreated, res.StatusCode)
+
+			schedules, err := store.getAllSchedules()
+			require.Nil(t, err)
+			assert.Len(t, schedules, 2)
+		})
+
+		t.Run("it will be listed", func(t *testing.T) {
+			mappings, err := store.getMappings()
+			require.Nil(t, err)
+			require.Len(t, mappings, 1)
+			assert.EqualValues(t, "acme", mappings[0].Provider)
+		})
+
+		t.Run("it can be deleted", func(t *testing.T) {
+			require.Nil(t, store.deleteMapping("acme"))
+			_, _, err := store.normalizeCsv("Halt|Route|Train|Time", "acme")
+			require.Error(t, err)
+			assert.EqualValues(t, "Mapping not found: acme", err.Error())
+		})
+	})
+	t.Run("when a provider mapping has train ID rules", func(t *testing.T) {
+		req, _ := http.NewRequest(http.MethodPut, srv.URL+"/mappings/metro", strings.NewReader(`{"trainIDRules": {"minLength": 2, "maxLength": 5, "classes": ["digit"]}}`))
+		res, err := http.DefaultClient.Do(req)
+		require.Nil(t, err)
+		res.Body.Close()
+		require.EqualValues(t, http.StatusOK, res.StatusCode)
+
+		csv := `stopID,route,trainID,time
+1,"M","12345","Jul 04 2021 07:42"
+2,"M","12345","Jul 04 2021 07:50"`
+
+		t.Run("imports through it will follow them", func(t *testing.T) {
+			res, err := http.Post(srv.URL+"/schedules?mapping=metro", "text/csv", strings.NewReader(csv))
+			require.Nil(t, err)
+			res.Body.Close()
+			assert.EqualValues(t, http.StatusCreated, res.StatusCode)
+		})
+
+		t.Run("other imports will keep the store's rules", func(t *testing.T) {
+			res, err := http.Post(srv.URL+"/schedules", "text/csv", strings.NewReader(csv))
+			require.Nil(t, err)
+			res.Body.Close()
+			assert.EqualValues(t, http.StatusBadRequest, res.StatusCode)
+		})
+	})
+}
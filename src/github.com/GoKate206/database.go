@@ -2,32 +2,152 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
-	"log"
-	"sort"
+	"os"
+	"sync"
 	"time"
 
 	"github.com/sdomino/scribble"
 )
 
 var (
-	db             *scribble.Driver
 	scheduleDbName = "train-schedule"
+	errStoreClosed = errors.New("Schedule store is closed")
 )
 
-func tearDownDb() {
-	if err := db.Delete(fmt.Sprintf("./%s", scheduleDbName), ""); err != nil {
-		log.Fatal(fmt.Sprintf("Error deleting from db: %v", err))
+// Store is the schedule database. Imports take the write lock for their
+// whole run and queries the read lock, so a query never sees half an import.
+// Methods named ...Locked expect the caller to hold the lock
+type Store struct {
+	mu     sync.RWMutex
+	dir    string
+	driver *scribble.Driver
+
+	// collections are indexed in memory on first read
+	// and dropped from the cache when written to
+	cacheMu  sync.Mutex
+	indexes  map[string]*scheduleIndex
+	versions []TimetableVersion
+	alerts   []ServiceAlert
+	// serviceDays are days with cancellations and extras applied
+	serviceDays         map[string]*dayIndex
+	serviceDaysRollover int
+	cancellations       []Cancellation
+	frequencies         []Frequency
+	stops               map[int64]Stop
+	stopTree            *stopTree
+	platformChanges     []PlatformChange
+
+	// trainIDRules check train IDs, uploads through a mapping
+	// with rules of its own are read with those instead
+	trainIDRules TrainIDRules
+
+	// webhookAllowlist are the private networks webhooks and reminder
+	// webhooks may still be sent to, none by default
+	webhookAllowlist WebhookAllowlist
+
+	// listeners are told about every committed change
+	listenMu     sync.Mutex
+	listeners    map[int]func(ChangeEvent)
+	nextListener int
+}
+
+// openStore opens, or creates, the database in dir and indexes
+// the uploaded schedules and active timetable versions
+func openStore(dir string) (*Store, error) {
+	driver, err := scribble.New(dir, nil)
+	if err != nil {
+		return nil, fmt.Errorf("Cannot create Schedule DB: %v", err)
+	}
+
+	s := &Store{
+		dir:          dir,
+		driver:       driver,
+		indexes:      map[string]*scheduleIndex{},
+		serviceDays:  map[string]*dayIndex{},
+		trainIDRules: defaultTrainIDRules(),
 	}
+	if err := s.warm(); err != nil {
+		return nil, err
+	}
+
+	return s, nil
 }
 
-func initDb() {
-	var err error
-	db, err = scribble.New(fmt.Sprintf("./%s", scheduleDbName), nil)
+func (s *Store) warm() error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	collections := []string{scheduleDbName}
+	versions, err := s.getVersionsLocked()
 	if err != nil {
-		log.Fatal("Cannot create Schedule DB")
-		return
+		return err
+	}
+	for _, version := range versions {
+		if version.Active {
+			collections = append(collections, versionCollection(version.ID))
+		}
 	}
+
+	for _, collection := range collections {
+		if _, err := s.indexLocked(collection); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Close ends the store's lifetime, waiting on running imports and queries
+func (s *Store) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.driver == nil {
+		return errStoreClosed
+	}
+	s.driver = nil
+	s.indexes = map[string]*scheduleIndex{}
+	s.versions = nil
+	s.alerts = nil
+	s.cancellations = nil
+	s.frequencies = nil
+	s.stops = nil
+	s.stopTree = nil
+	s.platformChanges = nil
+	s.serviceDays = map[string]*dayIndex{}
+
+	return nil
+}
+
+// Destroy closes the store and wipes every collection
+func (s *Store) Destroy() error {
+	if err := s.Close(); err != nil && err != errStoreClosed {
+		return err
+	}
+
+	return os.RemoveAll(s.dir)
+}
+
+func (s *Store) rlock() error {
+	s.mu.RLock()
+	if s.driver == nil {
+		s.mu.RUnlock()
+		return errStoreClosed
+	}
+
+	return nil
+}
+
+func (s *Store) lock() error {
+	s.mu.Lock()
+	if s.driver == nil {
+		s.mu.Unlock()
+		return errStoreClosed
+	}
+
+	return nil
 }
 
 func bytesToSchedule(bytes []byte) (Schedule, error) {
@@ -37,67 +157,79 @@ func bytesToSchedule(bytes []byte) (Schedule, error) {
 	return schedule, err
 }
 
-func getScheduleByDate(givenDate time.Time) ([]Schedule, error) {
-	schedules := []Schedule{}
-	day := givenDate.Format(dateLayout)
+// getScheduleByDate returns every train on the service day givenDate falls in,
+// from the timetable version in effect that day or the uploaded schedules
+func (s *Store) getScheduleByDate(givenDate time.Time) ([]Schedule, error) {
+	if err := s.rlock(); err != nil {
+		return []Schedule{}, err
+	}
+	defer s.mu.RUnlock()
 
-	bytes, err := db.ReadAll(fmt.Sprintf("./%s", scheduleDbName))
-	// ReadAll will error if there are no rows,
-	// only error if there are rows
-	if len(bytes) > 0 && err != nil {
-		return schedules, err
+	return s.getScheduleByDateLocked(givenDate)
+}
+
+func (s *Store) getScheduleByDateLocked(givenDate time.Time) ([]Schedule, error) {
+	day, err := s.dayLocked(givenDate)
+	if err != nil {
+		return []Schedule{}, err
 	}
 
-	for _, b := range bytes {
-		schedule, err := bytesToSchedule(b)
-		if err != nil {
-			return schedules, err
-		}
+	return day.all(), nil
+}
 
-		trainDate, err := time.Parse(layout, schedule.Time)
-		if err != nil {
-			return schedules, err
-		}
+func (s *Store) getServiceDayScheduleLocked(collection string, day string) ([]Schedule, error) {
+	idx, err := s.indexLocked(collection)
+	if err != nil {
+		return []Schedule{}, err
+	}
 
-		if trainDate.Format(dateLayout) == day {
-			schedules = append(schedules, schedule)
-		}
+	return idx.days[day].all(), nil
+}
+
+func (s *Store) getAllStops() ([]int64, error) {
+	trainStops := []int64{}
+	schedules, err := s.getAllSchedules()
+	if err != nil {
+		return trainStops, err
 	}
 
-	sort.Slice(schedules, func(i int, j int) bool {
-		if schedules[i].Time < schedules[j].Time {
-			return true
-		}
-		if schedules[i].Time > schedules[j].Time {
-			return false
+	uniqueStops := map[int64]bool{}
+	for _, schedule := range schedules {
+		if !uniqueStops[schedule.StopID] {
+			uniqueStops[schedule.StopID] = true
+			trainStops = append(trainStops, schedule.StopID)
 		}
+	}
+
+	return trainStops, nil
+}
 
-		return schedules[i].StopID < schedules[j].StopID
-	})
+func (s *Store) getAllSchedules() ([]Schedule, error) {
+	if err := s.rlock(); err != nil {
+		return []Schedule{}, err
+	}
+	defer s.mu.RUnlock()
 
-	return schedules, nil
+	return s.readSchedulesLocked(scheduleDbName)
 }
 
-func getAllStops() ([]int64, error) {
-	trainStops := []int64{}
-	bytes, err := db.ReadAll(fmt.Sprintf("./%s", scheduleDbName))
+func (s *Store) readSchedulesLocked(collection string) ([]Schedule, error) {
+	schedules := []Schedule{}
+	bytes, err := s.driver.ReadAll(collection)
 	// ReadAll will error if there are no rows,
 	// only error if there are rows
 	if len(bytes) > 0 && err != nil {
-		return trainStops, err
+		return schedules, err
 	}
 
-	uniqueStops := map[int64]bool{}
 	for _, b := range bytes {
 		schedule, err := bytesToSchedule(b)
 		if err != nil {
-			return trainStops, err
+			return schedules, err
 		}
 
-		if !uniqueStops[schedule.StopID] {
-			trainStops = append(trainStops, schedule.StopID)
-		}
+		schedules = append(schedules, schedule)
 	}
 
-	return trainStops, nil
+	return schedules, nil
 }
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// initTestStore opens a store in its own directory so tests never share rows
+func initTestStore(t testing.TB) *Store {
+	dir, err := ioutil.TempDir("", scheduleDbName)
+	require.Nil(t, err)
+
+	store, err := openStore(dir)
+	require.Nil(t, err)
+
+	return store
+}
+
+func tearDownStore(store *Store) {
+	store.Destroy()
+}
+
+// trainsAt builds a csv of count trains arriving at stop 1 together
+func trainsAt(count int, at string) string {
+	rows := []string{strings.Join(expectedHeaders, ",")}
+	for i := 0; i < count; i++ {
+		rows = append(rows, fmt.Sprintf(`1,"C","t%03d","%s"`, i, at))
+	}
+
+	return strings.Join(rows, "\n")
+}
+
+func TestStoreLifetime(t *testing.T) {
+	t.Run("given two open stores", func(t *testing.T) {
+		first := initTestStore(t)
+		defer tearDownStore(first)
+		second := initTestStore(t)
+		defer tearDownStore(second)
+
+		require.Nil(t, first.csvHandler(trainsAt(2, "Jul 04 2021 07:42")))
+
+		t.Run("they will not share schedules", func(t *testing.T) {
+			schedules, err := second.getAllSchedules()
+			require.Nil(t, err)
+			assert.Len(t, schedules, 0)
+		})
+	})
+
+	t.Run("given a closed store", func(t *testing.T) {
+		store := initTestStore(t)
+		defer tearDownStore(store)
+		require.Nil(t, store.Close())
+
+		t.Run("queries and imports will error", func(t *testing.T) {
+			_, err := store.getTrainsByStopAndTime(1, "Jul 04 2021 07:42")
+			assert.Equal(t, errStoreClosed, err)
+			assert.Equal(t, errStoreClosed, store.insertSchedules([]Schedule{}))
+		})
+
+		t.Run("it can not be closed twice", func(t *testing.T) {
+			assert.Equal(t, errStoreClosed, store.Close())
+		})
+	})
+}
+
+// TestStoreConcurrency is meant to be run with -race
+func TestStoreConcurrency(t *testing.T) {
+	store := initTestStore(t)
+	defer tearDownStore(store)
+
+	morning, evening := trainsAt(6, "Jul 04 2021 07:42"), trainsAt(3, "Jul 04 2021 19:42")
+	require.Nil(t, store.csvHandler(morning))
+	jul04, _ := time.Parse(layout, "Jul 04 2021 12:00")
+
+	var (
+		wg   sync.WaitGroup
+		errs = make(chan error, 100)
+		done = make(chan struct{})
+	)
+
+	// imports swap the whole timetable back and forth
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		defer close(done)
+		for i := 0; i < 20; i++ {
+			upload := morning
+			if i%2 == 0 {
+				upload = evening
+			}
+			if _, err := store.replaceSchedules(upload, store.trainIDRules, false, defaultLintConfig()); err != nil {
+				errs <- err
+			}
+		}
+	}()
+
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+
+				schedules, err := store.getScheduleByDate(jul04)
+				if err != nil {
+					errs <- err
+					continue
+				}
+				// a half finished import would show a mix of both
+				if len(schedules) != 6 && len(schedules) != 3 {
+					errs <- fmt.Errorf("Query saw %d trains mid import", len(schedules))
+				}
+
+				if _, err := store.buildDepartureBoard(1, jul04); err != nil {
+					errs <- err
+				}
+			}
+		}()
+	}
+
+	wg.Wait()
+	close(errs)
+
+	t.Run("queries will only see whole imports", func(t *testing.T) {
+		for err := range errs {
+			assert.Nil(t, err)
+		}
+	})
+}
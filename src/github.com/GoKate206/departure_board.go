@@ -0,0 +1,235 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"sort"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+var (
+	// boardArrivalsPerGroup is how many upcoming trains a route shows
+	boardArrivalsPerGroup = 3
+	// boardRefreshSeconds is how often the HTML board reloads itself
+	boardRefreshSeconds = 30
+	// ledWidth is the number of characters on a line of an LED display
+	ledWidth = 24
+)
+
+type BoardArrival struct {
+	TrainID      string `json:"trainID"`
+	Time         string `json:"time"`
+	MinutesUntil int    `json:"minutesUntil"`
+	Status       string `json:"status,omitempty"`
+	// HeadwayMinutes replaces the minutes until for frequency based trains
+	HeadwayMinutes int    `json:"headwayMinutes,omitempty"`
+	Platform       string `json:"platform,omitempty"`
+	Track          string `json:"track,omitempty"`
+	// ScheduledPlatform is set when the train was moved from it
+	ScheduledPlatform string `json:"scheduledPlatform,omitempty"`
+	Headsign          string `json:"headsign,omitempty"`
+}
+
+// BoardGroup holds the upcoming arrivals of one route heading one
+// direction, Headsign is where its next train goes
+type BoardGroup struct {
+	Route     string         `json:"route"`
+	Direction string         `json:"direction,omitempty"`
+	Headsign  string         `json:"headsign,omitempty"`
+	Arrivals  []BoardArrival `json:"arrivals"`
+}
+
+type DepartureBoard struct {
+	StopID      int64        `json:"stopID"`
+	GeneratedAt string       `json:"generatedAt"`
+	Groups      []BoardGroup `json:"groups"`
+}
+
+// buildDepartureBoard collects the next trains at a stop from clock on,
+// grouped by route and direction. The rest of the service day is shown
+// along with the next day of service so late night boards are not empty
+func (s *Store) buildDepartureBoard(stopID int64, clock time.Time) (DepartureBoard, error) {
+	board := DepartureBoard{StopID: stopID, GeneratedAt: clock.Format(layout), Groups: []BoardGroup{}}
+	if err := s.rlock(); err != nil {
+		return board, err
+	}
+	defer s.mu.RUnlock()
+	groups := map[string]*BoardGroup{}
+	found := false
+
+	for i := 0; i <= lookaheadDays; i++ {
+		if found && i > 1 {
+			break
+		}
+
+		day, err := s.dayLocked(clock.AddDate(0, 0, i))
+		if err != nil {
+			return board, err
+		}
+
+		for _, n := range day.stopFrom(stopID, clock) {
+			schedule, trainTime := day.schedules[n], day.times[n]
+			found = true
+
+			key := schedule.Route + "|" + schedule.Direction
+			group, ok := groups[key]
+			if !ok {
+				group = &BoardGroup{Route: schedule.Route, Direction: schedule.Direction, Headsign: schedule.Headsign, Arrivals: []BoardArrival{}}
+				groups[key] = group
+			}
+
+			// a route running every so often is shown once with its headway
+			if len(group.Arrivals) < boardArrivalsPerGroup && !group.showsHeadway(schedule) {
+				group.Arrivals = append(group.Arrivals, BoardArrival{
+					TrainID:           schedule.TrainID,
+					Time:              schedule.Time,
+					MinutesUntil:      int(trainTime.Sub(clock) / time.Minute),
+					Status:            schedule.Status,
+					HeadwayMinutes:    schedule.HeadwayMinutes,
+					Platform:          schedule.Platform,
+					Track:             schedule.Track,
+					ScheduledPlatform: schedule.ScheduledPlatform,
+					Headsign:          schedule.Headsign,
+				})
+			}
+		}
+	}
+
+	for _, group := range groups {
+		board.Groups = append(board.Groups, *group)
+	}
+
+	// soonest route first, route name then direction breaks ties
+	sort.Slice(board.Groups, func(i, j int) bool {
+		a, b := board.Groups[i], board.Groups[j]
+		if a.Arrivals[0].MinutesUntil != b.Arrivals[0].MinutesUntil {
+			return a.Arrivals[0].MinutesUntil < b.Arrivals[0].MinutesUntil
+		}
+		if a.Route != b.Route {
+			return a.Route < b.Route
+		}
+
+		return a.Direction < b.Direction
+	})
+
+	return board, nil
+}
+
+func (g *BoardGroup) showsHeadway(schedule Schedule) bool {
+	if schedule.HeadwayMinutes == 0 {
+		return false
+	}
+
+	for _, arrival := range g.Arrivals {
+		if arrival.TrainID == schedule.TrainID && arrival.HeadwayMinutes > 0 {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Due is how the arrival is shown to riders, ex: "5 min"
+func (a BoardArrival) Due() string {
+	if a.Status == statusCancelled {
+		return "Cancelled"
+	}
+	if a.HeadwayMinutes > 0 {
+		return fmt.Sprintf("Every %d min", a.HeadwayMinutes)
+	}
+	if a.MinutesUntil == 0 {
+		return "Due"
+	}
+
+	return fmt.Sprintf("%d min", a.MinutesUntil)
+}
+
+// renderBoard renders a board as json, text or html
+func renderBoard(board DepartureBoard, format string) ([]byte, error) {
+	switch format {
+	case "", "json":
+		return json.MarshalIndent(board, "", "\t")
+	case "text":
+		return []byte(renderBoardText(board)), nil
+	case "html":
+		return renderBoardHTML(board)
+	}
+
+	return nil, errUnknownFormat(format)
+}
+
+func errUnknownFormat(format string) error {
+	return fmt.Errorf("Unknown board format: %s", format)
+}
+
+// renderBoardText lays the board out for LED displays,
+// every line is exactly ledWidth characters, counted in runes so
+// names outside ASCII are neither cut mid character nor padded short
+func renderBoardText(board DepartureBoard) string {
+	lines := []string{fmt.Sprintf("STOP %d %s", board.StopID, board.GeneratedAt[len(board.GeneratedAt)-5:])}
+	if len(board.Groups) == 0 {
+		lines = append(lines, "NO TRAINS SCHEDULED")
+	}
+
+	for _, group := range board.Groups {
+		for _, arrival := range group.Arrivals {
+			due := arrival.Due()
+			left := fmt.Sprintf("%-4s %s", group.Route, arrival.TrainID)
+			if arrival.Platform != "" {
+				left += " P" + arrival.Platform
+			}
+			if pad := ledWidth - utf8.RuneCountInString(left) - utf8.RuneCountInString(due); pad > 0 {
+				left += strings.Repeat(" ", pad)
+			}
+			lines = append(lines, left+due)
+		}
+	}
+
+	for i, line := range lines {
+		runes := []rune(strings.ToUpper(line))
+		if len(runes) > ledWidth {
+			runes = runes[:ledWidth]
+		}
+		lines[i] = string(runes) + strings.Repeat(" ", ledWidth-len(runes))
+	}
+
+	return strings.Join(lines, "\n") + "\n"
+}
+
+var boardTemplate = template.Must(template.New("board").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<meta http-equiv="refresh" content="{{.Refresh}}">
+<title>Stop {{.Board.StopID}} departures</title>
+</head>
+<body>
+<h1>Stop {{.Board.StopID}}</h1>
+<p>Updated {{.Board.GeneratedAt}}</p>
+{{- range .Board.Groups}}
+<h2>Route {{.Route}}{{with .Headsign}} to {{.}}{{end}}</h2>
+<table>
+{{- range .Arrivals}}
+<tr><td>{{.TrainID}}</td><td>{{.Time}}</td><td>{{.Due}}</td>{{if .Platform}}<td>Platform {{.Platform}}{{with .ScheduledPlatform}} ( changed from {{.}} ){{end}}</td>{{end}}</tr>
+{{- end}}
+</table>
+{{- else}}
+<p>No trains scheduled</p>
+{{- end}}
+</body>
+</html>
+`))
+
+func renderBoardHTML(board DepartureBoard) ([]byte, error) {
+	var b bytes.Buffer
+	err := boardTemplate.Execute(&b, struct {
+		Board   DepartureBoard
+		Refresh int
+	}{board, boardRefreshSeconds})
+
+	return b.Bytes(), err
+}
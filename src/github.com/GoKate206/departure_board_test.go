@@ -0,0 +1,114 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+	"unicode/utf8"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBuildDepartureBoard(t *testing.T) {
+	store := initTestStore(t)
+	defer tearDownStore(store)
+
+	store.csvHandler(`stopID,route,trainID,time
+1,"C","865a","Jul 04 2021 07:14"
+1,"C","865a","Jul 04 2021 07:42"
+1,"C","kpr5","Jul 04 2021 08:10"
+1,"C","kpr5","Jul 04 2021 08:34"
+1,"C","kpr5","Jul 04 2021 09:04"
+1,"55","465a","Jul 04 2021 07:30"
+2,"55","465a","Jul 04 2021 07:35"
+1,"55","465a","Jul 05 2021 06:00"`)
+	clock, _ := time.Parse(layout, "Jul 04 2021 07:30")
+
+	t.Run("when a board is built for a stop", func(t *testing.T) {
+		board, err := store.buildDepartureBoard(1, clock)
+		require.Nil(t, err)
+
+		t.Run("it will group upcoming trains by route, soonest first", func(t *testing.T) {
+			require.Len(t, board.Groups, 2)
+			assert.EqualValues(t, "55", board.Groups[0].Route)
+			assert.EqualValues(t, "C", board.Groups[1].Route)
+		})
+
+		t.Run("it will show minutes until each arrival", func(t *testing.T) {
+			assert.EqualValues(t, 0, board.Groups[0].Arrivals[0].MinutesUntil)
+			assert.EqualValues(t, 1440-90, board.Groups[0].Arrivals[1].MinutesUntil)
+			assert.EqualValues(t, 12, board.Groups[1].Arrivals[0].MinutesUntil)
+		})
+
+		t.Run("it will limit the arrivals shown per route", func(t *testing.T) {
+			assert.Len(t, board.Groups[1].Arrivals, boardArrivalsPerGroup)
+		})
+
+		t.Run("it will render as json", func(t *testing.T) {
+			b, err := renderBoard(board, "json")
+			require.Nil(t, err)
+
+			decoded := DepartureBoard{}
+			require.Nil(t, json.Unmarshal(b, &decoded))
+			assert.EqualValues(t, board, decoded)
+		})
+
+		t.Run("it will render fixed width text for LED displays", func(t *testing.T) {
+			b, err := renderBoard(board, "text")
+			require.Nil(t, err)
+
+			lines := strings.Split(strings.TrimSuffix(string(b), "\n"), "\n")
+			require.Len(t, lines, 6)
+			assert.EqualValues(t, "STOP 1 07:30            ", lines[0])
+			assert.EqualValues(t, "55   465A            DUE", lines[1])
+			assert.EqualValues(t, "C    865A         12 MIN", lines[3])
+			for _, line := range lines {
+				assert.Len(t, line, ledWidth)
+			}
+		})
+
+		t.Run("it will render a self refreshing html page", func(t *testing.T) {
+			b, err := renderBoard(board, "html")
+			require.Nil(t, err)
+			assert.Contains(t, string(b), `<meta http-equiv="refresh" content="30">`)
+			assert.Contains(t, string(b), "<h2>Route C</h2>")
+			assert.Contains(t, string(b), "<td>kpr5</td><td>Jul 04 2021 08:34</td><td>64 min</td>")
+		})
+	})
+
+	t.Run("when a board is built for a stop with no trains", func(t *testing.T) {
+		board, err := store.buildDepartureBoard(9, clock)
+		require.Nil(t, err)
+		assert.Len(t, board.Groups, 0)
+
+		b, err := renderBoard(board, "text")
+		require.Nil(t, err)
+		assert.Contains(t, string(b), "NO TRAINS SCHEDULED")
+	})
+
+	t.Run("when names are not ASCII", func(t *testing.T) {
+		board := DepartureBoard{StopID: 1, GeneratedAt: "Jul 04 2021 07:30", Groups: []BoardGroup{{
+			Route:    "Ö",
+			Arrivals: []BoardArrival{{TrainID: "zürich-gare-de-lyon-express", MinutesUntil: 5}},
+		}}}
+		b, err := renderBoard(board, "text")
+		require.Nil(t, err)
+		lines := strings.Split(strings.TrimSuffix(string(b), "\n"), "\n")
+
+		t.Run("it will cut and pad them by character", func(t *testing.T) {
+			require.Len(t, lines, 2)
+			assert.True(t, utf8.ValidString(lines[1]))
+			assert.EqualValues(t, "Ö    ZÜRICH-GARE-DE-LYON", lines[1])
+			for _, line := range lines {
+				assert.EqualValues(t, ledWidth, utf8.RuneCountInString(line))
+			}
+		})
+	})
+
+	t.Run("when rendered in an unknown format", func(t *testing.T) {
+		_, err := renderBoard(DepartureBoard{}, "pdf")
+		assert.EqualValues(t, "Unknown board format: pdf", err.Error())
+	})
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// StopQuery narrows a stop query, the zero value returns every train
+type StopQuery struct {
+	Access AccessOptions
+	// Direction keeps only trains heading that way when set
+	Direction string
+	// GroupByDirection fills NextTrains.Directions
+	GroupByDirection bool
+}
+
+// DirectionGroup is the trains of a stop query heading one way, with
+// the destinations they show
+type DirectionGroup struct {
+	Direction string     `json:"direction"`
+	Headsigns []string   `json:"headsigns"`
+	Trains    []Schedule `json:"trains"`
+}
+
+// parseDirection reads a direction ID, GTFS uses 0 and 1 but agencies
+// may use labels like inbound
+func parseDirection(value string) (string, error) {
+	value = strings.TrimSpace(value)
+	if len(value) > 16 {
+		return "", fmt.Errorf("Direction must be at most 16 characters, got: %s", value)
+	}
+
+	return value, nil
+}
+
+func parseHeadsign(value string) (string, error) {
+	value = strings.TrimSpace(value)
+	if len(value) > 64 {
+		return "", fmt.Errorf("Headsign must be at most 64 characters, got: %s", value)
+	}
+
+	return value, nil
+}
+
+// inDirection keeps the trains heading direction
+func inDirection(trains []Schedule, direction string) []Schedule {
+	heading := []Schedule{}
+	for _, train := range trains {
+		if train.Direction == direction {
+			heading = append(heading, train)
+		}
+	}
+
+	return heading
+}
+
+// groupByDirection groups trains by direction, in direction order,
+// trains without one are grouped under an empty direction
+func groupByDirection(trains []Schedule) []DirectionGroup {
+	groups := []DirectionGroup{}
+	index := map[string]int{}
+	for _, train := range trains {
+		i, ok := index[train.Direction]
+		if !ok {
+			i = len(groups)
+			index[train.Direction] = i
+			groups = append(groups, DirectionGroup{Direction: train.Direction, Headsigns: []string{}, Trains: []Schedule{}})
+		}
+
+		group := &groups[i]
+		group.Trains = append(group.Trains, train)
+		if train.Headsign != "" && !containsString(group.Headsigns, train.Headsign) {
+			group.Headsigns = append(group.Headsigns, train.Headsign)
+		}
+	}
+
+	sort.SliceStable(groups, func(i, j int) bool { return groups[i].Direction < groups[j].Direction })
+
+	return groups
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDirections(t *testing.T) {
+	store := initTestStore(t)
+	defer tearDownStore(store)
+	require.Nil(t, store.csvHandler(`stopID,route,trainID,time,direction,headsign
+1,"C","865a","Jul 04 2021 07:42",0,Airport
+1,"C","866a","Jul 04 2021 07:42",1,Downtown
+1,"C","867a","Jul 04 2021 07:42",1,Market
+1,"55","465a","Jul 04 2021 07:42",0,Harbour`))
+
+	t.Run("when asking for one direction", func(t *testing.T) {
+		next, err := store.getNextTrainsFor(1, "Jul 04 2021 07:42", StopQuery{Direction: "1"})
+		require.Nil(t, err)
+
+		t.Run("it will only return trains heading that way", func(t *testing.T) {
+			require.Len(t, next.Trains, 2)
+			for _, train := range next.Trains {
+				assert.EqualValues(t, "1", train.Direction)
+			}
+		})
+	})
+
+	t.Run("when one direction's pair arrives after a mixed pair", func(t *testing.T) {
+		store := initTestStore(t)
+		defer tearDownStore(store)
+		require.Nil(t, store.csvHandler(`stopID,route,trainID,time,direction
+1,"C","865a","Jul 04 2021 07:42",0
+1,"C","866a","Jul 04 2021 07:42",1
+1,"C","965a","Jul 05 2021 07:42",0
+1,"C","966a","Jul 05 2021 07:42",1
+1,"C","967a","Jul 05 2021 08:00",1
+1,"D","968a","Jul 05 2021 08:00",1`))
+
+		t.Run("it will not answer with the lone train heading that way", func(t *testing.T) {
+			next, err := store.getNextTrainsFor(1, "Jul 04 2021 07:42", StopQuery{Direction: "1"})
+			require.Nil(t, err)
+			assert.Len(t, next.Trains, 0)
+		})
+
+		t.Run("it will look on for the pair heading that way", func(t *testing.T) {
+			next, err := store.getNextTrainsFor(1, "Jul 04 2021 09:00", StopQuery{Direction: "1"})
+			require.Nil(t, err)
+			require.Len(t, next.Trains, 2)
+			assert.EqualValues(t, "Jul 05 2021", next.Date)
+			assert.EqualValues(t, "967a", next.Trains[0].TrainID)
+			assert.EqualValues(t, "968a", next.Trains[1].TrainID)
+		})
+	})
+
+	t.Run("when grouping by direction", func(t *testing.T) {
+		next, err := store.getNextTrainsFor(1, "Jul 04 2021 07:42", StopQuery{GroupByDirection: true})
+		require.Nil(t, err)
+
+		t.Run("it will group trains with their headsigns", func(t *testing.T) {
+			require.Len(t, next.Directions, 2)
+			assert.EqualValues(t, "0", next.Directions[0].Direction)
+			assert.ElementsMatch(t, []string{"Airport", "Harbour"}, next.Directions[0].Headsigns)
+			assert.Len(t, next.Directions[1].Trains, 2)
+			assert.ElementsMatch(t, []string{"Downtown", "Market"}, next.Directions[1].Headsigns)
+		})
+	})
+
+	t.Run("when building a board", func(t *testing.T) {
+		clock, _ := time.Parse(layout, "Jul 04 2021 07:40")
+		board, err := store.buildDepartureBoard(1, clock)
+		require.Nil(t, err)
+
+		t.Run("it will group a route by direction", func(t *testing.T) {
+			require.Len(t, board.Groups, 3)
+			assert.EqualValues(t, []string{"55", "C", "C"}, []string{board.Groups[0].Route, board.Groups[1].Route, board.Groups[2].Route})
+			assert.EqualValues(t, "0", board.Groups[1].Direction)
+			assert.EqualValues(t, "Airport", board.Groups[1].Headsign)
+		})
+	})
+
+	t.Run("when a headsign is too long", func(t *testing.T) {
+		_, err := parseHeadsign(string(make([]byte, 65)))
+		assert.Error(t, err)
+	})
+
+	t.Run("when asking the server to group by direction", func(t *testing.T) {
+		srv := httptest.NewServer(newServer(store))
+		defer srv.Close()
+		res, err := http.Get(srv.URL + "/stops/1/next?groupBy=direction&direction=0&time=" + url.QueryEscape("Jul 04 2021 07:42"))
+		require.Nil(t, err)
+		defer res.Body.Close()
+
+		next := NextTrains{}
+		require.Nil(t, json.NewDecoder(res.Body).Decode(&next))
+
+		t.Run("it will filter then group", func(t *testing.T) {
+			require.Len(t, next.Directions, 1)
+			assert.Len(t, next.Directions[0].Trains, 2)
+		})
+	})
+}
@@ -0,0 +1,354 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	frequencyDbName  = "frequencies"
+	frequencyHeaders = []string{"stopID", "route", "trainID", "serviceDay", "startTime", "endTime", "headwaySecs", "exactTimes"}
+	// frequencyPatternHeaders are optional columns after frequencyHeaders
+	frequencyPatternHeaders = []string{"until", "days", "stops"}
+)
+
+// Frequency is a GTFS frequencies.txt style definition, a train every
+// HeadwaySecs from StartTime until before EndTime. Times are HH:MM on the
+// service day and may run past 24:00. Without ExactTimes the arrivals are
+// only an estimate and riders are shown the headway instead.
+// It runs on ServiceDay, or every day from ServiceDay to Until on the Days
+// of the week given, and calls at StopID then each of Calls in turn
+type Frequency struct {
+	ID          string          `json:"ID"`
+	StopID      int64           `json:"stopID"`
+	Route       string          `json:"route"`
+	TrainID     string          `json:"trainID"`
+	ServiceDay  string          `json:"serviceDay"`
+	Until       string          `json:"until,omitempty"`
+	Days        []string        `json:"days,omitempty"`
+	StartTime   string          `json:"startTime"`
+	EndTime     string          `json:"endTime"`
+	HeadwaySecs int             `json:"headwaySecs"`
+	ExactTimes  bool            `json:"exactTimes"`
+	Calls       []FrequencyCall `json:"calls,omitempty"`
+}
+
+// FrequencyCall is a stop a frequency calls at, OffsetMinutes after StopID
+type FrequencyCall struct {
+	StopID        int64 `json:"stopID"`
+	OffsetMinutes int   `json:"offsetMinutes"`
+}
+
+// lastDay is the last service day the definition runs on
+func (f Frequency) lastDay() string {
+	if f.Until == "" {
+		return f.ServiceDay
+	}
+
+	return f.Until
+}
+
+func (f Frequency) bounds(day string) (time.Time, time.Time, error) {
+	start, _, err := parseScheduleTime(fmt.Sprintf("%s %s", day, f.StartTime))
+	if err != nil {
+		return start, start, err
+	}
+
+	end, _, err := parseScheduleTime(fmt.Sprintf("%s %s", day, f.EndTime))
+	return start, end, err
+}
+
+// runsOn tells if the definition runs on a service day
+func (f Frequency) runsOn(day string) bool {
+	date, err := time.Parse(dateLayout, day)
+	if err != nil {
+		return false
+	}
+	first, err := time.Parse(dateLayout, f.ServiceDay)
+	if err != nil {
+		return false
+	}
+	last, err := time.Parse(dateLayout, f.lastDay())
+	if err != nil {
+		return false
+	}
+
+	return !date.Before(first) && !date.After(last) &&
+		(len(f.Days) == 0 || containsString(f.Days, date.Weekday().String()[:3]))
+}
+
+// validate normalizes the definition, days become Mon, Tue, ...
+func (f Frequency) validate(rules TrainIDRules) (Frequency, error) {
+	if _, err := rules.validate(f.TrainID); err != nil {
+		return f, err
+	}
+	if f.HeadwaySecs < 60 {
+		return f, fmt.Errorf("Headway must be at least 60 seconds, got: %d", f.HeadwaySecs)
+	}
+
+	start, end, err := f.bounds(f.ServiceDay)
+	if err != nil {
+		return f, err
+	}
+	if !start.Before(end) {
+		return f, fmt.Errorf("Start time must be before end time: %s - %s", f.StartTime, f.EndTime)
+	}
+
+	if f.Until != "" {
+		first, _ := time.Parse(dateLayout, f.ServiceDay)
+		last, err := time.Parse(dateLayout, f.Until)
+		if err != nil {
+			return f, err
+		}
+		if last.Before(first) {
+			return f, fmt.Errorf("Until must not be before the service day: %s - %s", f.ServiceDay, f.Until)
+		}
+		f.Until = last.Format(dateLayout)
+	}
+
+	days := []string{}
+	for _, value := range f.Days {
+		day, err := parseWeekday(value)
+		if err != nil {
+			return f, err
+		}
+		if !containsString(days, day.String()[:3]) {
+			days = append(days, day.String()[:3])
+		}
+	}
+	f.Days = days
+
+	if _, end, err = f.bounds(f.lastDay()); err != nil {
+		return f, err
+	}
+	if end.Before(timeNow()) {
+		return f, fmt.Errorf("Scheduled time must be in the future")
+	}
+
+	for _, call := range f.Calls {
+		if call.OffsetMinutes <= 0 {
+			return f, fmt.Errorf("Stop offsets must be after the first stop, got: %d", call.OffsetMinutes)
+		}
+	}
+
+	return f, nil
+}
+
+// expand lists the arrivals the definition stands for on its first service day
+func (f Frequency) expand() []Schedule {
+	return f.expandOn(f.ServiceDay)
+}
+
+// expandOn lists the arrivals of each run at every stop on a service day
+func (f Frequency) expandOn(day string) []Schedule {
+	schedules := []Schedule{}
+	start, end, err := f.bounds(day)
+	if err != nil {
+		return schedules
+	}
+
+	headway := 0
+	if !f.ExactTimes {
+		headway = f.HeadwaySecs / 60
+	}
+
+	calls := append([]FrequencyCall{{StopID: f.StopID}}, f.Calls...)
+	for t := start; t.Before(end); t = t.Add(time.Duration(f.HeadwaySecs) * time.Second) {
+		for _, call := range calls {
+			schedules = append(schedules, Schedule{
+				StopID:         call.StopID,
+				Route:          f.Route,
+				TrainID:        f.TrainID,
+				Time:           t.Add(time.Duration(call.OffsetMinutes) * time.Minute).Format(layout),
+				ID:             f.ID,
+				ServiceDay:     day,
+				HeadwayMinutes: headway,
+			})
+		}
+	}
+
+	return schedules
+}
+
+// parseFrequencyCalls reads the stops column, stopID:minutes pairs
+// separated by spaces giving the stops after the first
+func parseFrequencyCalls(value string) ([]FrequencyCall, error) {
+	calls := []FrequencyCall{}
+	for _, field := range strings.Fields(value) {
+		parts := strings.Split(field, ":")
+		if len(parts) != 2 {
+			return calls, fmt.Errorf("Stops must be stopID:minutes, got: %s", field)
+		}
+
+		stopID, err := strconv.ParseInt(parts[0], 10, 64)
+		if err != nil {
+			return calls, err
+		}
+		offset, err := strconv.Atoi(parts[1])
+		if err != nil {
+			return calls, err
+		}
+
+		calls = append(calls, FrequencyCall{StopID: stopID, OffsetMinutes: offset})
+	}
+
+	return calls, nil
+}
+
+// readFrequencyCsv parses definitions with frequencyHeaders, optionally
+// followed by frequencyPatternHeaders. exactTimes is 1 for exact times and
+// 0, or empty, for a headway. until is the last service day, days the
+// days of the week separated by spaces and stops the later calls
+func readFrequencyCsv(givenCsv string, rules TrainIDRules) ([]Frequency, error) {
+	frequencies := []Frequency{}
+	records, err := csv.NewReader(strings.NewReader(givenCsv)).ReadAll()
+	if err != nil || len(records) == 0 {
+		return frequencies, err
+	}
+
+	header := strings.Join(records[0], ",")
+	patterned := header == strings.Join(append(append([]string{}, frequencyHeaders...), frequencyPatternHeaders...), ",")
+	if header != strings.Join(frequencyHeaders, ",") && !patterned {
+		return frequencies, fmt.Errorf("Incorrect header. Expected %s", strings.Join(frequencyHeaders, ","))
+	}
+
+	for _, record := range records[1:] {
+		stopID, err := strconv.ParseInt(record[0], 10, 64)
+		if err != nil {
+			return nil, err
+		}
+
+		headway, err := strconv.Atoi(record[6])
+		if err != nil {
+			return nil, err
+		}
+
+		if record[7] != "" && record[7] != "0" && record[7] != "1" {
+			return nil, fmt.Errorf("exactTimes must be 0 or 1, got: %s", record[7])
+		}
+
+		frequency := Frequency{
+			StopID:      stopID,
+			Route:       record[1],
+			TrainID:     record[2],
+			ServiceDay:  record[3],
+			StartTime:   record[4],
+			EndTime:     record[5],
+			HeadwaySecs: headway,
+			ExactTimes:  record[7] == "1",
+		}
+		if patterned {
+			frequency.Until = record[8]
+			frequency.Days = strings.Fields(record[9])
+			if frequency.Calls, err = parseFrequencyCalls(record[10]); err != nil {
+				return nil, err
+			}
+		}
+
+		if frequency, err = frequency.validate(rules); err != nil {
+			return nil, err
+		}
+
+		frequencies = append(frequencies, frequency)
+	}
+
+	return frequencies, nil
+}
+
+func (s *Store) insertFrequencies(frequencies []Frequency) ([]Frequency, error) {
+	if err := s.lock(); err != nil {
+		return frequencies, err
+	}
+	defer s.mu.Unlock()
+	defer s.invalidateLocked(frequencyDbName)
+
+	for i := range frequencies {
+		frequencies[i].ID = newID()
+		if err := s.driver.Write(frequencyDbName, frequencies[i].ID, &frequencies[i]); err != nil {
+			return frequencies, err
+		}
+	}
+
+	if len(frequencies) > 0 {
+		calls := []Schedule{}
+		for _, frequency := range frequencies {
+			calls = append(calls, Schedule{StopID: frequency.StopID, Route: frequency.Route, TrainID: frequency.TrainID})
+			for _, call := range frequency.Calls {
+				calls = append(calls, Schedule{StopID: call.StopID, Route: frequency.Route, TrainID: frequency.TrainID})
+			}
+		}
+		change := changeOf(changeOverrideAdded, calls)
+		change.Collection = frequencyDbName
+		s.publishLocked(change)
+	}
+
+	return frequencies, nil
+}
+
+func (s *Store) getFrequencies() ([]Frequency, error) {
+	if err := s.rlock(); err != nil {
+		return []Frequency{}, err
+	}
+	defer s.mu.RUnlock()
+
+	return s.getFrequenciesLocked()
+}
+
+// getFrequenciesLocked returns every definition, cached until one is written
+func (s *Store) getFrequenciesLocked() ([]Frequency, error) {
+	s.cacheMu.Lock()
+	defer s.cacheMu.Unlock()
+
+	if s.frequencies != nil {
+		return s.frequencies, nil
+	}
+
+	frequencies := []Frequency{}
+	bytes, err := s.driver.ReadAll(frequencyDbName)
+	// ReadAll will error if there are no rows,
+	// only error if there are rows
+	if len(bytes) > 0 && err != nil {
+		return frequencies, err
+	}
+
+	for _, b := range bytes {
+		frequency := Frequency{}
+		if err := json.Unmarshal(b, &frequency); err != nil {
+			return frequencies, err
+		}
+		frequencies = append(frequencies, frequency)
+	}
+	s.frequencies = frequencies
+
+	return frequencies, nil
+}
+
+// frequencyDayLocked expands the definitions running on a service day
+func (s *Store) frequencyDayLocked(day string) (*dayIndex, error) {
+	frequencies, err := s.getFrequenciesLocked()
+	if err != nil {
+		return nil, err
+	}
+
+	var expanded *dayIndex
+	for _, frequency := range frequencies {
+		if !frequency.runsOn(day) {
+			continue
+		}
+		if expanded == nil {
+			expanded = &dayIndex{}
+		}
+
+		for _, schedule := range frequency.expandOn(day) {
+			trainTime, _ := time.Parse(layout, schedule.Time)
+			expanded.schedules = append(expanded.schedules, schedule)
+			expanded.times = append(expanded.times, trainTime)
+		}
+	}
+
+	return expanded, nil
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReadFrequencyCsv(t *testing.T) {
+	t.Run("when given a valid definition", func(t *testing.T) {
+		frequencies, err := readFrequencyCsv(`stopID,route,trainID,serviceDay,startTime,endTime,headwaySecs,exactTimes
+1,"C","f001","Jul 04 2021","06:00","10:00",480,0
+1,"55","f002","Jul 04 2021","23:00","25:00",1800,1`, defaultTrainIDRules())
+		require.Nil(t, err)
+		require.Len(t, frequencies, 2)
+
+		t.Run("it will expand into arrivals before the end time", func(t *testing.T) {
+			schedules := frequencies[0].expand()
+			assert.Len(t, schedules, 30)
+			assert.EqualValues(t, "Jul 04 2021 06:00", schedules[0].Time)
+			assert.EqualValues(t, "Jul 04 2021 09:52", schedules[29].Time)
+			assert.EqualValues(t, 8, schedules[0].HeadwayMinutes)
+		})
+
+		t.Run("exact times will run past midnight on the service day", func(t *testing.T) {
+			schedules := frequencies[1].expand()
+			require.Len(t, schedules, 4)
+			assert.EqualValues(t, "Jul 05 2021 00:30", schedules[3].Time)
+			assert.EqualValues(t, "Jul 04 2021", schedules[3].ServiceDay)
+			assert.EqualValues(t, 0, schedules[3].HeadwayMinutes)
+		})
+	})
+
+	t.Run("when given a definition over days and stops", func(t *testing.T) {
+		frequencies, err := readFrequencyCsv(`stopID,route,trainID,serviceDay,startTime,endTime,headwaySecs,exactTimes,until,days,stops
+1,"C","f001","Jul 05 2021","06:00","07:00",1200,1,"Jul 18 2021","monday sat","2:4 3:9"`, defaultTrainIDRules())
+		require.Nil(t, err)
+		require.Len(t, frequencies, 1)
+		frequency := frequencies[0]
+
+		t.Run("it will run on the days of the week in its range", func(t *testing.T) {
+			assert.EqualValues(t, []string{"Mon", "Sat"}, frequency.Days)
+			// Jul 05 and 12 2021 are Mondays, Jul 10 and 17 Saturdays
+			for _, day := range []string{"Jul 05 2021", "Jul 10 2021", "Jul 12 2021", "Jul 17 2021"} {
+				assert.True(t, frequency.runsOn(day), day)
+			}
+			for _, day := range []string{"Jul 04 2021", "Jul 06 2021", "Jul 19 2021"} {
+				assert.False(t, frequency.runsOn(day), day)
+			}
+		})
+
+		t.Run("each run will call at every stop in turn", func(t *testing.T) {
+			schedules := frequency.expandOn("Jul 10 2021")
+			require.Len(t, schedules, 9)
+			assert.EqualValues(t, []int64{1, 2, 3}, []int64{schedules[3].StopID, schedules[4].StopID, schedules[5].StopID})
+			assert.EqualValues(t, "Jul 10 2021 06:20", schedules[3].Time)
+			assert.EqualValues(t, "Jul 10 2021 06:24", schedules[4].Time)
+			assert.EqualValues(t, "Jul 10 2021 06:29", schedules[5].Time)
+			assert.EqualValues(t, "Jul 10 2021", schedules[5].ServiceDay)
+		})
+	})
+
+	t.Run("when given invalid definitions", func(t *testing.T) {
+		header := "stopID,route,trainID,serviceDay,startTime,endTime,headwaySecs,exactTimes\n"
+		cases := map[string]string{
+			`1,"C","f001","Jul 04 2021","06:00","10:00",30,0`:  "Headway must be at least 60 seconds, got: 30",
+			`1,"C","f001","Jul 04 2021","10:00","06:00",480,0`: "Start time must be before end time: 10:00 - 06:00",
+			`1,"C","f001","Jun 04 2021","06:00","10:00",480,0`: "Scheduled time must be in the future",
+			`1,"C","f01","Jul 04 2021","06:00","10:00",480,0`:  "Train Id is invalid, too few characters: f01",
+			`1,"C","f001","Jul 04 2021","06:00","10:00",480,2`: "exactTimes must be 0 or 1, got: 2",
+		}
+
+		for row, expected := range cases {
+			_, err := readFrequencyCsv(header+row, defaultTrainIDRules())
+			require.Error(t, err)
+			assert.EqualValues(t, expected, err.Error())
+		}
+
+		header = "stopID,route,trainID,serviceDay,startTime,endTime,headwaySecs,exactTimes,until,days,stops\n"
+		cases = map[string]string{
+			`1,"C","f001","Jul 04 2021","06:00","10:00",480,0,"Jul 01 2021","",""`: "Until must not be before the service day: Jul 04 2021 - Jul 01 2021",
+			`1,"C","f001","Jul 04 2021","06:00","10:00",480,0,"","someday",""`:     "Day must be a day of the week, got: someday",
+			`1,"C","f001","Jul 04 2021","06:00","10:00",480,0,"","","2-4"`:         "Stops must be stopID:minutes, got: 2-4",
+			`1,"C","f001","Jul 04 2021","06:00","10:00",480,0,"","","2:0"`:         "Stop offsets must be after the first stop, got: 0",
+			`1,"C","f001","Jun 04 2021","06:00","10:00",480,0,"Jun 30 2021","",""`: "Scheduled time must be in the future",
+		}
+
+		for row, expected := range cases {
+			_, err := readFrequencyCsv(header+row, defaultTrainIDRules())
+			require.Error(t, err)
+			assert.EqualValues(t, expected, err.Error())
+		}
+	})
+}
+
+func TestFrequencyQueries(t *testing.T) {
+	store := initTestStore(t)
+	defer tearDownStore(store)
+	require.Nil(t, store.csvHandler(`stopID,route,trainID,time
+1,"55","465a","Jul 04 2021 06:16"`))
+
+	frequencies, err := readFrequencyCsv(`stopID,route,trainID,serviceDay,startTime,endTime,headwaySecs,exactTimes
+1,"C","f001","Jul 04 2021","06:00","07:00",480,0`, defaultTrainIDRules())
+	require.Nil(t, err)
+	_, err = store.insertFrequencies(frequencies)
+	require.Nil(t, err)
+
+	t.Run("when a stop is queried at a frequency arrival", func(t *testing.T) {
+		trains, err := store.getTrainsByStopAndTime(1, "Jul 04 2021 06:16")
+		require.Nil(t, err)
+
+		t.Run("it will be returned with the timetabled train", func(t *testing.T) {
+			require.Len(t, trains, 2)
+			assert.EqualValues(t, 8, trains[0].HeadwayMinutes+trains[1].HeadwayMinutes)
+		})
+	})
+
+	t.Run("when a definition runs over days and stops", func(t *testing.T) {
+		frequencies, err := readFrequencyCsv(`stopID,route,trainID,serviceDay,startTime,endTime,headwaySecs,exactTimes,until,days,stops
+1,"21","f002","Jul 05 2021","08:00","09:00",1800,1,"Jul 31 2021","Tue","2:5"`, defaultTrainIDRules())
+		require.Nil(t, err)
+		_, err = store.insertFrequencies(frequencies)
+		require.Nil(t, err)
+		// Jul 13 2021 is a Tuesday
+		tuesday, _ := time.Parse(layout, "Jul 13 2021 12:00")
+		wednesday, _ := time.Parse(layout, "Jul 14 2021 12:00")
+
+		t.Run("its days will have its runs at every stop", func(t *testing.T) {
+			schedules, err := store.getScheduleByDate(tuesday)
+			require.Nil(t, err)
+			require.Len(t, schedules, 4)
+			assert.EqualValues(t, 2, schedules[1].StopID)
+			assert.EqualValues(t, "Jul 13 2021 08:05", schedules[1].Time)
+
+			schedules, err = store.getScheduleByDate(wednesday)
+			require.Nil(t, err)
+			assert.Len(t, schedules, 0)
+		})
+	})
+
+	t.Run("when a board is built", func(t *testing.T) {
+		clock, _ := time.Parse(layout, "Jul 04 2021 06:10")
+		board, err := store.buildDepartureBoard(1, clock)
+		require.Nil(t, err)
+
+		t.Run("the frequency route will show its headway once", func(t *testing.T) {
+			require.Len(t, board.Groups, 2)
+			route := board.Groups[1]
+			assert.EqualValues(t, "C", route.Route)
+			require.Len(t, route.Arrivals, 1)
+			assert.EqualValues(t, "Every 8 min", route.Arrivals[0].Due())
+		})
+	})
+}
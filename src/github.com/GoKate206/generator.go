@@ -0,0 +1,110 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// NetworkConfig describes a synthetic network for benchmarks and load tests
+type NetworkConfig struct {
+	Stops         int
+	Routes        int
+	StopsPerRoute int
+	// HeadwayMinutes between trains on weekdays, weekends run half as often
+	HeadwayMinutes int
+	// FirstTrain and LastTrain are the minutes after midnight trains leave
+	// the first stop of a route, runs can finish after midnight
+	FirstTrain int
+	LastTrain  int
+	StartDate  time.Time
+	Days       int
+	Seed       int64
+}
+
+func defaultNetworkConfig(startDate time.Time) NetworkConfig {
+	return NetworkConfig{
+		Stops:          100,
+		Routes:         10,
+		StopsPerRoute:  12,
+		HeadwayMinutes: 10,
+		FirstTrain:     5 * 60,
+		LastTrain:      23*60 + 30,
+		StartDate:      startDate,
+		Days:           1,
+		Seed:           1,
+	}
+}
+
+type generatedRoute struct {
+	name   string
+	stops  []int64
+	travel []int // minutes from the first stop
+	offset int   // minutes after the first train time the route starts
+}
+
+// generateNetwork writes a timetable in the CSV upload format. Every route
+// runs through its own random stops, a train run visits them in order
+func generateNetwork(cfg NetworkConfig) (string, error) {
+	if cfg.Stops < 1 || cfg.Routes < 1 || cfg.StopsPerRoute < 1 || cfg.HeadwayMinutes < 1 || cfg.Days < 1 {
+		return "", fmt.Errorf("Stops, routes, stops per route, headway and days must be positive")
+	}
+	if cfg.StopsPerRoute > cfg.Stops {
+		return "", fmt.Errorf("Stops per route can not be more than %d stops", cfg.Stops)
+	}
+
+	random := rand.New(rand.NewSource(cfg.Seed))
+	routes := make([]generatedRoute, cfg.Routes)
+	for i := range routes {
+		route := generatedRoute{name: routeName(i), offset: random.Intn(cfg.HeadwayMinutes)}
+		minutes := 0
+		for _, stop := range random.Perm(cfg.Stops)[:cfg.StopsPerRoute] {
+			route.stops = append(route.stops, int64(stop+1))
+			route.travel = append(route.travel, minutes)
+			minutes += 2 + random.Intn(4)
+		}
+		routes[i] = route
+	}
+
+	var b strings.Builder
+	b.WriteString(strings.Join(expectedHeaders, ","))
+	run := 0
+	for day := 0; day < cfg.Days; day++ {
+		date := cfg.StartDate.AddDate(0, 0, day)
+		headway := cfg.HeadwayMinutes
+		if weekday := date.Weekday(); weekday == time.Saturday || weekday == time.Sunday {
+			headway *= 2
+		}
+
+		for _, route := range routes {
+			for start := cfg.FirstTrain + route.offset; start <= cfg.LastTrain; start += headway {
+				trainID := generatedTrainID(run)
+				run++
+				for i, stop := range route.stops {
+					arrival := date.Add(time.Duration(start+route.travel[i]) * time.Minute)
+					fmt.Fprintf(&b, "\n%d,%s,%s,%s", stop, route.name, trainID, arrival.Format(layout))
+				}
+			}
+		}
+	}
+
+	return b.String(), nil
+}
+
+// routeName names routes A..Z then A1..Z1 and so on
+func routeName(i int) string {
+	name := string(rune('A' + i%26))
+	if i >= 26 {
+		name += strconv.Itoa(i / 26)
+	}
+
+	return name
+}
+
+// generatedTrainID is a 4 character base 36 ID, unique for 36^4 runs
+func generatedTrainID(run int) string {
+	id := strconv.FormatInt(int64(run%(36*36*36*36)), 36)
+	return strings.Repeat("0", 4-len(id)) + id
+}
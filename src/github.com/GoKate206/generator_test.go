@@ -0,0 +1,65 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestGenerateNetwork(t *testing.T) {
+	// Jul 02 2021 is a Friday
+	start, _ := time.Parse(dateLayout, "Jul 02 2021")
+	cfg := NetworkConfig{
+		Stops:          10,
+		Routes:         2,
+		StopsPerRoute:  4,
+		HeadwayMinutes: 30,
+		FirstTrain:     6 * 60,
+		LastTrain:      8 * 60,
+		StartDate:      start,
+		Days:           2,
+		Seed:           7,
+	}
+
+	t.Run("when a network is generated", func(t *testing.T) {
+		csv, err := generateNetwork(cfg)
+		require.Nil(t, err)
+		schedules := mustReadCsv(t, csv)
+
+		t.Run("weekends will run half as often as weekdays", func(t *testing.T) {
+			perDay := map[string]int{}
+			for _, schedule := range schedules {
+				perDay[schedule.Time[:len(dateLayout)]]++
+			}
+			// routes × runs × stops per route
+			assert.EqualValues(t, 2*4*4, perDay["Jul 02 2021"])
+			assert.InDelta(t, 2*2*4, perDay["Jul 03 2021"], 2*4)
+		})
+
+		t.Run("every stop will be within the network", func(t *testing.T) {
+			for _, schedule := range schedules {
+				assert.True(t, schedule.StopID >= 1 && schedule.StopID <= 10)
+			}
+		})
+
+		t.Run("it will be the same for the same seed", func(t *testing.T) {
+			again, err := generateNetwork(cfg)
+			require.Nil(t, err)
+			assert.EqualValues(t, csv, again)
+		})
+	})
+
+	t.Run("when more stops per route than stops are asked for", func(t *testing.T) {
+		cfg := cfg
+		cfg.StopsPerRoute = 11
+		_, err := generateNetwork(cfg)
+		assert.EqualValues(t, "Stops per route can not be more than 10 stops", err.Error())
+	})
+
+	t.Run("train IDs will be 4 characters", func(t *testing.T) {
+		assert.EqualValues(t, "0000", generatedTrainID(0))
+		assert.EqualValues(t, "00zz", generatedTrainID(36*36-1))
+	})
+}
@@ -0,0 +1,349 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"time"
+)
+
+const earthRadiusMeters = 6371000.0
+
+var (
+	// walkingDistanceMeters is how far riders are assumed to walk to a stop
+	walkingDistanceMeters = 800.0
+	// walkingMetersPerMinute is a 5 km/h walk
+	walkingMetersPerMinute = 83.0
+	// nearbyWindowMinutes is how far ahead trains near a point are listed
+	nearbyWindowMinutes = 60
+	// maxNearbyRadiusMeters and maxNearbyStops bound one nearby search,
+	// a radius search returns the closest maxNearbyStops
+	maxNearbyRadiusMeters = 5000.0
+	maxNearbyStops        = 50
+)
+
+// NearbyStop is a stop and how far it is from the point searched from
+type NearbyStop struct {
+	Stop           Stop `json:"stop"`
+	DistanceMeters int  `json:"distanceMeters"`
+}
+
+// NearbyTrains are the trains a rider can walk to in time at a nearby stop
+type NearbyTrains struct {
+	NearbyStop
+	WalkMinutes int        `json:"walkMinutes"`
+	Trains      []Schedule `json:"trains"`
+}
+
+func validateCoordinates(lat, lon float64) error {
+	if math.IsNaN(lat) || lat < -90 || lat > 90 {
+		return fmt.Errorf("Latitude must be between -90 and 90, got: %v", lat)
+	}
+	if math.IsNaN(lon) || lon < -180 || lon > 180 {
+		return fmt.Errorf("Longitude must be between -180 and 180, got: %v", lon)
+	}
+
+	return nil
+}
+
+// geoPoint is a point on the unit sphere, the straight line ( chord )
+// between two of them grows with the distance along the surface so a
+// plain k-d tree finds the nearest stops anywhere on earth
+type geoPoint [3]float64
+
+func toGeoPoint(lat, lon float64) geoPoint {
+	phi, lambda := lat*math.Pi/180, lon*math.Pi/180
+	return geoPoint{math.Cos(phi) * math.Cos(lambda), math.Cos(phi) * math.Sin(lambda), math.Sin(phi)}
+}
+
+func (p geoPoint) chord2(q geoPoint) float64 {
+	dx, dy, dz := p[0]-q[0], p[1]-q[1], p[2]-q[2]
+	return dx*dx + dy*dy + dz*dz
+}
+
+func chordToMeters(chord2 float64) float64 {
+	return 2 * earthRadiusMeters * math.Asin(math.Min(1, math.Sqrt(chord2)/2))
+}
+
+func metersToChord2(meters float64) float64 {
+	chord := 2 * math.Sin(math.Min(math.Pi/2, meters/(2*earthRadiusMeters)))
+	return chord * chord
+}
+
+// stopDistanceMeters is the great circle distance between two stops with coordinates
+func stopDistanceMeters(a, b Stop) (float64, bool) {
+	if a.Lat == nil || b.Lat == nil {
+		return 0, false
+	}
+
+	return chordToMeters(toGeoPoint(*a.Lat, *a.Lon).chord2(toGeoPoint(*b.Lat, *b.Lon))), true
+}
+
+type stopNode struct {
+	stop        Stop
+	point       geoPoint
+	axis        int
+	left, right *stopNode
+}
+
+// stopTree is a k-d tree of the stops with coordinates
+type stopTree struct {
+	root *stopNode
+}
+
+type treeHit struct {
+	stop   Stop
+	chord2 float64
+}
+
+func buildStopTree(stops map[int64]Stop) *stopTree {
+	nodes := []*stopNode{}
+	for _, stop := range stops {
+		if stop.Lat != nil {
+			nodes = append(nodes, &stopNode{stop: stop, point: toGeoPoint(*stop.Lat, *stop.Lon)})
+		}
+	}
+	// the same tree whatever order the stops were read in
+	sort.Slice(nodes, func(i, j int) bool { return nodes[i].stop.ID < nodes[j].stop.ID })
+
+	return &stopTree{root: buildStopNodes(nodes, 0)}
+}
+
+func buildStopNodes(nodes []*stopNode, depth int) *stopNode {
+	if len(nodes) == 0 {
+		return nil
+	}
+
+	axis := depth % 3
+	sort.SliceStable(nodes, func(i, j int) bool { return nodes[i].point[axis] < nodes[j].point[axis] })
+	median := len(nodes) / 2
+	node := nodes[median]
+	node.axis = axis
+	node.left = buildStopNodes(nodes[:median], depth+1)
+	node.right = buildStopNodes(nodes[median+1:], depth+1)
+
+	return node
+}
+
+// nearest returns the k closest stops, closest first
+func (t *stopTree) nearest(p geoPoint, k int) []treeHit {
+	hits := []treeHit{}
+	if k <= 0 {
+		return hits
+	}
+
+	var visit func(node *stopNode)
+	visit = func(node *stopNode) {
+		if node == nil {
+			return
+		}
+
+		hit := treeHit{node.stop, p.chord2(node.point)}
+		if len(hits) < k || hit.chord2 < hits[len(hits)-1].chord2 {
+			i := sort.Search(len(hits), func(i int) bool { return hits[i].chord2 > hit.chord2 })
+			hits = append(hits, treeHit{})
+			copy(hits[i+1:], hits[i:])
+			hits[i] = hit
+			if len(hits) > k {
+				hits = hits[:k]
+			}
+		}
+
+		diff := p[node.axis] - node.point[node.axis]
+		near, far := node.left, node.right
+		if diff > 0 {
+			near, far = far, near
+		}
+		visit(near)
+		// the far side can only help if the splitting plane is closer than the worst hit
+		if len(hits) < k || diff*diff < hits[len(hits)-1].chord2 {
+			visit(far)
+		}
+	}
+	visit(t.root)
+
+	return hits
+}
+
+// within returns the stops within a chord of the point, closest first
+func (t *stopTree) within(p geoPoint, chord2 float64) []treeHit {
+	hits := []treeHit{}
+
+	var visit func(node *stopNode)
+	visit = func(node *stopNode) {
+		if node == nil {
+			return
+		}
+
+		if d := p.chord2(node.point); d <= chord2 {
+			hits = append(hits, treeHit{node.stop, d})
+		}
+
+		diff := p[node.axis] - node.point[node.axis]
+		if diff <= 0 || diff*diff <= chord2 {
+			visit(node.left)
+		}
+		if diff >= 0 || diff*diff <= chord2 {
+			visit(node.right)
+		}
+	}
+	visit(t.root)
+
+	sort.Slice(hits, func(i, j int) bool {
+		if hits[i].chord2 != hits[j].chord2 {
+			return hits[i].chord2 < hits[j].chord2
+		}
+		return hits[i].stop.ID < hits[j].stop.ID
+	})
+
+	return hits
+}
+
+// stopTreeLocked returns the spatial index of the stops, built
+// on first use and dropped when a stop is written
+func (s *Store) stopTreeLocked() (*stopTree, error) {
+	stops, err := s.getStopsLocked()
+	if err != nil {
+		return nil, err
+	}
+
+	s.cacheMu.Lock()
+	defer s.cacheMu.Unlock()
+	if s.stopTree == nil {
+		s.stopTree = buildStopTree(stops)
+	}
+
+	return s.stopTree, nil
+}
+
+// validateRadius rejects a search radius past maxNearbyRadiusMeters
+func validateRadius(radiusMeters float64) error {
+	if math.IsNaN(radiusMeters) || radiusMeters > maxNearbyRadiusMeters {
+		return fmt.Errorf("Radius must be at most %g meters, got: %g", maxNearbyRadiusMeters, radiusMeters)
+	}
+
+	return nil
+}
+
+// getNearbyStops returns the k nearest stops to a point, or with a
+// radius every stop within it, closest first. Both limit when given
+func (s *Store) getNearbyStops(lat, lon float64, k int, radiusMeters float64) ([]NearbyStop, error) {
+	nearby := []NearbyStop{}
+	if err := validateCoordinates(lat, lon); err != nil {
+		return nearby, err
+	}
+	if k <= 0 && radiusMeters <= 0 {
+		return nearby, fmt.Errorf("Nearby stops need a count or a radius")
+	}
+	if k > maxNearbyStops {
+		return nearby, fmt.Errorf("Nearby stops are limited to %d, got: %d", maxNearbyStops, k)
+	}
+	if err := validateRadius(radiusMeters); err != nil {
+		return nearby, err
+	}
+
+	if err := s.rlock(); err != nil {
+		return nearby, err
+	}
+	defer s.mu.RUnlock()
+
+	return s.getNearbyStopsLocked(lat, lon, k, radiusMeters)
+}
+
+func (s *Store) getNearbyStopsLocked(lat, lon float64, k int, radiusMeters float64) ([]NearbyStop, error) {
+	nearby := []NearbyStop{}
+	tree, err := s.stopTreeLocked()
+	if err != nil {
+		return nearby, err
+	}
+
+	p := toGeoPoint(lat, lon)
+	var hits []treeHit
+	if radiusMeters > 0 {
+		if k <= 0 || k > maxNearbyStops {
+			k = maxNearbyStops
+		}
+		hits = tree.within(p, metersToChord2(radiusMeters))
+		if len(hits) > k {
+			hits = hits[:k]
+		}
+	} else {
+		hits = tree.nearest(p, k)
+	}
+
+	for _, hit := range hits {
+		nearby = append(nearby, NearbyStop{Stop: hit.stop, DistanceMeters: int(math.Round(chordToMeters(hit.chord2)))})
+	}
+
+	return nearby, nil
+}
+
+// getTrainsNear lists, for every stop within walking distance of a point,
+// the trains arriving in the next nearbyWindowMinutes that can be reached
+// on foot from clock. Stops without reachable trains are left out
+func (s *Store) getTrainsNear(lat, lon float64, radiusMeters float64, clock time.Time) ([]NearbyTrains, error) {
+	results := []NearbyTrains{}
+	if radiusMeters <= 0 {
+		radiusMeters = walkingDistanceMeters
+	}
+	if err := validateCoordinates(lat, lon); err != nil {
+		return results, err
+	}
+	if err := validateRadius(radiusMeters); err != nil {
+		return results, err
+	}
+
+	if err := s.rlock(); err != nil {
+		return results, err
+	}
+	defer s.mu.RUnlock()
+
+	nearby, err := s.getNearbyStopsLocked(lat, lon, 0, radiusMeters)
+	if err != nil {
+		return results, err
+	}
+
+	until := clock.Add(time.Duration(nearbyWindowMinutes) * time.Minute)
+	for _, stop := range nearby {
+		walk := int(math.Ceil(float64(stop.DistanceMeters) / walkingMetersPerMinute))
+		reachable := clock.Add(time.Duration(walk) * time.Minute)
+		result := NearbyTrains{NearbyStop: stop, WalkMinutes: walk, Trains: []Schedule{}}
+
+		// the window may run into the next service day
+		for _, date := range []time.Time{clock, until} {
+			day, err := s.dayLocked(date)
+			if err != nil {
+				return results, err
+			}
+
+			for _, n := range day.stopFrom(stop.Stop.ID, reachable) {
+				if day.times[n].After(until) {
+					break
+				}
+				if !containsSchedule(result.Trains, day.schedules[n]) {
+					result.Trains = append(result.Trains, day.schedules[n])
+				}
+			}
+
+			if serviceDayOf(clock) == serviceDayOf(until) {
+				break
+			}
+		}
+
+		if len(result.Trains) > 0 {
+			results = append(results, result)
+		}
+	}
+
+	return results, nil
+}
+
+func containsSchedule(schedules []Schedule, schedule Schedule) bool {
+	for _, s := range schedules {
+		if s.TrainID == schedule.TrainID && s.StopID == schedule.StopID && s.Time == schedule.Time {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,225 @@
+package main
+
+import (
+	"encoding/json"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sort"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func geoStop(id int64, lat, lon float64) Stop {
+	return Stop{ID: id, Lat: &lat, Lon: &lon}
+}
+
+func TestStopDistance(t *testing.T) {
+	t.Run("when two stops are a degree of latitude apart", func(t *testing.T) {
+		meters, ok := stopDistanceMeters(geoStop(1, 0, 0), geoStop(2, 1, 0))
+
+		t.Run("it will return the great circle distance", func(t *testing.T) {
+			require.True(t, ok)
+			assert.InDelta(t, 111195, meters, 1)
+		})
+	})
+
+	t.Run("when a stop has no coordinates", func(t *testing.T) {
+		_, ok := stopDistanceMeters(geoStop(1, 0, 0), Stop{ID: 2})
+		assert.False(t, ok)
+	})
+
+	t.Run("when coordinates are out of range or half given", func(t *testing.T) {
+		lat := 52.0
+		assert.Error(t, validateCoordinates(91, 0))
+		assert.Error(t, validateCoordinates(0, -181))
+		_, err := Stop{ID: 1, Name: "Central", Lat: &lat}.validate()
+		assert.Error(t, err)
+	})
+}
+
+func TestStopTree(t *testing.T) {
+	random := rand.New(rand.NewSource(47))
+	stops := map[int64]Stop{}
+	for id := int64(1); id <= 500; id++ {
+		stops[id] = geoStop(id, 51+random.Float64(), 4+random.Float64())
+	}
+	stops[501] = Stop{ID: 501}
+	tree := buildStopTree(stops)
+	point := toGeoPoint(51.5, 4.5)
+
+	bruteForce := func() []treeHit {
+		hits := []treeHit{}
+		for _, stop := range stops {
+			if stop.Lat != nil {
+				hits = append(hits, treeHit{stop, point.chord2(toGeoPoint(*stop.Lat, *stop.Lon))})
+			}
+		}
+		sort.Slice(hits, func(i, j int) bool { return hits[i].chord2 < hits[j].chord2 })
+		return hits
+	}()
+
+	t.Run("when asking for the k nearest stops", func(t *testing.T) {
+		hits := tree.nearest(point, 10)
+
+		t.Run("it will match a brute force search", func(t *testing.T) {
+			require.Len(t, hits, 10)
+			for i, hit := range hits {
+				assert.EqualValues(t, bruteForce[i].stop.ID, hit.stop.ID)
+			}
+		})
+	})
+
+	t.Run("when asking for the stops within a radius", func(t *testing.T) {
+		chord2 := metersToChord2(5000)
+		hits := tree.within(point, chord2)
+
+		t.Run("it will match a brute force search and skip stops without coordinates", func(t *testing.T) {
+			expected := 0
+			for _, hit := range bruteForce {
+				if hit.chord2 <= chord2 {
+					expected++
+				}
+			}
+			require.NotZero(t, expected)
+			require.Len(t, hits, expected)
+			for i, hit := range hits {
+				assert.EqualValues(t, bruteForce[i].stop.ID, hit.stop.ID)
+				assert.True(t, chordToMeters(hit.chord2) <= 5000)
+			}
+		})
+	})
+}
+
+func TestNearbyQueries(t *testing.T) {
+	store := initTestStore(t)
+	defer tearDownStore(store)
+	require.Nil(t, store.csvHandler(`stopID,route,trainID,time
+1,"C","865a","Jul 04 2021 07:42"
+2,"C","865a","Jul 04 2021 07:43"
+2,"C","866a","Jul 04 2021 07:50"
+3,"C","866a","Jul 04 2021 08:20"`))
+	for _, stop := range []Stop{geoStop(1, 52, 4), geoStop(2, 52.0036, 4), geoStop(3, 53, 4)} {
+		stop.Name = "Stop"
+		_, err := store.saveStop(stop)
+		require.Nil(t, err)
+	}
+
+	t.Run("when asking for the nearest stops", func(t *testing.T) {
+		nearby, err := store.getNearbyStops(52.0036, 4, 2, 0)
+		require.Nil(t, err)
+
+		t.Run("it will return them closest first with their distance", func(t *testing.T) {
+			require.Len(t, nearby, 2)
+			assert.EqualValues(t, 2, nearby[0].Stop.ID)
+			assert.EqualValues(t, 0, nearby[0].DistanceMeters)
+			assert.EqualValues(t, 1, nearby[1].Stop.ID)
+			assert.InDelta(t, 400, nearby[1].DistanceMeters, 1)
+		})
+	})
+
+	t.Run("when neither a count nor a radius is given", func(t *testing.T) {
+		_, err := store.getNearbyStops(52, 4, 0, 0)
+		assert.Error(t, err)
+	})
+
+	t.Run("when a search is too wide", func(t *testing.T) {
+		_, err := store.getNearbyStops(52, 4, 0, 100000)
+		require.Error(t, err)
+		assert.EqualValues(t, "Radius must be at most 5000 meters, got: 100000", err.Error())
+
+		_, err = store.getNearbyStops(52, 4, 1000, 0)
+		require.Error(t, err)
+		assert.EqualValues(t, "Nearby stops are limited to 50, got: 1000", err.Error())
+
+		_, err = store.getTrainsNear(52, 4, 100000, timeNow())
+		assert.Error(t, err)
+	})
+
+	t.Run("when a radius holds more stops than are returned", func(t *testing.T) {
+		defer func(limit int) { maxNearbyStops = limit }(maxNearbyStops)
+		maxNearbyStops = 1
+
+		nearby, err := store.getNearbyStops(52.0036, 4, 0, 1000)
+		require.Nil(t, err)
+
+		t.Run("it will return the closest", func(t *testing.T) {
+			require.Len(t, nearby, 1)
+			assert.EqualValues(t, 2, nearby[0].Stop.ID)
+		})
+	})
+
+	t.Run("when asking for trains near a point", func(t *testing.T) {
+		clock, _, err := parseScheduleTime("Jul 04 2021 07:40")
+		require.Nil(t, err)
+		nearby, err := store.getTrainsNear(52, 4, 0, clock)
+		require.Nil(t, err)
+
+		t.Run("it will only list trains that can be walked to in time", func(t *testing.T) {
+			require.Len(t, nearby, 2)
+			assert.EqualValues(t, 1, nearby[0].Stop.ID)
+			assert.EqualValues(t, 0, nearby[0].WalkMinutes)
+			require.Len(t, nearby[0].Trains, 1)
+			assert.EqualValues(t, "865a", nearby[0].Trains[0].TrainID)
+
+			assert.EqualValues(t, 2, nearby[1].Stop.ID)
+			assert.EqualValues(t, 5, nearby[1].WalkMinutes)
+			require.Len(t, nearby[1].Trains, 1)
+			assert.EqualValues(t, "866a", nearby[1].Trains[0].TrainID)
+		})
+	})
+
+	t.Run("when a train is linted between stops with coordinates", func(t *testing.T) {
+		cfg := defaultLintConfig()
+		cfg.Stops, _ = store.getStopMap()
+		report := lintSchedules(mustReadCsv(t, `stopID,route,trainID,time
+1,"C","900a","Jul 04 2021 07:42"
+3,"C","900a","Jul 04 2021 07:52"`), cfg)
+
+		t.Run("it will use their distance for the speed rule", func(t *testing.T) {
+			assert.EqualValues(t, severityError, lintRules(report)["impossible-speed"])
+		})
+	})
+
+	t.Run("when asking over the server", func(t *testing.T) {
+		srv := httptest.NewServer(newServer(store))
+		defer srv.Close()
+
+		t.Run("it will find stops within a radius", func(t *testing.T) {
+			res, err := http.Get(srv.URL + "/stops/nearby?lat=52&lon=4&radius=1000")
+			require.Nil(t, err)
+			defer res.Body.Close()
+			nearby := []NearbyStop{}
+			require.Nil(t, json.NewDecoder(res.Body).Decode(&nearby))
+			assert.Len(t, nearby, 2)
+		})
+
+		t.Run("it will list the trains near a point", func(t *testing.T) {
+			res, err := http.Get(srv.URL + "/trains/nearby?lat=52&lon=4&time=" + url.QueryEscape("Jul 04 2021 07:40"))
+			require.Nil(t, err)
+			defer res.Body.Close()
+			nearby := []NearbyTrains{}
+			require.Nil(t, json.NewDecoder(res.Body).Decode(&nearby))
+			assert.Len(t, nearby, 2)
+		})
+
+		t.Run("it will reject a radius past the limit", func(t *testing.T) {
+			for _, path := range []string{"/stops/nearby?lat=52&lon=4&radius=50000", "/trains/nearby?lat=52&lon=4&radius=50000", "/stops/nearby?lat=52&lon=4&k=500"} {
+				res, err := http.Get(srv.URL + path)
+				require.Nil(t, err)
+				res.Body.Close()
+				assert.EqualValues(t, http.StatusBadRequest, res.StatusCode, path)
+			}
+		})
+
+		t.Run("it will reject a missing point", func(t *testing.T) {
+			res, err := http.Get(srv.URL + "/stops/nearby?lat=52&k=3")
+			require.Nil(t, err)
+			res.Body.Close()
+			assert.EqualValues(t, http.StatusBadRequest, res.StatusCode)
+		})
+	})
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+const icalLayout = "20060102T150405"
+
+// calendarDays is how many service days a calendar covers when the
+// filter has no To date
+var calendarDays = 14
+
+// maxCalendarDays is the longest range a calendar can be asked for
+var maxCalendarDays = 366
+
+// calendarSchedules returns the actual service matching a filter, from
+// its From day ( default today ) up to its To day or calendarDays
+func (s *Store) calendarSchedules(filter ScheduleFilter) ([]Schedule, error) {
+	schedules := []Schedule{}
+	match, err := filter.matcher()
+	if err != nil {
+		return schedules, err
+	}
+
+	from, _ := time.Parse(dateLayout, serviceDayOf(timeNow().UTC()))
+	if filter.From != "" {
+		from, _ = time.Parse(dateLayout, filter.From)
+	}
+	to := from.AddDate(0, 0, calendarDays-1)
+	if filter.To != "" {
+		to, _ = time.Parse(dateLayout, filter.To)
+	}
+	if to.Before(from) {
+		return schedules, fmt.Errorf("To must not be before From: %s - %s", to.Format(dateLayout), from.Format(dateLayout))
+	}
+	if days := int(to.Sub(from).Hours()/24) + 1; days > maxCalendarDays {
+		return schedules, fmt.Errorf("Calendars can cover at most %d days, got: %d", maxCalendarDays, days)
+	}
+
+	if err := s.rlock(); err != nil {
+		return schedules, err
+	}
+	defer s.mu.RUnlock()
+
+	for day := from; !day.After(to); day = day.AddDate(0, 0, 1) {
+		index, err := s.dayLocked(day.Add(time.Duration(serviceDayRolloverHour) * time.Hour))
+		if err != nil {
+			return schedules, err
+		}
+
+		for _, schedule := range index.all() {
+			ok, err := match(schedule)
+			if err != nil {
+				return schedules, err
+			}
+			if ok {
+				schedules = append(schedules, schedule)
+			}
+		}
+	}
+
+	return schedules, nil
+}
+
+// renderICal writes schedules as an RFC 5545 calendar, one VEVENT per
+// arrival. Times are floating as schedules carry no time zone
+func renderICal(name string, schedules []Schedule) string {
+	lines := []string{
+		"BEGIN:VCALENDAR",
+		"VERSION:2.0",
+		"PRODID:-//GoKate206//Train Schedule//EN",
+		"CALSCALE:GREGORIAN",
+		"METHOD:PUBLISH",
+		"X-WR-CALNAME:" + icalEscape(name),
+	}
+
+	stamp := timeNow().UTC().Format(icalLayout) + "Z"
+	for _, schedule := range schedules {
+		at, err := time.Parse(layout, schedule.Time)
+		if err != nil {
+			continue
+		}
+		serviceDay, _, _ := scheduleServiceDay(schedule)
+
+		summary := fmt.Sprintf("Route %s train %s at stop %d", schedule.Route, schedule.TrainID, schedule.StopID)
+		if schedule.HeadwayMinutes > 0 {
+			summary = fmt.Sprintf("Route %s every %d min at stop %d", schedule.Route, schedule.HeadwayMinutes, schedule.StopID)
+		}
+		if schedule.Headsign != "" {
+			summary += " to " + schedule.Headsign
+		}
+
+		lines = append(lines,
+			"BEGIN:VEVENT",
+			fmt.Sprintf("UID:%s-%s-%d-%s@train-schedule", strings.Replace(serviceDay, " ", "", -1), schedule.TrainID, schedule.StopID, at.Format(icalLayout)),
+			"DTSTAMP:"+stamp,
+			"DTSTART:"+at.Format(icalLayout),
+			"DTEND:"+at.Add(time.Minute).Format(icalLayout),
+			"SUMMARY:"+icalEscape(summary),
+			fmt.Sprintf("LOCATION:Stop %d", schedule.StopID),
+		)
+		if schedule.Status == statusCancelled {
+			lines = append(lines, "STATUS:CANCELLED")
+		} else {
+			lines = append(lines, "STATUS:CONFIRMED")
+		}
+		lines = append(lines, "END:VEVENT")
+	}
+	lines = append(lines, "END:VCALENDAR")
+
+	var b strings.Builder
+	for _, line := range lines {
+		b.WriteString(icalFold(line))
+		b.WriteString("\r\n")
+	}
+
+	return b.String()
+}
+
+// icalEscape escapes TEXT values, every line break, CR ones too,
+// becomes \n so it cannot end the content line
+func icalEscape(text string) string {
+	return strings.NewReplacer(`\`, `\\`, ";", `\;`, ",", `\,`, "\r\n", `\n`, "\r", `\n`, "\n", `\n`).Replace(text)
+}
+
+// icalFold splits lines longer than 75 octets, continuation lines start
+// with a space. Multi byte characters are not split
+func icalFold(line string) string {
+	var b strings.Builder
+	width := 0
+	for _, r := range line {
+		size := len(string(r))
+		if width+size > 75 {
+			b.WriteString("\r\n ")
+			width = 1
+		}
+		b.WriteRune(r)
+		width += size
+	}
+
+	return b.String()
+}
+
+// calendarName describes what a filter subscribes to
+func calendarName(filter ScheduleFilter) string {
+	parts := []string{}
+	if filter.Route != "" {
+		parts = append(parts, "Route "+filter.Route)
+	}
+	if filter.TrainID != "" {
+		parts = append(parts, "Train "+filter.TrainID)
+	}
+	if filter.StopID != nil {
+		parts = append(parts, fmt.Sprintf("at stop %d", *filter.StopID))
+	}
+	if len(parts) == 0 {
+		return "Train schedule"
+	}
+
+	return strings.Join(parts, " ")
+}
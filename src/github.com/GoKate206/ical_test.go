@@ -0,0 +1,103 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRenderICal(t *testing.T) {
+	t.Run("when given schedules", func(t *testing.T) {
+		ics := renderICal("Route C at stop 1", []Schedule{
+			{StopID: 1, Route: "C", TrainID: "865a", Time: "Jul 04 2021 07:42"},
+			{StopID: 1, Route: "C", TrainID: "866a", Time: "Jul 05 2021 01:10", ServiceDay: "Jul 04 2021", Status: statusCancelled},
+		})
+
+		t.Run("it will write a VEVENT per arrival with CRLF lines", func(t *testing.T) {
+			assert.True(t, strings.HasPrefix(ics, "BEGIN:VCALENDAR\r\nVERSION:2.0\r\n"))
+			assert.True(t, strings.HasSuffix(ics, "END:VCALENDAR\r\n"))
+			assert.EqualValues(t, 2, strings.Count(ics, "BEGIN:VEVENT"))
+			assert.Contains(t, ics, "X-WR-CALNAME:Route C at stop 1\r\n")
+			assert.Contains(t, ics, "DTSTART:20210704T074200\r\nDTEND:20210704T074300\r\nSUMMARY:Route C train 865a at stop 1\r\n")
+		})
+
+		t.Run("it will key events by service day and mark cancellations", func(t *testing.T) {
+			assert.Contains(t, ics, "UID:Jul042021-866a-1-20210705T011000@train-schedule\r\n")
+			assert.Contains(t, ics, "STATUS:CANCELLED\r\n")
+		})
+	})
+
+	t.Run("when text is long or has special characters", func(t *testing.T) {
+		t.Run("it will escape it", func(t *testing.T) {
+			assert.EqualValues(t, `a\, b\; c\\d\n`, icalEscape("a, b; c\\d\n"))
+			assert.EqualValues(t, `Central\nNorth\nSouth`, icalEscape("Central\r\nNorth\rSouth"))
+		})
+
+		t.Run("it will fold lines at 75 octets", func(t *testing.T) {
+			folded := icalFold("SUMMARY:" + strings.Repeat("x", 100))
+			lines := strings.Split(folded, "\r\n")
+			require.Len(t, lines, 2)
+			assert.Len(t, lines[0], 75)
+			assert.True(t, strings.HasPrefix(lines[1], " "))
+		})
+	})
+}
+
+func TestCalendarFeed(t *testing.T) {
+	store := initTestStore(t)
+	defer tearDownStore(store)
+	require.Nil(t, store.csvHandler(`stopID,route,trainID,time
+1,"C","865a","Jul 04 2021 07:42"
+1,"55","465a","Jul 04 2021 07:42"
+1,"C","866a","Jul 20 2021 07:42"
+2,"C","865a","Jul 04 2021 07:50"`))
+	srv := httptest.NewServer(newServer(store))
+	defer srv.Close()
+
+	t.Run("when a route at a stop is subscribed to", func(t *testing.T) {
+		res, err := http.Get(srv.URL + "/calendar.ics?stopID=1&route=C")
+		require.Nil(t, err)
+		defer res.Body.Close()
+		body, err := ioutil.ReadAll(res.Body)
+		require.Nil(t, err)
+
+		t.Run("it will serve the next two weeks of matching trains", func(t *testing.T) {
+			assert.EqualValues(t, "text/calendar; charset=utf-8", res.Header.Get("Content-Type"))
+			assert.EqualValues(t, 1, strings.Count(string(body), "BEGIN:VEVENT"))
+			assert.Contains(t, string(body), "SUMMARY:Route C train 865a at stop 1")
+		})
+	})
+
+	t.Run("when a date range is given", func(t *testing.T) {
+		schedules, err := store.calendarSchedules(ScheduleFilter{Route: "C", From: "Jul 04 2021", To: "Jul 31 2021"})
+		require.Nil(t, err)
+
+		t.Run("it will cover the range", func(t *testing.T) {
+			assert.Len(t, schedules, 3)
+		})
+	})
+
+	t.Run("when the range is invalid", func(t *testing.T) {
+		for _, query := range []string{"from=tomorrow", "from=Jul+31+2021&to=Jul+04+2021", "from=Jan+01+2021&to=Jan+01+2031"} {
+			res, err := http.Get(srv.URL + "/calendar.ics?" + query)
+			require.Nil(t, err)
+			res.Body.Close()
+			assert.EqualValues(t, http.StatusBadRequest, res.StatusCode, query)
+		}
+	})
+
+	t.Run("when the range is backwards or too long", func(t *testing.T) {
+		_, err := store.calendarSchedules(ScheduleFilter{From: "Jul 31 2021", To: "Jul 04 2021"})
+		require.Error(t, err)
+		assert.EqualValues(t, "To must not be before From: Jul 04 2021 - Jul 31 2021", err.Error())
+
+		_, err = store.calendarSchedules(ScheduleFilter{From: "Jan 01 2021", To: "Jan 02 2022"})
+		require.Error(t, err)
+		assert.EqualValues(t, "Calendars can cover at most 366 days, got: 367", err.Error())
+	})
+}
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	severityInfo    = "info"
+	severityWarning = "warning"
+	severityError   = "error"
+)
+
+var severityRank = map[string]int{severityInfo: 0, severityWarning: 1, severityError: 2}
+
+// LintConfig tunes the network level checks run before an import
+type LintConfig struct {
+	// StopDistances are km between stops, keyed lowest stop ID first,
+	// otherwise they come from the coordinates of Stops. Travel speed
+	// is only checked between stops with a known distance
+	StopDistances map[[2]int64]float64
+	Stops         map[int64]Stop
+	MaxSpeedKmh   float64
+	// MaxGapMinutes is the longest a route may go without a train at a stop
+	MaxGapMinutes int
+	// BlockOn is the lowest severity that stops an import, empty never blocks
+	BlockOn string
+}
+
+func defaultLintConfig() LintConfig {
+	return LintConfig{MaxSpeedKmh: 160, MaxGapMinutes: 120, BlockOn: severityError}
+}
+
+// LintIssue points at the CSV lines, header being line 1, that broke a rule
+type LintIssue struct {
+	Rule     string `json:"rule"`
+	Severity string `json:"severity"`
+	Message  string `json:"message"`
+	Lines    []int  `json:"lines"`
+}
+
+type LintReport struct {
+	Issues  []LintIssue `json:"issues"`
+	Blocked bool        `json:"blocked"`
+}
+
+func (r LintReport) String() string {
+	var b strings.Builder
+	for _, issue := range r.Issues {
+		fmt.Fprintf(&b, "%s %s: %s ( lines %v )\n", issue.Severity, issue.Rule, issue.Message, issue.Lines)
+	}
+
+	return b.String()
+}
+
+type lintRow struct {
+	line     int
+	schedule Schedule
+	at       time.Time
+	day      string
+}
+
+// lintSchedules checks schedules read from a CSV as a whole network
+func lintSchedules(schedules []Schedule, cfg LintConfig) LintReport {
+	report := LintReport{Issues: []LintIssue{}}
+	add := func(rule, severity, message string, rows ...lintRow) {
+		lines := []int{}
+		for _, row := range rows {
+			lines = append(lines, row.line)
+		}
+		report.Issues = append(report.Issues, LintIssue{rule, severity, message, lines})
+	}
+
+	rows := []lintRow{}
+	for i, schedule := range schedules {
+		day, at, err := scheduleServiceDay(schedule)
+		if err != nil {
+			continue
+		}
+		rows = append(rows, lintRow{line: i + 2, schedule: schedule, at: at, day: day})
+	}
+	sort.SliceStable(rows, func(i, j int) bool { return rows[i].at.Before(rows[j].at) })
+
+	// duplicate rows
+	seen := map[string]lintRow{}
+	for _, row := range rows {
+		key := fmt.Sprintf("%d|%s|%s|%s", row.schedule.StopID, row.schedule.Route, row.schedule.TrainID, row.schedule.Time)
+		if first, ok := seen[key]; ok {
+			add("duplicate-row", severityWarning, fmt.Sprintf("Train %s is listed twice at stop %d at %s", row.schedule.TrainID, row.schedule.StopID, row.schedule.Time), first, row)
+			continue
+		}
+		seen[key] = row
+	}
+
+	// train runs, a train on a service day in arrival order
+	runs := map[string][]lintRow{}
+	runKeys := []string{}
+	for _, row := range rows {
+		key := row.schedule.TrainID + "|" + row.day
+		if _, ok := runs[key]; !ok {
+			runKeys = append(runKeys, key)
+		}
+		runs[key] = append(runs[key], row)
+	}
+
+	for _, key := range runKeys {
+		run := runs[key]
+		stops := map[int64]bool{}
+		for i, row := range run {
+			stops[row.schedule.StopID] = true
+			if i == 0 {
+				continue
+			}
+
+			prev := run[i-1]
+			if prev.schedule.StopID == row.schedule.StopID {
+				continue
+			}
+
+			if prev.at.Equal(row.at) {
+				add("same-minute-two-stops", severityError, fmt.Sprintf("Train %s is at stops %d and %d at %s", row.schedule.TrainID, prev.schedule.StopID, row.schedule.StopID, row.schedule.Time), prev, row)
+				continue
+			}
+
+			if distance, ok := cfg.stopDistance(prev.schedule.StopID, row.schedule.StopID); ok && cfg.MaxSpeedKmh > 0 {
+				speed := distance / row.at.Sub(prev.at).Hours()
+				if speed > cfg.MaxSpeedKmh {
+					add("impossible-speed", severityError, fmt.Sprintf("Train %s would travel %.0f km/h from stop %d to %d", row.schedule.TrainID, speed, prev.schedule.StopID, row.schedule.StopID), prev, row)
+				}
+			}
+		}
+
+		if len(stops) == 1 {
+			add("single-stop-train", severityWarning, fmt.Sprintf("Train %s only calls at stop %d on %s", run[0].schedule.TrainID, run[0].schedule.StopID, run[0].day), run...)
+		}
+	}
+
+	// service gaps, a route at a stop on a service day
+	if cfg.MaxGapMinutes > 0 {
+		services := map[string][]lintRow{}
+		serviceKeys := []string{}
+		for _, row := range rows {
+			key := fmt.Sprintf("%s|%d|%s", row.schedule.Route, row.schedule.StopID, row.day)
+			if _, ok := services[key]; !ok {
+				serviceKeys = append(serviceKeys, key)
+			}
+			services[key] = append(services[key], row)
+		}
+
+		maxGap := time.Duration(cfg.MaxGapMinutes) * time.Minute
+		for _, key := range serviceKeys {
+			service := services[key]
+			for i := 1; i < len(service); i++ {
+				if gap := service[i].at.Sub(service[i-1].at); gap > maxGap {
+					add("service-gap", severityInfo, fmt.Sprintf("Route %s has no train at stop %d for %d minutes", service[i].schedule.Route, service[i].schedule.StopID, int(gap.Minutes())), service[i-1], service[i])
+				}
+			}
+		}
+	}
+
+	sort.SliceStable(report.Issues, func(i, j int) bool {
+		return severityRank[report.Issues[i].Severity] > severityRank[report.Issues[j].Severity]
+	})
+
+	if rank, ok := severityRank[cfg.BlockOn]; ok {
+		for _, issue := range report.Issues {
+			if severityRank[issue.Severity] >= rank {
+				report.Blocked = true
+			}
+		}
+	}
+
+	return report
+}
+
+func (cfg LintConfig) stopDistance(a, b int64) (float64, bool) {
+	if a > b {
+		a, b = b, a
+	}
+	if distance, ok := cfg.StopDistances[[2]int64{a, b}]; ok {
+		return distance, true
+	}
+
+	meters, ok := stopDistanceMeters(cfg.Stops[a], cfg.Stops[b])
+	return meters / 1000, ok
+}
+
+// lintCsv reads a CSV with the train ID rules given and lints it, the error
+// tells when the report blocks it. Every way of storing an upload goes through it
+func (s *Store) lintCsv(givenCsv string, rules TrainIDRules, cfg LintConfig) ([]Schedule, LintReport, error) {
+	schedules, err := readCsv(givenCsv, rules)
+	if err != nil {
+		return schedules, LintReport{}, fmt.Errorf("Error reading CSV: %v", err)
+	}
+
+	if cfg.Stops == nil {
+		if cfg.Stops, err = s.getStopMap(); err != nil {
+			return schedules, LintReport{}, err
+		}
+	}
+
+	report := lintSchedules(schedules, cfg)
+	if report.Blocked {
+		return schedules, report, fmt.Errorf("Import blocked by %s lint issues", cfg.BlockOn)
+	}
+
+	return schedules, report, nil
+}
+
+// lintedImport lints a CSV and imports it unless the report blocks it
+func (s *Store) lintedImport(givenCsv string, rules TrainIDRules, cfg LintConfig) (LintReport, error) {
+	schedules, report, err := s.lintCsv(givenCsv, rules, cfg)
+	if err != nil {
+		return report, err
+	}
+
+	return report, s.insertSchedules(schedules)
+}
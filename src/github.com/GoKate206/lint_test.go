@@ -0,0 +1,151 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func lintRules(report LintReport) map[string]string {
+	rules := map[string]string{}
+	for _, issue := range report.Issues {
+		rules[issue.Rule] = issue.Severity
+	}
+
+	return rules
+}
+
+func TestLintSchedules(t *testing.T) {
+	t.Run("when a train is at two stops in the same minute", func(t *testing.T) {
+		report := lintSchedules(mustReadCsv(t, `stopID,route,trainID,time
+1,"C","865a","Jul 04 2021 07:42"
+2,"C","865a","Jul 04 2021 07:42"`), defaultLintConfig())
+
+		t.Run("it will report an error on both lines and block", func(t *testing.T) {
+			require.NotEmpty(t, report.Issues)
+			assert.EqualValues(t, "same-minute-two-stops", report.Issues[0].Rule)
+			assert.EqualValues(t, severityError, report.Issues[0].Severity)
+			assert.EqualValues(t, []int{2, 3}, report.Issues[0].Lines)
+			assert.True(t, report.Blocked)
+		})
+	})
+
+	t.Run("when a train would travel faster than the max speed", func(t *testing.T) {
+		cfg := defaultLintConfig()
+		cfg.StopDistances = map[[2]int64]float64{{1, 2}: 50}
+		report := lintSchedules(mustReadCsv(t, `stopID,route,trainID,time
+2,"C","865a","Jul 04 2021 07:42"
+1,"C","865a","Jul 04 2021 07:52"`), cfg)
+
+		t.Run("it will report an impossible speed", func(t *testing.T) {
+			assert.EqualValues(t, severityError, lintRules(report)["impossible-speed"])
+			assert.EqualValues(t, "Train 865a would travel 300 km/h from stop 2 to 1", report.Issues[0].Message)
+		})
+	})
+
+	t.Run("when rows are duplicated and a train calls at one stop", func(t *testing.T) {
+		report := lintSchedules(mustReadCsv(t, `stopID,route,trainID,time
+1,"C","865a","Jul 04 2021 07:42"
+1,"C","865a","Jul 04 2021 07:42"`), defaultLintConfig())
+
+		t.Run("it will warn without blocking", func(t *testing.T) {
+			rules := lintRules(report)
+			assert.EqualValues(t, severityWarning, rules["duplicate-row"])
+			assert.EqualValues(t, severityWarning, rules["single-stop-train"])
+			assert.False(t, report.Blocked)
+		})
+
+		t.Run("it will block when configured to block on warnings", func(t *testing.T) {
+			cfg := defaultLintConfig()
+			cfg.BlockOn = severityWarning
+			assert.True(t, lintSchedules(mustReadCsv(t, `stopID,route,trainID,time
+1,"C","865a","Jul 04 2021 07:42"`), cfg).Blocked)
+		})
+	})
+
+	t.Run("when a route has a long gap at a stop", func(t *testing.T) {
+		report := lintSchedules(mustReadCsv(t, `stopID,route,trainID,time
+1,"C","865a","Jul 04 2021 07:42"
+2,"C","865a","Jul 04 2021 07:50"
+1,"C","866a","Jul 04 2021 12:00"
+2,"C","866a","Jul 04 2021 12:08"`), defaultLintConfig())
+
+		t.Run("it will note the gap at each stop", func(t *testing.T) {
+			require.Len(t, report.Issues, 2)
+			assert.EqualValues(t, "service-gap", report.Issues[0].Rule)
+			assert.EqualValues(t, "Route C has no train at stop 1 for 258 minutes", report.Issues[0].Message)
+			assert.False(t, report.Blocked)
+		})
+	})
+}
+
+func TestLintedImport(t *testing.T) {
+	store := initTestStore(t)
+	defer tearDownStore(store)
+
+	csv := `stopID,route,trainID,time
+1,"C","865a","Jul 04 2021 07:42"
+2,"C","865a","Jul 04 2021 07:42"`
+
+	t.Run("when the report blocks", func(t *testing.T) {
+		report, err := store.lintedImport(csv, store.trainIDRules, defaultLintConfig())
+
+		t.Run("it will not import anything", func(t *testing.T) {
+			require.Error(t, err)
+			assert.True(t, report.Blocked)
+			schedules, err := store.getAllSchedules()
+			require.Nil(t, err)
+			assert.Len(t, schedules, 0)
+		})
+	})
+
+	t.Run("when blocking is turned off", func(t *testing.T) {
+		cfg := defaultLintConfig()
+		cfg.BlockOn = ""
+		report, err := store.lintedImport(csv, store.trainIDRules, cfg)
+
+		t.Run("it will import and return the issues as warnings", func(t *testing.T) {
+			require.Nil(t, err)
+			assert.NotEmpty(t, report.Issues)
+			schedules, err := store.getAllSchedules()
+			require.Nil(t, err)
+			assert.Len(t, schedules, 2)
+		})
+	})
+	blocking := `stopID,route,trainID,time
+1,"C","777a","Jul 05 2021 07:42"
+2,"C","777a","Jul 05 2021 07:42"`
+
+	t.Run("when a re-upload blocks", func(t *testing.T) {
+		diff, err := store.replaceSchedules(blocking, store.trainIDRules, false, defaultLintConfig())
+
+		t.Run("it will not replace anything", func(t *testing.T) {
+			require.Error(t, err)
+			assert.True(t, diff.Lint.Blocked)
+			assert.False(t, diff.Committed)
+			schedules, err := store.getAllSchedules()
+			require.Nil(t, err)
+			assert.Len(t, schedules, 2)
+		})
+
+		t.Run("a dry run will report it", func(t *testing.T) {
+			diff, err := store.replaceSchedules(blocking, store.trainIDRules, true, defaultLintConfig())
+			require.Nil(t, err)
+			assert.True(t, diff.Lint.Blocked)
+			assert.EqualValues(t, 2, diff.Added)
+		})
+	})
+
+	t.Run("when a timetable version blocks", func(t *testing.T) {
+		_, report, err := store.importTimetable(blocking, store.trainIDRules, "Jul 01 2021", defaultLintConfig())
+
+		t.Run("it will not be stored", func(t *testing.T) {
+			require.Error(t, err)
+			assert.True(t, report.Blocked)
+			versions, err := store.getVersions()
+			require.Nil(t, err)
+			assert.Len(t, versions, 0)
+		})
+	})
+}
@@ -1,13 +1,170 @@
 package main
 
 import (
+	"context"
+	"flag"
 	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"time"
 )
 
 func main() {
-	// If I had more time I would creat a server so users could
-	// interact with a UI to upload CSV Schedules
-	// and request train / stop schedules
-	fmt.Println("Hello Tomo!")
+	dbDir := flag.String("db", fmt.Sprintf("./%s", scheduleDbName), "directory of the schedule database")
+	addr := flag.String("addr", ":8080", "address the server listens on")
+	rulesFile := flag.String("train-id-rules", "", "JSON file of train Id rules per agency")
+	mapping := flag.String("mapping", "", "import through a saved provider mapping, or auto to detect the columns")
+	sheet := flag.String("sheet", "", "sheet of an xlsx import, the first by default")
+	agency := flag.String("agency", "", "agency in -train-id-rules whose train Id rules are used")
+	smtpAddr := flag.String("smtp", "localhost:25", "SMTP server email reminders are sent through")
+	mailFrom := flag.String("mail-from", "reminders@localhost", "sender of email reminders")
+	webhookAllow := flag.String("webhook-allow", "", "comma separated private networks webhooks may be sent to, such as 127.0.0.1 or 10.0.0.0/8")
+	flag.Parse()
 
+	store, err := openStore(*dbDir)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer store.Close()
+
+	if *rulesFile != "" {
+		if store.trainIDRules, err = loadTrainIDRules(*rulesFile, *agency); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	if store.webhookAllowlist, err = parseWebhookAllowlist(*webhookAllow); err != nil {
+		log.Fatal(err)
+	}
+
+	switch flag.Arg(0) {
+	case "", "serve":
+		err = serve(store, *addr, map[string]notifier{
+			channelLog:     logNotifier{logger: log.New(os.Stderr, "", log.LstdFlags)},
+			channelWebhook: webhookNotifier{client: store.webhookAllowlist.client(webhookTimeout)},
+			channelEmail:   emailNotifier{addr: *smtpAddr, from: *mailFrom},
+		})
+	case "import":
+		err = importFile(store, flag.Arg(1), *sheet, *mapping)
+	case "generate":
+		err = generate(flag.Args()[1:])
+	case "calendar":
+		err = calendar(store, flag.Args()[1:])
+	default:
+		err = fmt.Errorf("Unknown command: %s, expected serve, import, generate or calendar", flag.Arg(0))
+	}
+
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+// serve runs the server and the reminder scheduler until interrupted, then
+// lets running requests and, for up to webhookDrainTimeout, webhook
+// deliveries finish before the store is closed
+func serve(store *Store, addr string, notifiers map[string]notifier) error {
+	handler := newServer(store)
+	srv := &http.Server{Addr: addr, Handler: handler}
+	// streams never go idle, they are ended for Shutdown to finish
+	srv.RegisterOnShutdown(handler.shutdown)
+	webhooks := startWebhooks(store)
+	defer webhooks.close()
+
+	stopReminders := make(chan struct{})
+	defer close(stopReminders)
+	go newReminderScheduler(store, notifiers).run(stopReminders)
+
+	done := make(chan error, 1)
+	go func() {
+		interrupt := make(chan os.Signal, 1)
+		signal.Notify(interrupt, os.Interrupt)
+		<-interrupt
+
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		done <- srv.Shutdown(ctx)
+	}()
+
+	log.Printf("Serving train schedules on %s", addr)
+	if err := srv.ListenAndServe(); err != http.ErrServerClosed {
+		return err
+	}
+
+	return <-done
+}
+
+// importFile imports a csv, xlsx, json or ndjson file by its extension
+func importFile(store *Store, path string, sheet string, mapping string) error {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	csv, err := uploadToCsv(b, uploadFormatOf(path), sheet)
+	if err != nil {
+		return err
+	}
+
+	csv, rules, err := store.normalizeCsv(csv, mapping)
+	if err != nil {
+		return err
+	}
+
+	report, err := store.lintedImport(csv, rules, defaultLintConfig())
+	if len(report.Issues) > 0 {
+		fmt.Fprint(os.Stderr, report)
+	}
+
+	return err
+}
+
+// generate prints a synthetic network in the CSV upload format
+func generate(args []string) error {
+	cfg := defaultNetworkConfig(timeNow().UTC().Truncate(24*time.Hour).AddDate(0, 0, 1))
+	flags := flag.NewFlagSet("generate", flag.ContinueOnError)
+	flags.IntVar(&cfg.Stops, "stops", cfg.Stops, "number of stops")
+	flags.IntVar(&cfg.Routes, "routes", cfg.Routes, "number of routes")
+	flags.IntVar(&cfg.StopsPerRoute, "stops-per-route", cfg.StopsPerRoute, "stops each route calls at")
+	flags.IntVar(&cfg.HeadwayMinutes, "headway", cfg.HeadwayMinutes, "weekday minutes between trains")
+	flags.IntVar(&cfg.Days, "days", cfg.Days, "service days starting tomorrow")
+	flags.Int64Var(&cfg.Seed, "seed", cfg.Seed, "random seed")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	csv, err := generateNetwork(cfg)
+	if err != nil {
+		return err
+	}
+
+	_, err = fmt.Println(csv)
+	return err
+}
+
+// calendar writes the trains matching its filter flags as an .ics file
+func calendar(store *Store, args []string) error {
+	filter := ScheduleFilter{}
+	flags := flag.NewFlagSet("calendar", flag.ContinueOnError)
+	stopID := flags.Int64("stop", -1, "stop Id, any stop by default")
+	flags.StringVar(&filter.Route, "route", "", "route")
+	flags.StringVar(&filter.TrainID, "train", "", "train Id")
+	flags.StringVar(&filter.From, "from", "", "first service day, today by default")
+	flags.StringVar(&filter.To, "to", "", "last service day")
+	out := flags.String("o", "train-schedule.ics", "file to write")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if *stopID >= 0 {
+		filter.StopID = stopID
+	}
+
+	schedules, err := store.calendarSchedules(filter)
+	if err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(*out, []byte(renderICal(calendarName(filter), schedules)), 0644)
 }
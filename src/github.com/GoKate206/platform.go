@@ -0,0 +1,126 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+)
+
+var platformChangeDbName = "platform-changes"
+
+// PlatformChange moves a train to another platform, or track, at a stop
+// on a service day. An empty Track leaves the timetabled track
+type PlatformChange struct {
+	ID         string `json:"ID"`
+	TrainID    string `json:"trainID"`
+	ServiceDay string `json:"serviceDay"`
+	StopID     int64  `json:"stopID"`
+	Platform   string `json:"platform"`
+	Track      string `json:"track,omitempty"`
+	Reason     string `json:"reason,omitempty"`
+}
+
+func (c PlatformChange) applies(schedule Schedule) bool {
+	return c.TrainID == schedule.TrainID && c.StopID == schedule.StopID
+}
+
+// apply moves the schedule, keeping what was timetabled so riders
+// can be told about the change
+func (c PlatformChange) apply(schedule *Schedule) {
+	if schedule.ScheduledPlatform == "" {
+		schedule.ScheduledPlatform = schedule.Platform
+		if schedule.ScheduledPlatform == "" {
+			schedule.ScheduledPlatform = "?"
+		}
+	}
+	schedule.Platform = c.Platform
+	if c.Track != "" {
+		schedule.Track = c.Track
+	}
+}
+
+// parsePlatform trims a platform or track, they are short labels like 3 or 12b
+func parsePlatform(value string) (string, error) {
+	value = strings.TrimSpace(value)
+	if len(value) > 8 {
+		return "", fmt.Errorf("Platform and track must be at most 8 characters, got: %s", value)
+	}
+
+	return value, nil
+}
+
+func (s *Store) addPlatformChange(change PlatformChange) (PlatformChange, error) {
+	if _, err := s.trainIDRules.validate(change.TrainID); err != nil {
+		return change, err
+	}
+
+	day, err := time.Parse(dateLayout, change.ServiceDay)
+	if err != nil {
+		return change, err
+	}
+	change.ServiceDay = day.Format(dateLayout)
+
+	if change.Platform, err = parsePlatform(change.Platform); err != nil {
+		return change, err
+	}
+	if change.Platform == "" {
+		return change, fmt.Errorf("Platform is required")
+	}
+	if change.Track, err = parsePlatform(change.Track); err != nil {
+		return change, err
+	}
+
+	if err := s.lock(); err != nil {
+		return change, err
+	}
+	defer s.mu.Unlock()
+
+	change.ID = newID()
+	s.invalidateLocked(platformChangeDbName)
+
+	if err := s.driver.Write(platformChangeDbName, change.ID, &change); err != nil {
+		return change, err
+	}
+	s.publishOverrideLocked(changeOverrideAdded, platformChangeDbName, change)
+
+	return change, nil
+}
+
+func (s *Store) getPlatformChanges() ([]PlatformChange, error) {
+	if err := s.rlock(); err != nil {
+		return []PlatformChange{}, err
+	}
+	defer s.mu.RUnlock()
+
+	return s.getPlatformChangesLocked()
+}
+
+// getPlatformChangesLocked returns every platform change, cached until one is written
+func (s *Store) getPlatformChangesLocked() ([]PlatformChange, error) {
+	s.cacheMu.Lock()
+	defer s.cacheMu.Unlock()
+
+	if s.platformChanges != nil {
+		return s.platformChanges, nil
+	}
+
+	changes := []PlatformChange{}
+	bytes, err := s.driver.ReadAll(platformChangeDbName)
+	// ReadAll will error if there are no rows,
+	// only error if there are rows
+	if len(bytes) > 0 && err != nil {
+		return changes, err
+	}
+
+	for _, b := range bytes {
+		change := PlatformChange{}
+		if err := json.Unmarshal(b, &change); err != nil {
+			return changes, err
+		}
+		changes = append(changes, change)
+	}
+	s.platformChanges = changes
+
+	return changes, nil
+}
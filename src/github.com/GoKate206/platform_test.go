@@ -0,0 +1,102 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPlatforms(t *testing.T) {
+	store := initTestStore(t)
+	defer tearDownStore(store)
+	require.Nil(t, store.csvHandler(`stopID,route,trainID,time,platform,track
+1,"C","865a","Jul 04 2021 07:42",2,b
+1,"55","465a","Jul 04 2021 07:42",3,
+1,"C","865a","Jul 05 2021 07:42",2,b
+1,"55","465a","Jul 05 2021 07:42",3,`))
+
+	t.Run("when trains have platforms", func(t *testing.T) {
+		next, err := store.getNextTrains(1, "Jul 04 2021 07:42")
+		require.Nil(t, err)
+
+		t.Run("stop queries will return them", func(t *testing.T) {
+			require.Len(t, next.Trains, 2)
+			platforms := map[string]string{}
+			for _, train := range next.Trains {
+				platforms[train.TrainID] = train.Platform + train.Track
+			}
+			assert.EqualValues(t, map[string]string{"865a": "2b", "465a": "3"}, platforms)
+		})
+	})
+
+	t.Run("when a train is moved to another platform", func(t *testing.T) {
+		change, err := store.addPlatformChange(PlatformChange{TrainID: "865a", ServiceDay: "Jul 05 2021", StopID: 1, Platform: "4", Reason: "Works"})
+		require.Nil(t, err)
+		next, err := store.getNextTrains(1, "Jul 05 2021 07:42")
+		require.Nil(t, err)
+
+		t.Run("it will apply on its service day and keep the timetabled platform", func(t *testing.T) {
+			for _, train := range next.Trains {
+				if train.TrainID == "865a" {
+					assert.EqualValues(t, "4", train.Platform)
+					assert.EqualValues(t, "b", train.Track)
+					assert.EqualValues(t, "2", train.ScheduledPlatform)
+				}
+			}
+
+			today, err := store.getNextTrains(1, "Jul 04 2021 07:42")
+			require.Nil(t, err)
+			for _, train := range today.Trains {
+				assert.EqualValues(t, "", train.ScheduledPlatform)
+			}
+		})
+
+		t.Run("the board will show the new platform", func(t *testing.T) {
+			clock, _ := time.Parse(layout, "Jul 05 2021 07:40")
+			board, err := store.buildDepartureBoard(1, clock)
+			require.Nil(t, err)
+			text := renderBoardText(board)
+			assert.Contains(t, text, "C    865A P4       2 MIN")
+			html, err := renderBoardHTML(board)
+			require.Nil(t, err)
+			assert.Contains(t, string(html), "<td>Platform 4 ( changed from 2 )</td>")
+		})
+
+		t.Run("it can be removed", func(t *testing.T) {
+			require.Nil(t, store.deleteOverride(platformChangeDbName, change.ID))
+			changes, err := store.getPlatformChanges()
+			require.Nil(t, err)
+			assert.Len(t, changes, 0)
+		})
+	})
+
+	t.Run("when a platform change is invalid", func(t *testing.T) {
+		cases := map[string]PlatformChange{
+			"Platform is required": {TrainID: "865a", ServiceDay: "Jul 05 2021", StopID: 1},
+			"Platform and track must be at most 8 characters, got: platform 12": {TrainID: "865a", ServiceDay: "Jul 05 2021", StopID: 1, Platform: "platform 12"},
+		}
+
+		for expected, change := range cases {
+			_, err := store.addPlatformChange(change)
+			require.Error(t, err)
+			assert.EqualValues(t, expected, err.Error())
+		}
+	})
+
+	t.Run("when a platform change is posted", func(t *testing.T) {
+		srv := httptest.NewServer(newServer(store))
+		defer srv.Close()
+		res, err := http.Post(srv.URL+"/platform-changes", "application/json", strings.NewReader(`{"trainID": "465a", "serviceDay": "Jul 05 2021", "stopID": 1, "platform": "1"}`))
+		require.Nil(t, err)
+		res.Body.Close()
+
+		t.Run("it will be created", func(t *testing.T) {
+			assert.EqualValues(t, http.StatusCreated, res.StatusCode)
+		})
+	})
+}
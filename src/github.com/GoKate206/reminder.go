@@ -0,0 +1,487 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/mail"
+	"net/smtp"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	channelLog     = "log"
+	channelWebhook = "webhook"
+	channelEmail   = "email"
+)
+
+var (
+	riderSubscriptionDbName = "rider-subscriptions"
+	// defaultLeadMinutes is how long before the train a rider is reminded
+	defaultLeadMinutes = 10
+	maxLeadMinutes     = 240
+	// reminderInterval is how often the scheduler looks for reminders due
+	reminderInterval = time.Minute
+	// mailTimeout bounds connecting to and talking with the SMTP server
+	mailTimeout = 30 * time.Second
+)
+
+// RiderSubscription reminds a rider LeadMinutes before their train arrives
+// at a stop, the trains of a route or one train. Days are the service
+// days it runs on, every day when empty. Reminders go out on Channel,
+// to Address for webhooks and email
+type RiderSubscription struct {
+	ID          string   `json:"ID"`
+	Rider       string   `json:"rider"`
+	StopID      int64    `json:"stopID"`
+	Route       string   `json:"route,omitempty"`
+	TrainID     string   `json:"trainID,omitempty"`
+	LeadMinutes int      `json:"leadMinutes"`
+	Days        []string `json:"days,omitempty"`
+	Channel     string   `json:"channel"`
+	Address     string   `json:"address,omitempty"`
+}
+
+// Reminder is a train a subscription is due to be reminded of
+type Reminder struct {
+	Subscription RiderSubscription `json:"subscription"`
+	StopName     string            `json:"stopName,omitempty"`
+	Train        Schedule          `json:"train"`
+	ServiceDay   string            `json:"serviceDay"`
+	RemindAt     string            `json:"remindAt"`
+}
+
+// parseWeekday reads a day of the week by its name or first three letters
+func parseWeekday(value string) (time.Weekday, error) {
+	value = strings.ToLower(strings.TrimSpace(value))
+	for day := time.Sunday; day <= time.Saturday; day++ {
+		name := strings.ToLower(day.String())
+		if len(value) >= 3 && strings.HasPrefix(name, value) {
+			return day, nil
+		}
+	}
+
+	return time.Sunday, fmt.Errorf("Day must be a day of the week, got: %s", value)
+}
+
+// validate normalizes the subscription, days become Mon, Tue, ...
+func (r RiderSubscription) validate(rules TrainIDRules, allow WebhookAllowlist) (RiderSubscription, error) {
+	r.Rider = strings.TrimSpace(r.Rider)
+	if r.Rider == "" {
+		return r, fmt.Errorf("Rider is required")
+	}
+	if r.Route == "" && r.TrainID == "" {
+		return r, fmt.Errorf("Subscriptions need a route or a train")
+	}
+	if r.TrainID != "" {
+		trainID, err := rules.validate(r.TrainID)
+		if err != nil {
+			return r, err
+		}
+		r.TrainID = trainID
+	}
+
+	if r.LeadMinutes == 0 {
+		r.LeadMinutes = defaultLeadMinutes
+	}
+	if r.LeadMinutes < 0 || r.LeadMinutes > maxLeadMinutes {
+		return r, fmt.Errorf("Lead minutes must be between 1 and %d, got: %d", maxLeadMinutes, r.LeadMinutes)
+	}
+
+	days := []string{}
+	for _, value := range r.Days {
+		day, err := parseWeekday(value)
+		if err != nil {
+			return r, err
+		}
+		if !containsString(days, day.String()[:3]) {
+			days = append(days, day.String()[:3])
+		}
+	}
+	r.Days = days
+
+	if r.Channel == "" {
+		r.Channel = channelLog
+	}
+	switch r.Channel {
+	case channelLog:
+	case channelWebhook:
+		if err := (Webhook{URL: r.Address}).validate(allow); err != nil {
+			return r, err
+		}
+	case channelEmail:
+		address, err := mail.ParseAddress(r.Address)
+		if err != nil {
+			return r, fmt.Errorf("Address must be an email address, got: %s", r.Address)
+		}
+		// a display name would end up inside RCPT TO
+		r.Address = address.Address
+	default:
+		return r, fmt.Errorf("Channel must be log, webhook or email, got: %s", r.Channel)
+	}
+
+	return r, nil
+}
+
+// runsOn tells if the subscription is wanted on a service day
+func (r RiderSubscription) runsOn(day time.Weekday) bool {
+	return len(r.Days) == 0 || containsString(r.Days, day.String()[:3])
+}
+
+func (r RiderSubscription) matches(schedule Schedule) bool {
+	return schedule.StopID == r.StopID &&
+		(r.Route == "" || schedule.Route == r.Route) &&
+		(r.TrainID == "" || schedule.TrainID == r.TrainID)
+}
+
+// message is the reminder as told to the rider
+func (r Reminder) message() string {
+	stop := r.StopName
+	if stop == "" {
+		stop = fmt.Sprintf("stop %d", r.Train.StopID)
+	}
+	at := r.Train.Time[strings.LastIndex(r.Train.Time, " ")+1:]
+
+	if r.Train.Status == statusCancelled {
+		return fmt.Sprintf("Train %s ( %s ) at %s at %s is cancelled", r.Train.TrainID, r.Train.Route, stop, at)
+	}
+	message := fmt.Sprintf("Train %s ( %s ) arrives at %s at %s, in %d min", r.Train.TrainID, r.Train.Route, stop, at, r.Subscription.LeadMinutes)
+	if r.Train.Platform != "" {
+		message += ", platform " + r.Train.Platform
+	}
+
+	return message
+}
+
+func (s *Store) addRiderSubscription(subscription RiderSubscription) (RiderSubscription, error) {
+	subscription, err := subscription.validate(s.trainIDRules, s.webhookAllowlist)
+	if err != nil {
+		return subscription, err
+	}
+
+	if err := s.lock(); err != nil {
+		return subscription, err
+	}
+	defer s.mu.Unlock()
+
+	subscription.ID = newID()
+
+	return subscription, s.driver.Write(riderSubscriptionDbName, subscription.ID, &subscription)
+}
+
+func (s *Store) deleteRiderSubscription(id string) error {
+	if err := s.lock(); err != nil {
+		return err
+	}
+	defer s.mu.Unlock()
+
+	if err := s.driver.Read(riderSubscriptionDbName, id, &RiderSubscription{}); err != nil {
+		return fmt.Errorf("Subscription not found: %s", id)
+	}
+
+	return s.driver.Delete(riderSubscriptionDbName, id)
+}
+
+// getRiderSubscriptions returns a rider's subscriptions, or everyone's
+// when rider is empty
+func (s *Store) getRiderSubscriptions(rider string) ([]RiderSubscription, error) {
+	if err := s.rlock(); err != nil {
+		return []RiderSubscription{}, err
+	}
+	defer s.mu.RUnlock()
+
+	return s.getRiderSubscriptionsLocked(rider)
+}
+
+func (s *Store) getRiderSubscriptionsLocked(rider string) ([]RiderSubscription, error) {
+	subscriptions := []RiderSubscription{}
+	bytes, err := s.driver.ReadAll(riderSubscriptionDbName)
+	// ReadAll will error if there are no rows,
+	// only error if there are rows
+	if len(bytes) > 0 && err != nil {
+		return subscriptions, err
+	}
+
+	for _, b := range bytes {
+		subscription := RiderSubscription{}
+		if err := json.Unmarshal(b, &subscription); err != nil {
+			return subscriptions, err
+		}
+		if rider == "" || subscription.Rider == rider {
+			subscriptions = append(subscriptions, subscription)
+		}
+	}
+	sort.Slice(subscriptions, func(i, j int) bool {
+		if subscriptions[i].Rider != subscriptions[j].Rider {
+			return subscriptions[i].Rider < subscriptions[j].Rider
+		}
+		return subscriptions[i].ID < subscriptions[j].ID
+	})
+
+	return subscriptions, nil
+}
+
+// dueReminders returns the reminders falling due after from up to and
+// including to, trains arriving in that window moved by each lead time.
+// Cancelled trains are reminded of too, so riders know not to wait
+func (s *Store) dueReminders(from, to time.Time) ([]Reminder, error) {
+	reminders := []Reminder{}
+	if err := s.rlock(); err != nil {
+		return reminders, err
+	}
+	defer s.mu.RUnlock()
+
+	subscriptions, err := s.getRiderSubscriptionsLocked("")
+	if err != nil {
+		return reminders, err
+	}
+
+	stops, err := s.getStopsLocked()
+	if err != nil {
+		return reminders, err
+	}
+
+	for _, subscription := range subscriptions {
+		lead := time.Duration(subscription.LeadMinutes) * time.Minute
+		start, end := from.Add(lead), to.Add(lead)
+
+		for _, date := range []time.Time{start, end} {
+			day, err := s.dayLocked(date)
+			if err != nil {
+				return reminders, err
+			}
+			serviceDay := serviceDayOf(date)
+			weekday, _ := time.Parse(dateLayout, serviceDay)
+
+			for _, n := range day.stopFrom(subscription.StopID, start) {
+				if day.times[n].After(end) {
+					break
+				}
+				if !day.times[n].After(start) || !subscription.matches(day.schedules[n]) || !subscription.runsOn(weekday.Weekday()) {
+					continue
+				}
+
+				reminders = append(reminders, Reminder{
+					Subscription: subscription,
+					StopName:     stops[subscription.StopID].Name,
+					Train:        day.schedules[n],
+					ServiceDay:   serviceDay,
+					RemindAt:     day.times[n].Add(-lead).Format(layout),
+				})
+			}
+
+			if serviceDayOf(start) == serviceDayOf(end) {
+				break
+			}
+		}
+	}
+
+	sort.SliceStable(reminders, func(i, j int) bool { return reminders[i].RemindAt < reminders[j].RemindAt })
+
+	return reminders, nil
+}
+
+// notifier sends a reminder to its rider
+type notifier interface {
+	notify(reminder Reminder) error
+}
+
+// logNotifier writes reminders to a log, for trying subscriptions out
+type logNotifier struct {
+	logger *log.Logger
+}
+
+func (n logNotifier) notify(reminder Reminder) error {
+	n.logger.Printf("Reminder for %s: %s", reminder.Subscription.Rider, reminder.message())
+	return nil
+}
+
+// webhookNotifier posts the reminder as JSON to the subscription's address
+type webhookNotifier struct {
+	client *http.Client
+}
+
+func (n webhookNotifier) notify(reminder Reminder) error {
+	body, err := json.Marshal(reminder)
+	if err != nil {
+		return err
+	}
+
+	res, err := n.client.Post(reminder.Subscription.Address, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return fmt.Errorf("Reminder webhook answered %d", res.StatusCode)
+	}
+
+	return nil
+}
+
+// emailNotifier mails the reminder through an SMTP server, usually a
+// local relay or stand-in, without authentication
+type emailNotifier struct {
+	addr string
+	from string
+}
+
+func (n emailNotifier) notify(reminder Reminder) error {
+	// the message is the subject too, a line break in a stop name
+	// must not start a header of its own
+	message := strings.NewReplacer("\r", " ", "\n", " ").Replace(reminder.message())
+	// subscriptions saved before addresses were normalized may have a display name
+	to, err := mail.ParseAddress(reminder.Subscription.Address)
+	if err != nil {
+		return fmt.Errorf("Address must be an email address, got: %s", reminder.Subscription.Address)
+	}
+	body := strings.Join([]string{
+		"From: " + n.from,
+		"To: " + to.Address,
+		"Subject: " + message,
+		"Content-Type: text/plain; charset=utf-8",
+		"",
+		message,
+		"",
+	}, "\r\n")
+
+	return n.send(to.Address, []byte(body))
+}
+
+// send is smtp.SendMail with a deadline, so a server that stops
+// answering cannot hold up the scheduler
+func (n emailNotifier) send(to string, body []byte) error {
+	conn, err := net.DialTimeout("tcp", n.addr, mailTimeout)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if err := conn.SetDeadline(time.Now().Add(mailTimeout)); err != nil {
+		return err
+	}
+
+	host, _, _ := net.SplitHostPort(n.addr)
+	c, err := smtp.NewClient(conn, host)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	if ok, _ := c.Extension("STARTTLS"); ok {
+		if err := c.StartTLS(&tls.Config{ServerName: host}); err != nil {
+			return err
+		}
+	}
+	if err := c.Mail(n.from); err != nil {
+		return err
+	}
+	if err := c.Rcpt(to); err != nil {
+		return err
+	}
+	w, err := c.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(body); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+
+	return c.Quit()
+}
+
+// reminderScheduler sends the reminders falling due each minute through
+// the notifier of their channel
+type reminderScheduler struct {
+	store     *Store
+	notifiers map[string]notifier
+	// last is the clock of the last tick, reminders up to it were sent
+	// or are pending, failed ones tried again each tick until their train arrives
+	last    time.Time
+	pending []Reminder
+}
+
+func newReminderScheduler(store *Store, notifiers map[string]notifier) *reminderScheduler {
+	return &reminderScheduler{store: store, notifiers: notifiers}
+}
+
+// run ticks every reminderInterval until done is closed
+func (r *reminderScheduler) run(done <-chan struct{}) {
+	ticker := time.NewTicker(reminderInterval)
+	defer ticker.Stop()
+
+	for {
+		if _, err := r.tick(timeNow().UTC()); err != nil {
+			log.Printf("Reminders: %v", err)
+		}
+
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// tick sends the reminders due since the last tick, or in the minute up
+// to now on the first, and those that failed before. A reminder that
+// cannot be sent does not stop the others, the last error is returned
+func (r *reminderScheduler) tick(now time.Time) ([]Reminder, error) {
+	// schedules are in UTC, a local clock would look up the wrong service day
+	now = now.UTC().Truncate(time.Minute)
+	from := r.last
+	if from.IsZero() || !from.Before(now) {
+		from = now.Add(-time.Minute)
+	}
+
+	reminders, err := r.store.dueReminders(from, now)
+	if err != nil {
+		return reminders, err
+	}
+	r.last = now
+	reminders = append(r.stillPending(now), reminders...)
+	r.pending = nil
+
+	sent := []Reminder{}
+	for _, reminder := range reminders {
+		n, ok := r.notifiers[reminder.Subscription.Channel]
+		if !ok {
+			err = fmt.Errorf("No notifier for channel: %s", reminder.Subscription.Channel)
+			continue
+		}
+
+		if notifyErr := n.notify(reminder); notifyErr != nil {
+			err = fmt.Errorf("Reminder for %s: %v", reminder.Subscription.Rider, notifyErr)
+			r.pending = append(r.pending, reminder)
+			continue
+		}
+		sent = append(sent, reminder)
+	}
+
+	return sent, err
+}
+
+// stillPending returns the reminders that failed before whose train is
+// still to come, the others are dropped with a log line
+func (r *reminderScheduler) stillPending(now time.Time) []Reminder {
+	pending := []Reminder{}
+	for _, reminder := range r.pending {
+		arrives, _, err := parseScheduleTime(reminder.Train.Time)
+		if err != nil || !arrives.After(now) {
+			log.Printf("Dropped reminder for %s of train %s, it could not be sent before the train arrived", reminder.Subscription.Rider, reminder.Train.TrainID)
+			continue
+		}
+		pending = append(pending, reminder)
+	}
+
+	return pending
+}
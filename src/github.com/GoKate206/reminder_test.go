@@ -0,0 +1,366 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// recordNotifier keeps what it was asked to send
+type recordNotifier struct {
+	reminders []Reminder
+}
+
+func (n *recordNotifier) notify(reminder Reminder) error {
+	n.reminders = append(n.reminders, reminder)
+	return nil
+}
+
+// failingNotifier fails the first failures reminders, then records the rest
+type failingNotifier struct {
+	failures int
+	recordNotifier
+}
+
+func (n *failingNotifier) notify(reminder Reminder) error {
+	if n.failures > 0 {
+		n.failures--
+		return fmt.Errorf("Unreachable")
+	}
+	return n.recordNotifier.notify(reminder)
+}
+
+// smtpStandIn accepts one mail, enough of SMTP for net/smtp, and sends
+// the message it was given after its RCPT command
+func smtpStandIn(t *testing.T) (string, <-chan string) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.Nil(t, err)
+	messages := make(chan string, 1)
+
+	go func() {
+		defer listener.Close()
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		reader := bufio.NewReader(conn)
+		rcpt := ""
+		fmt.Fprint(conn, "220 localhost ESMTP\r\n")
+		for {
+			line, err := reader.ReadString('\n')
+			if err != nil {
+				return
+			}
+
+			switch command := strings.ToUpper(strings.Fields(line + " x")[0]); command {
+			case "EHLO", "HELO":
+				fmt.Fprint(conn, "250 localhost\r\n")
+			case "RCPT":
+				rcpt = line
+				fmt.Fprint(conn, "250 OK\r\n")
+			case "DATA":
+				fmt.Fprint(conn, "354 End data with <CR><LF>.<CR><LF>\r\n")
+				message := rcpt
+				for {
+					line, err := reader.ReadString('\n')
+					if err != nil || line == ".\r\n" {
+						break
+					}
+					message += line
+				}
+				messages <- message
+				fmt.Fprint(conn, "250 OK\r\n")
+			case "QUIT":
+				fmt.Fprint(conn, "221 Bye\r\n")
+				return
+			default:
+				fmt.Fprint(conn, "250 OK\r\n")
+			}
+		}
+	}()
+
+	return listener.Addr().String(), messages
+}
+
+func TestRiderSubscriptionValidation(t *testing.T) {
+	t.Run("when a subscription leaves out the defaults", func(t *testing.T) {
+		subscription, err := RiderSubscription{Rider: "ana", StopID: 1, Route: "C", Days: []string{"monday", "Fri", "mon"}}.validate(defaultTrainIDRules(), nil)
+		require.Nil(t, err)
+
+		t.Run("it will be reminded 10 min before on the log", func(t *testing.T) {
+			assert.EqualValues(t, 10, subscription.LeadMinutes)
+			assert.EqualValues(t, channelLog, subscription.Channel)
+			assert.EqualValues(t, []string{"Mon", "Fri"}, subscription.Days)
+		})
+	})
+
+	t.Run("when an email address has a display name", func(t *testing.T) {
+		subscription, err := RiderSubscription{Rider: "ana", StopID: 1, Route: "C", Channel: channelEmail, Address: "Ana <ana@example.com>"}.validate(defaultTrainIDRules(), nil)
+		require.Nil(t, err)
+
+		t.Run("it will keep the bare address", func(t *testing.T) {
+			assert.EqualValues(t, "ana@example.com", subscription.Address)
+		})
+	})
+
+	t.Run("when a subscription is invalid", func(t *testing.T) {
+		cases := map[string]RiderSubscription{
+			"Subscriptions need a route or a train":                       {Rider: "ana", StopID: 1},
+			"Day must be a day of the week, got: someday":                 {Rider: "ana", StopID: 1, Route: "C", Days: []string{"someday"}},
+			"Lead minutes must be between 1 and 240, got: 300":            {Rider: "ana", StopID: 1, Route: "C", LeadMinutes: 300},
+			"Channel must be log, webhook or email, got: pager":           {Rider: "ana", StopID: 1, Route: "C", Channel: "pager"},
+			"Address must be an email address, got: ana":                  {Rider: "ana", StopID: 1, Route: "C", Channel: channelEmail, Address: "ana"},
+			"Webhook URL must be an absolute http or https URL, got: ana": {Rider: "ana", StopID: 1, Route: "C", Channel: channelWebhook, Address: "ana"},
+		}
+
+		for expected, subscription := range cases {
+			_, err := subscription.validate(defaultTrainIDRules(), nil)
+			require.Error(t, err)
+			assert.EqualValues(t, expected, err.Error())
+		}
+	})
+}
+
+func TestReminders(t *testing.T) {
+	store := initTestStore(t)
+	defer tearDownStore(store)
+	require.Nil(t, store.csvHandler(`stopID,route,trainID,time,platform
+1,"C","865a","Jul 04 2021 07:42",2
+1,"C","866a","Jul 04 2021 07:50",
+1,"55","465a","Jul 04 2021 07:50",
+2,"C","865a","Jul 04 2021 07:55",`))
+	_, err := store.saveStop(Stop{ID: 1, Name: "Central"})
+	require.Nil(t, err)
+
+	// Jul 04 2021 is a Sunday
+	sunday, err := store.addRiderSubscription(RiderSubscription{Rider: "ana", StopID: 1, Route: "C", Days: []string{"sun"}})
+	require.Nil(t, err)
+	_, err = store.addRiderSubscription(RiderSubscription{Rider: "ben", StopID: 1, TrainID: "466a", LeadMinutes: 5, Days: []string{"mon"}})
+	require.Nil(t, err)
+
+	logged := &recordNotifier{}
+	scheduler := newReminderScheduler(store, map[string]notifier{channelLog: logged})
+	at := func(value string) time.Time {
+		t, _ := time.Parse(layout, value)
+		return t
+	}
+
+	t.Run("when a train arrives in the lead time", func(t *testing.T) {
+		sent, err := scheduler.tick(at("Jul 04 2021 07:32"))
+		require.Nil(t, err)
+
+		t.Run("it will remind the rider through their channel", func(t *testing.T) {
+			require.Len(t, sent, 1)
+			assert.EqualValues(t, sunday.ID, sent[0].Subscription.ID)
+			assert.EqualValues(t, "865a", sent[0].Train.TrainID)
+			assert.EqualValues(t, "Jul 04 2021 07:32", sent[0].RemindAt)
+			assert.EqualValues(t, "Train 865a ( C ) arrives at Central at 07:42, in 10 min, platform 2", sent[0].message())
+			assert.Len(t, logged.reminders, 1)
+		})
+	})
+
+	t.Run("when the next tick comes", func(t *testing.T) {
+		sent, err := scheduler.tick(at("Jul 04 2021 07:33"))
+		require.Nil(t, err)
+
+		t.Run("it will not remind of the same train twice", func(t *testing.T) {
+			assert.Len(t, sent, 0)
+		})
+	})
+
+	t.Run("when ticks were missed and a train is cancelled", func(t *testing.T) {
+		_, err := store.addCancellation(Cancellation{TrainID: "866a", ServiceDay: "Jul 04 2021"})
+		require.Nil(t, err)
+		sent, err := scheduler.tick(at("Jul 04 2021 07:40"))
+		require.Nil(t, err)
+
+		t.Run("it will catch up on the route's trains only and tell of the cancellation", func(t *testing.T) {
+			require.Len(t, sent, 1)
+			assert.EqualValues(t, "866a", sent[0].Train.TrainID)
+			assert.EqualValues(t, "Train 866a ( C ) at Central at 07:50 is cancelled", sent[0].message())
+		})
+	})
+
+	t.Run("when reminders go out by webhook and email", func(t *testing.T) {
+		received := make(chan Reminder, 1)
+		receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			reminder := Reminder{}
+			json.NewDecoder(r.Body).Decode(&reminder)
+			received <- reminder
+		}))
+		defer receiver.Close()
+		addr, messages := smtpStandIn(t)
+
+		reminder := Reminder{Subscription: RiderSubscription{Rider: "ana", LeadMinutes: 10, Channel: channelWebhook, Address: receiver.URL}, Train: Schedule{StopID: 1, Route: "C", TrainID: "865a", Time: "Jul 04 2021 07:42"}}
+		require.Nil(t, webhookNotifier{client: http.DefaultClient}.notify(reminder))
+
+		reminder.Subscription.Channel, reminder.Subscription.Address = channelEmail, "ana@example.com"
+		require.Nil(t, emailNotifier{addr: addr, from: "reminders@localhost"}.notify(reminder))
+
+		t.Run("it will post the reminder as JSON", func(t *testing.T) {
+			assert.EqualValues(t, "865a", (<-received).Train.TrainID)
+		})
+
+		t.Run("it will mail the message through SMTP", func(t *testing.T) {
+			message := <-messages
+			assert.Contains(t, message, "To: ana@example.com\r\n")
+			assert.Contains(t, message, "Subject: Train 865a ( C ) arrives at stop 1 at 07:42, in 10 min\r\n")
+		})
+	})
+
+	t.Run("when subscriptions are managed over the server", func(t *testing.T) {
+		srv := httptest.NewServer(newServer(store))
+		defer srv.Close()
+
+		res, err := http.Post(srv.URL+"/subscriptions", "application/json", strings.NewReader(`{"rider": "cy", "stopID": 2, "route": "C", "leadMinutes": 15, "days": ["Sat", "Sun"]}`))
+		require.Nil(t, err)
+		defer res.Body.Close()
+		created := RiderSubscription{}
+		require.Nil(t, json.NewDecoder(res.Body).Decode(&created))
+
+		t.Run("it will save and list a rider's subscriptions", func(t *testing.T) {
+			assert.EqualValues(t, http.StatusCreated, res.StatusCode)
+			res, err := http.Get(srv.URL + "/subscriptions?rider=cy")
+			require.Nil(t, err)
+			defer res.Body.Close()
+			subscriptions := []RiderSubscription{}
+			require.Nil(t, json.NewDecoder(res.Body).Decode(&subscriptions))
+			assert.EqualValues(t, []RiderSubscription{created}, subscriptions)
+		})
+
+		t.Run("it will delete one", func(t *testing.T) {
+			req, _ := http.NewRequest(http.MethodDelete, srv.URL+"/subscriptions/"+created.ID, nil)
+			res, err := http.DefaultClient.Do(req)
+			require.Nil(t, err)
+			res.Body.Close()
+			assert.EqualValues(t, http.StatusNoContent, res.StatusCode)
+
+			subscriptions, err := store.getRiderSubscriptions("cy")
+			require.Nil(t, err)
+			assert.Len(t, subscriptions, 0)
+		})
+	})
+}
+
+func TestReminderDelivery(t *testing.T) {
+	store := initTestStore(t)
+	defer tearDownStore(store)
+	require.Nil(t, store.csvHandler(`stopID,route,trainID,time
+1,"C","865a","Jul 04 2021 07:42"
+1,"C","866a","Jul 04 2021 08:42"`))
+	_, err := store.addRiderSubscription(RiderSubscription{Rider: "ana", StopID: 1, Route: "C"})
+	require.Nil(t, err)
+	at := func(value string) time.Time {
+		t, _ := time.Parse(layout, value)
+		return t
+	}
+
+	t.Run("when the clock is not in UTC", func(t *testing.T) {
+		logged := &recordNotifier{}
+		scheduler := newReminderScheduler(store, map[string]notifier{channelLog: logged})
+		// 07:32 UTC is still Jul 03 eight hours behind
+		sent, err := scheduler.tick(at("Jul 04 2021 07:32").In(time.FixedZone("UTC-8", -8*60*60)))
+		require.Nil(t, err)
+
+		t.Run("it will remind of the train on the UTC service day", func(t *testing.T) {
+			require.Len(t, sent, 1)
+			assert.EqualValues(t, "865a", sent[0].Train.TrainID)
+			assert.EqualValues(t, "Jul 04 2021", sent[0].ServiceDay)
+		})
+	})
+
+	t.Run("when a reminder cannot be sent", func(t *testing.T) {
+		failing := &failingNotifier{failures: 1}
+		scheduler := newReminderScheduler(store, map[string]notifier{channelLog: failing})
+		sent, err := scheduler.tick(at("Jul 04 2021 07:32"))
+		require.Error(t, err)
+		assert.Len(t, sent, 0)
+
+		t.Run("it will be tried again on the next tick", func(t *testing.T) {
+			sent, err := scheduler.tick(at("Jul 04 2021 07:33"))
+			require.Nil(t, err)
+			require.Len(t, sent, 1)
+			assert.EqualValues(t, "865a", sent[0].Train.TrainID)
+		})
+	})
+
+	t.Run("when a reminder fails until its train arrives", func(t *testing.T) {
+		failing := &failingNotifier{failures: 1}
+		scheduler := newReminderScheduler(store, map[string]notifier{channelLog: failing})
+		_, err := scheduler.tick(at("Jul 04 2021 07:32"))
+		require.Error(t, err)
+
+		t.Run("it will be dropped", func(t *testing.T) {
+			sent, err := scheduler.tick(at("Jul 04 2021 07:43"))
+			require.Nil(t, err)
+			assert.Len(t, sent, 0)
+			assert.Len(t, scheduler.pending, 0)
+		})
+	})
+
+	t.Run("when a stop name would start a mail header", func(t *testing.T) {
+		addr, messages := smtpStandIn(t)
+		reminder := Reminder{
+			Subscription: RiderSubscription{Rider: "ana", LeadMinutes: 10, Channel: channelEmail, Address: "ana@example.com"},
+			StopName:     "Central\r\nBcc: eve@example.com",
+			Train:        Schedule{StopID: 1, Route: "C", TrainID: "865a", Time: "Jul 04 2021 07:42"},
+		}
+		require.Nil(t, emailNotifier{addr: addr, from: "reminders@localhost"}.notify(reminder))
+
+		t.Run("it will keep the subject on one line", func(t *testing.T) {
+			message := <-messages
+			assert.Contains(t, message, "Subject: Train 865a ( C ) arrives at Central  Bcc: eve@example.com at 07:42, in 10 min\r\n")
+			assert.NotContains(t, message, "\r\nBcc:")
+		})
+	})
+
+	t.Run("when a saved address has a display name", func(t *testing.T) {
+		addr, messages := smtpStandIn(t)
+		reminder := Reminder{
+			Subscription: RiderSubscription{Rider: "ana", LeadMinutes: 10, Channel: channelEmail, Address: "Ana <ana@example.com>"},
+			Train:        Schedule{StopID: 1, Route: "C", TrainID: "865a", Time: "Jul 04 2021 07:42"},
+		}
+		require.Nil(t, emailNotifier{addr: addr, from: "reminders@localhost"}.notify(reminder))
+
+		t.Run("it will send to the bare address", func(t *testing.T) {
+			message := <-messages
+			assert.True(t, strings.HasPrefix(message, "RCPT TO:<ana@example.com>\r\n"), message)
+			assert.Contains(t, message, "\r\nTo: ana@example.com\r\n")
+		})
+	})
+
+	t.Run("when the SMTP server does not answer", func(t *testing.T) {
+		timeout := mailTimeout
+		mailTimeout = 50 * time.Millisecond
+		defer func() { mailTimeout = timeout }()
+
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		require.Nil(t, err)
+		defer listener.Close()
+		go func() {
+			conn, err := listener.Accept()
+			if err == nil {
+				defer conn.Close()
+				time.Sleep(time.Second)
+			}
+		}()
+
+		t.Run("it will give up", func(t *testing.T) {
+			started := time.Now()
+			err := emailNotifier{addr: listener.Addr().String(), from: "reminders@localhost"}.notify(Reminder{Subscription: RiderSubscription{Address: "ana@example.com"}, Train: Schedule{Time: "Jul 04 2021 07:42"}})
+			require.Error(t, err)
+			assert.True(t, time.Since(started) < time.Second)
+		})
+	})
+}
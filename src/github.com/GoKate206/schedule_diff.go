@@ -0,0 +1,227 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	changeAdded   = "added"
+	changeRemoved = "removed"
+	changeRetimed = "retimed"
+)
+
+// ScheduleChange is a single train arrival that differs between
+// the stored schedules and a candidate upload
+type ScheduleChange struct {
+	Kind    string `json:"kind"`
+	StopID  int64  `json:"stopID"`
+	Route   string `json:"route"`
+	TrainID string `json:"trainID"`
+	OldTime string `json:"oldTime,omitempty"`
+	NewTime string `json:"newTime,omitempty"`
+}
+
+// ScheduleDiff lists changes ordered by stop, route, train then time
+type ScheduleDiff struct {
+	Added   int              `json:"added"`
+	Removed int              `json:"removed"`
+	Retimed int              `json:"retimed"`
+	Changes []ScheduleChange `json:"changes"`
+	// Committed is false for dry runs
+	Committed bool `json:"committed"`
+	// Lint is the upload's lint report, a blocked upload is not committed
+	Lint LintReport `json:"lint"`
+}
+
+func (d ScheduleDiff) String() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "%d added, %d removed, %d retimed\n", d.Added, d.Removed, d.Retimed)
+	for _, c := range d.Changes {
+		fmt.Fprintf(&b, "stop %d route %s train %s: %s", c.StopID, c.Route, c.TrainID, c.Kind)
+		switch c.Kind {
+		case changeAdded:
+			fmt.Fprintf(&b, " %s", c.NewTime)
+		case changeRemoved:
+			fmt.Fprintf(&b, " %s", c.OldTime)
+		case changeRetimed:
+			fmt.Fprintf(&b, " %s -> %s", c.OldTime, c.NewTime)
+		}
+		b.WriteString("\n")
+	}
+
+	return b.String()
+}
+
+type trainRun struct {
+	stopID     int64
+	route      string
+	trainID    string
+	serviceDay string
+}
+
+// groupTrainTimes buckets arrival times by the train run they belong to,
+// a train can stop at the same stop several times a day
+func groupTrainTimes(schedules []Schedule) (map[trainRun][]time.Time, error) {
+	runs := map[trainRun][]time.Time{}
+	for _, schedule := range schedules {
+		serviceDay, trainTime, err := scheduleServiceDay(schedule)
+		if err != nil {
+			return runs, err
+		}
+
+		run := trainRun{schedule.StopID, schedule.Route, schedule.TrainID, serviceDay}
+		runs[run] = append(runs[run], trainTime)
+	}
+
+	for _, times := range runs {
+		sort.Slice(times, func(i, j int) bool { return times[i].Before(times[j]) })
+	}
+
+	return runs, nil
+}
+
+// diffSchedules compares stored schedules to a candidate upload.
+// Times on both sides are unchanged, the leftovers of a train run are
+// paired in order as retimed and any remainder is added or removed
+func diffSchedules(stored, candidate []Schedule) (ScheduleDiff, error) {
+	diff := ScheduleDiff{Changes: []ScheduleChange{}}
+
+	before, err := groupTrainTimes(stored)
+	if err != nil {
+		return diff, err
+	}
+
+	after, err := groupTrainTimes(candidate)
+	if err != nil {
+		return diff, err
+	}
+
+	runs := map[trainRun]bool{}
+	for run := range before {
+		runs[run] = true
+	}
+	for run := range after {
+		runs[run] = true
+	}
+
+	for run := range runs {
+		removed, added := subtractTimes(before[run], after[run]), subtractTimes(after[run], before[run])
+
+		for i := 0; i < len(removed) || i < len(added); i++ {
+			change := ScheduleChange{StopID: run.stopID, Route: run.route, TrainID: run.trainID}
+			switch {
+			case i < len(removed) && i < len(added):
+				change.Kind = changeRetimed
+				change.OldTime = removed[i].Format(layout)
+				change.NewTime = added[i].Format(layout)
+				diff.Retimed++
+			case i < len(removed):
+				change.Kind = changeRemoved
+				change.OldTime = removed[i].Format(layout)
+				diff.Removed++
+			default:
+				change.Kind = changeAdded
+				change.NewTime = added[i].Format(layout)
+				diff.Added++
+			}
+			diff.Changes = append(diff.Changes, change)
+		}
+	}
+
+	sort.Slice(diff.Changes, func(i, j int) bool {
+		a, b := diff.Changes[i], diff.Changes[j]
+		if a.StopID != b.StopID {
+			return a.StopID < b.StopID
+		}
+		if a.Route != b.Route {
+			return a.Route < b.Route
+		}
+		if a.TrainID != b.TrainID {
+			return a.TrainID < b.TrainID
+		}
+
+		return changeTime(a).Before(changeTime(b))
+	})
+
+	return diff, nil
+}
+
+func changeTime(c ScheduleChange) time.Time {
+	value := c.OldTime
+	if value == "" {
+		value = c.NewTime
+	}
+	t, _ := time.Parse(layout, value)
+
+	return t
+}
+
+// subtractTimes returns the sorted times in a that are not matched in b
+func subtractTimes(a, b []time.Time) []time.Time {
+	left := []time.Time{}
+	j := 0
+	for _, t := range a {
+		for j < len(b) && b[j].Before(t) {
+			j++
+		}
+		if j < len(b) && b[j].Equal(t) {
+			j++
+			continue
+		}
+		left = append(left, t)
+	}
+
+	return left
+}
+
+// replaceSchedules diffs a re-uploaded timetable against the stored schedules,
+// unless dryRun is set the stored schedules are replaced by the upload.
+// The upload is linted first, a dry run reports a blocking lint report
+// while a replacement is refused by it
+func (s *Store) replaceSchedules(givenCsv string, rules TrainIDRules, dryRun bool, cfg LintConfig) (ScheduleDiff, error) {
+	candidate, report, blocked := s.lintCsv(givenCsv, rules, cfg)
+	if blocked != nil && !report.Blocked {
+		return ScheduleDiff{}, blocked
+	}
+
+	if err := s.lock(); err != nil {
+		return ScheduleDiff{}, err
+	}
+	defer s.mu.Unlock()
+
+	stored, err := s.readSchedulesLocked(scheduleDbName)
+	if err != nil {
+		return ScheduleDiff{}, err
+	}
+
+	diff, err := diffSchedules(stored, candidate)
+	diff.Lint = report
+	if err != nil || dryRun {
+		return diff, err
+	}
+	if blocked != nil {
+		return diff, blocked
+	}
+
+	if len(stored) > 0 {
+		if err := s.driver.Delete(scheduleDbName, ""); err != nil {
+			return diff, err
+		}
+		s.invalidateLocked(scheduleDbName)
+	}
+
+	if err := s.insertSchedulesLocked(candidate); err != nil {
+		return diff, err
+	}
+	diff.Committed = true
+
+	// stops only in the old upload changed too
+	change := changeOf(changeReplaced, append(stored, candidate...))
+	change.Count = len(candidate)
+	s.publishLocked(change)
+
+	return diff, nil
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDiffSchedules(t *testing.T) {
+	stored, err := readCsv(`stopID,route,trainID,time
+1,"C","865a","Jul 04 2021 07:14"
+1,"C","865a","Jul 04 2021 07:42"
+1,"C","865a","Jul 04 2021 08:10"
+1,"55","465a","Jul 04 2021 07:42"
+2,"55","465a","Jul 04 2021 07:50"`, defaultTrainIDRules())
+	require.Nil(t, err)
+
+	t.Run("when the candidate matches the stored schedules", func(t *testing.T) {
+		diff, err := diffSchedules(stored, stored)
+		require.Nil(t, err)
+
+		t.Run("there will be no changes", func(t *testing.T) {
+			assert.Len(t, diff.Changes, 0)
+		})
+	})
+
+	t.Run("when the candidate adds, removes and retimes trains", func(t *testing.T) {
+		candidate, err := readCsv(`stopID,route,trainID,time
+1,"C","865a","Jul 04 2021 07:14"
+1,"C","865a","Jul 04 2021 07:45"
+1,"C","865a","Jul 04 2021 08:10"
+1,"C","kpr5","Jul 04 2021 10:14"
+2,"55","465a","Jul 04 2021 07:50"`, defaultTrainIDRules())
+		require.Nil(t, err)
+
+		diff, err := diffSchedules(stored, candidate)
+		require.Nil(t, err)
+
+		t.Run("it will count each kind of change", func(t *testing.T) {
+			assert.EqualValues(t, 1, diff.Added)
+			assert.EqualValues(t, 1, diff.Removed)
+			assert.EqualValues(t, 1, diff.Retimed)
+		})
+
+		t.Run("it will list changes by stop and route", func(t *testing.T) {
+			require.Len(t, diff.Changes, 3)
+			assert.EqualValues(t, ScheduleChange{
+				Kind: changeRemoved, StopID: 1, Route: "55", TrainID: "465a", OldTime: "Jul 04 2021 07:42",
+			}, diff.Changes[0])
+			assert.EqualValues(t, ScheduleChange{
+				Kind: changeRetimed, StopID: 1, Route: "C", TrainID: "865a",
+				OldTime: "Jul 04 2021 07:42", NewTime: "Jul 04 2021 07:45",
+			}, diff.Changes[1])
+			assert.EqualValues(t, ScheduleChange{
+				Kind: changeAdded, StopID: 1, Route: "C", TrainID: "kpr5", NewTime: "Jul 04 2021 10:14",
+			}, diff.Changes[2])
+		})
+	})
+}
+
+func TestReplaceSchedules(t *testing.T) {
+	store := initTestStore(t)
+	defer tearDownStore(store)
+
+	store.csvHandler(`stopID,route,trainID,time
+1,"C","865a","Jul 04 2021 07:14"
+1,"55","465a","Jul 04 2021 07:42"
+1,"55","465a","Jul 04 2021 08:42"`)
+
+	reupload := `stopID,route,trainID,time
+1,"C","865a","Jul 04 2021 07:20"
+1,"55","465a","Jul 04 2021 07:42"`
+
+	t.Run("when invoked as a dry run", func(t *testing.T) {
+		diff, err := store.replaceSchedules(reupload, store.trainIDRules, true, defaultLintConfig())
+		require.Nil(t, err)
+
+		t.Run("it will report the changes without committing them", func(t *testing.T) {
+			assert.False(t, diff.Committed)
+			assert.EqualValues(t, 1, diff.Retimed)
+			assert.EqualValues(t, 1, diff.Removed)
+
+			stored, err := store.getAllSchedules()
+			require.Nil(t, err)
+			assert.Len(t, stored, 3)
+		})
+	})
+
+	t.Run("when the import is committed", func(t *testing.T) {
+		diff, err := store.replaceSchedules(reupload, store.trainIDRules, false, defaultLintConfig())
+		require.Nil(t, err)
+		assert.True(t, diff.Committed)
+
+		t.Run("the stored schedules will match the upload", func(t *testing.T) {
+			stored, err := store.getAllSchedules()
+			require.Nil(t, err)
+
+			again, err := diffSchedules(stored, mustReadCsv(t, reupload))
+			require.Nil(t, err)
+			assert.Len(t, stored, 2)
+			assert.Len(t, again.Changes, 0)
+		})
+	})
+}
+
+func mustReadCsv(t *testing.T, givenCsv string) []Schedule {
+	schedules, err := readCsv(givenCsv, defaultTrainIDRules())
+	require.Nil(t, err)
+	return schedules
+}
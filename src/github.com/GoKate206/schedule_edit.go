@@ -0,0 +1,227 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+)
+
+// Edits apply to uploaded schedules, timetable versions are kept as imported
+
+// ScheduleFilter selects schedules to delete, empty fields match everything.
+// From and To are service days in dateLayout and are inclusive
+type ScheduleFilter struct {
+	StopID  *int64 `json:"stopID,omitempty"`
+	Route   string `json:"route,omitempty"`
+	TrainID string `json:"trainID,omitempty"`
+	From    string `json:"from,omitempty"`
+	To      string `json:"to,omitempty"`
+}
+
+// ScheduleUpdate retimes or reassigns a schedule, nil fields are left as is
+type ScheduleUpdate struct {
+	StopID  *int64  `json:"stopID,omitempty"`
+	Route   *string `json:"route,omitempty"`
+	TrainID *string `json:"trainID,omitempty"`
+	Time    *string `json:"time,omitempty"`
+	// Wheelchair is yes, no or empty for unknown
+	Wheelchair *string `json:"wheelchair,omitempty"`
+	Platform   *string `json:"platform,omitempty"`
+	Track      *string `json:"track,omitempty"`
+	Direction  *string `json:"direction,omitempty"`
+	Headsign   *string `json:"headsign,omitempty"`
+}
+
+func (f ScheduleFilter) isEmpty() bool {
+	return f.StopID == nil && f.Route == "" && f.TrainID == "" && f.From == "" && f.To == ""
+}
+
+// matcher parses the date range once and returns a func matching schedules
+func (f ScheduleFilter) matcher() (func(Schedule) (bool, error), error) {
+	var from, to time.Time
+	var err error
+	if f.From != "" {
+		if from, err = time.Parse(dateLayout, f.From); err != nil {
+			return nil, err
+		}
+	}
+	if f.To != "" {
+		if to, err = time.Parse(dateLayout, f.To); err != nil {
+			return nil, err
+		}
+	}
+
+	return func(schedule Schedule) (bool, error) {
+		if f.StopID != nil && schedule.StopID != *f.StopID {
+			return false, nil
+		}
+		if f.Route != "" && schedule.Route != f.Route {
+			return false, nil
+		}
+		if f.TrainID != "" && schedule.TrainID != f.TrainID {
+			return false, nil
+		}
+
+		serviceDay, _, err := scheduleServiceDay(schedule)
+		if err != nil {
+			return false, err
+		}
+		day, _ := time.Parse(dateLayout, serviceDay)
+
+		return !(f.From != "" && day.Before(from)) && !(f.To != "" && day.After(to)), nil
+	}, nil
+}
+
+func (s *Store) getScheduleLocked(id string) (Schedule, error) {
+	schedule := Schedule{}
+	if err := s.driver.Read(scheduleDbName, id, &schedule); err != nil {
+		return schedule, fmt.Errorf("Schedule not found: %s", id)
+	}
+
+	return schedule, nil
+}
+
+func (s *Store) deleteSchedule(id string) error {
+	if err := s.lock(); err != nil {
+		return err
+	}
+	defer s.mu.Unlock()
+
+	schedule, err := s.getScheduleLocked(id)
+	if err != nil {
+		return err
+	}
+	s.invalidateLocked(scheduleDbName)
+
+	if err := s.driver.Delete(scheduleDbName, id); err != nil {
+		return err
+	}
+	s.publishLocked(changeOf(changeDeleted, []Schedule{schedule}))
+
+	return nil
+}
+
+// deleteSchedules removes every schedule matching the filter and returns
+// how many were deleted. An empty filter is refused, use Destroy to wipe the store
+func (s *Store) deleteSchedules(filter ScheduleFilter) (int, error) {
+	if filter.isEmpty() {
+		return 0, fmt.Errorf("Delete needs a stop, route, train or date range")
+	}
+
+	matches, err := filter.matcher()
+	if err != nil {
+		return 0, err
+	}
+
+	if err := s.lock(); err != nil {
+		return 0, err
+	}
+	defer s.mu.Unlock()
+
+	schedules, err := s.readSchedulesLocked(scheduleDbName)
+	if err != nil {
+		return 0, err
+	}
+
+	deleted := []Schedule{}
+	defer func() {
+		if len(deleted) > 0 {
+			s.invalidateLocked(scheduleDbName)
+			s.publishLocked(changeOf(changeDeleted, deleted))
+		}
+	}()
+
+	for _, schedule := range schedules {
+		match, err := matches(schedule)
+		if err != nil {
+			return len(deleted), err
+		}
+
+		if match {
+			if err := s.driver.Delete(scheduleDbName, schedule.ID); err != nil {
+				return len(deleted), err
+			}
+			deleted = append(deleted, schedule)
+		}
+	}
+
+	return len(deleted), nil
+}
+
+// updateSchedule applies the update then validates the row as an import would
+func (s *Store) updateSchedule(id string, update ScheduleUpdate) (Schedule, error) {
+	if err := s.lock(); err != nil {
+		return Schedule{}, err
+	}
+	defer s.mu.Unlock()
+
+	existing, err := s.getScheduleLocked(id)
+	if err != nil {
+		return existing, err
+	}
+
+	record := []string{strconv.FormatInt(existing.StopID, 10), existing.Route, existing.TrainID}
+	if update.StopID != nil {
+		record[0] = strconv.FormatInt(*update.StopID, 10)
+	}
+	if update.Route != nil {
+		record[1] = *update.Route
+	}
+	if update.TrainID != nil {
+		record[2] = *update.TrainID
+	}
+
+	// the time is only checked when it changes,
+	// so trains that have already run can still be corrected
+	parsed, err := parseScheduleFields(record, s.trainIDRules)
+	if update.Time != nil && err == nil {
+		parsed.Time, parsed.ServiceDay, err = validateAndParseTime(*update.Time)
+	}
+	if err != nil {
+		return existing, err
+	}
+
+	// optional columns are kept unless updated
+	schedule := existing
+	schedule.StopID, schedule.Route, schedule.TrainID = parsed.StopID, parsed.Route, parsed.TrainID
+	// an untouched time keeps the service day it was imported with
+	if update.Time != nil {
+		schedule.Time, schedule.ServiceDay = parsed.Time, parsed.ServiceDay
+	}
+	if update.Wheelchair != nil {
+		if schedule.Wheelchair, err = parseAccessible(*update.Wheelchair); err != nil {
+			return existing, err
+		}
+	}
+	if update.Platform != nil {
+		if schedule.Platform, err = parsePlatform(*update.Platform); err != nil {
+			return existing, err
+		}
+	}
+	if update.Track != nil {
+		if schedule.Track, err = parsePlatform(*update.Track); err != nil {
+			return existing, err
+		}
+	}
+	if update.Direction != nil {
+		if schedule.Direction, err = parseDirection(*update.Direction); err != nil {
+			return existing, err
+		}
+	}
+	if update.Headsign != nil {
+		if schedule.Headsign, err = parseHeadsign(*update.Headsign); err != nil {
+			return existing, err
+		}
+	}
+	s.invalidateLocked(scheduleDbName)
+
+	if err := s.driver.Write(scheduleDbName, schedule.ID, &schedule); err != nil {
+		return schedule, err
+	}
+	// the old stop and route changed too when the train was moved
+	change := changeOf(changeUpdated, []Schedule{existing, schedule})
+	change.Count = 1
+	s.publishLocked(change)
+
+	return schedule, nil
+}
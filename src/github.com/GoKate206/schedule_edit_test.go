@@ -0,0 +1,149 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// scheduleIDOf returns the ID of the first stored schedule of a train
+func scheduleIDOf(t *testing.T, store *Store, trainID string) string {
+	schedules, err := store.getAllSchedules()
+	require.Nil(t, err)
+	for _, schedule := range schedules {
+		if schedule.TrainID == trainID {
+			return schedule.ID
+		}
+	}
+
+	t.Fatalf("No schedule of train %s", trainID)
+	return ""
+}
+
+func TestDeleteSchedules(t *testing.T) {
+	csv := `stopID,route,trainID,time
+1,"C","865a","Jul 04 2021 07:14"
+1,"C","865a","Jul 05 2021 07:14"
+2,"C","865a","Jul 05 2021 07:20"
+1,"55","465a","Jul 04 2021 07:42"
+2,"55","465a","Jul 06 2021 07:50"`
+	stopTwo := int64(2)
+
+	cases := []struct {
+		name    string
+		filter  ScheduleFilter
+		deleted int
+	}{
+		{"a train", ScheduleFilter{TrainID: "865a"}, 3},
+		{"a route", ScheduleFilter{Route: "55"}, 2},
+		{"a stop", ScheduleFilter{StopID: &stopTwo}, 2},
+		{"a date range", ScheduleFilter{From: "Jul 05 2021", To: "Jul 06 2021"}, 3},
+		{"a route at a stop", ScheduleFilter{Route: "C", StopID: &stopTwo}, 1},
+	}
+
+	for _, c := range cases {
+		t.Run("when deleting "+c.name, func(t *testing.T) {
+			store := initTestStore(t)
+			defer tearDownStore(store)
+			require.Nil(t, store.csvHandler(csv))
+
+			deleted, err := store.deleteSchedules(c.filter)
+			require.Nil(t, err)
+
+			t.Run("only matching schedules will be removed", func(t *testing.T) {
+				assert.EqualValues(t, c.deleted, deleted)
+
+				left, err := store.getAllSchedules()
+				require.Nil(t, err)
+				assert.Len(t, left, 5-c.deleted)
+			})
+		})
+	}
+
+	t.Run("when deleting with an empty filter", func(t *testing.T) {
+		store := initTestStore(t)
+		defer tearDownStore(store)
+
+		_, err := store.deleteSchedules(ScheduleFilter{})
+		assert.EqualValues(t, "Delete needs a stop, route, train or date range", err.Error())
+	})
+
+	t.Run("when deleting a single schedule", func(t *testing.T) {
+		store := initTestStore(t)
+		defer tearDownStore(store)
+		require.Nil(t, store.csvHandler(csv))
+		id := scheduleIDOf(t, store, "865a")
+
+		require.Nil(t, store.deleteSchedule(id))
+		left, err := store.getAllSchedules()
+		require.Nil(t, err)
+		assert.Len(t, left, 4)
+
+		t.Run("it can not be deleted twice", func(t *testing.T) {
+			err := store.deleteSchedule(id)
+			assert.EqualValues(t, "Schedule not found: "+id, err.Error())
+		})
+	})
+}
+
+func TestUpdateSchedule(t *testing.T) {
+	store := initTestStore(t)
+	defer tearDownStore(store)
+	require.Nil(t, store.csvHandler(`stopID,route,trainID,time
+1,"C","865a","Jul 04 2021 07:14"
+1,"55","465a","Jul 04 2021 07:42"`))
+	first, second := scheduleIDOf(t, store, "865a"), scheduleIDOf(t, store, "465a")
+
+	t.Run("when a schedule is retimed", func(t *testing.T) {
+		retimed := "Jul 04 2021 07:42"
+		schedule, err := store.updateSchedule(first, ScheduleUpdate{Time: &retimed})
+		require.Nil(t, err)
+
+		t.Run("it will keep its ID and be seen by stop queries", func(t *testing.T) {
+			assert.EqualValues(t, first, schedule.ID)
+
+			trains, err := store.getTrainsByStopAndTime(1, retimed)
+			require.Nil(t, err)
+			assert.Len(t, trains, 2)
+		})
+	})
+
+	t.Run("when a schedule is reassigned", func(t *testing.T) {
+		route, stopID := "21x", int64(3)
+		schedule, err := store.updateSchedule(second, ScheduleUpdate{Route: &route, StopID: &stopID})
+		require.Nil(t, err)
+		assert.EqualValues(t, "21x", schedule.Route)
+		assert.EqualValues(t, 3, schedule.StopID)
+		assert.EqualValues(t, "Jul 04 2021 07:42", schedule.Time)
+	})
+
+	t.Run("when an update would not pass import validation", func(t *testing.T) {
+		trainID, past := "a_b@", "Jun 01 2021 07:42"
+		_, err := store.updateSchedule(first, ScheduleUpdate{TrainID: &trainID})
+		assert.EqualValues(t, "Train Id must be alphanumeric: a_b@", err.Error())
+
+		_, err = store.updateSchedule(first, ScheduleUpdate{Time: &past})
+		assert.EqualValues(t, "Scheduled time must be in the future", err.Error())
+	})
+
+	t.Run("when a train that has run is corrected", func(t *testing.T) {
+		defer func(now func() time.Time) { timeNow = now }(timeNow)
+		timeNow = func() time.Time { return time.Date(2021, time.July, 5, 0, 0, 0, 0, time.UTC) }
+
+		platform := "4"
+		schedule, err := store.updateSchedule(second, ScheduleUpdate{Platform: &platform})
+		require.Nil(t, err)
+
+		t.Run("it will keep its time without checking it", func(t *testing.T) {
+			assert.EqualValues(t, "4", schedule.Platform)
+			assert.EqualValues(t, "Jul 04 2021 07:42", schedule.Time)
+		})
+	})
+
+	t.Run("when an unknown schedule is updated", func(t *testing.T) {
+		_, err := store.updateSchedule("9_zzzz", ScheduleUpdate{})
+		assert.EqualValues(t, "Schedule not found: 9_zzzz", err.Error())
+	})
+}
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"sort"
+	"time"
+)
+
+// dayIndex holds every train of one service day sorted by arrival then stop,
+// stops points into schedules so a stop's trains can be binary searched
+type dayIndex struct {
+	schedules []Schedule
+	times     []time.Time
+	stops     map[int64][]int
+}
+
+// scheduleIndex is a collection's schedules keyed by service day,
+// days are bucketed with the rollover hour at the time it was built
+type scheduleIndex struct {
+	days         map[string]*dayIndex
+	rolloverHour int
+}
+
+func buildScheduleIndex(schedules []Schedule) (*scheduleIndex, error) {
+	idx := &scheduleIndex{days: map[string]*dayIndex{}, rolloverHour: serviceDayRolloverHour}
+	for _, schedule := range schedules {
+		serviceDay, trainTime, err := scheduleServiceDay(schedule)
+		if err != nil {
+			return nil, err
+		}
+
+		day, ok := idx.days[serviceDay]
+		if !ok {
+			day = &dayIndex{}
+			idx.days[serviceDay] = day
+		}
+		day.schedules = append(day.schedules, schedule)
+		day.times = append(day.times, trainTime)
+	}
+
+	for _, day := range idx.days {
+		day.reindex()
+	}
+
+	return idx, nil
+}
+
+// reindex sorts the day and rebuilds the positions of each stop's trains
+func (d *dayIndex) reindex() {
+	sort.Sort(d)
+	d.stops = map[int64][]int{}
+	for i, schedule := range d.schedules {
+		d.stops[schedule.StopID] = append(d.stops[schedule.StopID], i)
+	}
+}
+
+func (d *dayIndex) Len() int { return len(d.schedules) }
+
+func (d *dayIndex) Swap(i, j int) {
+	d.schedules[i], d.schedules[j] = d.schedules[j], d.schedules[i]
+	d.times[i], d.times[j] = d.times[j], d.times[i]
+}
+
+// compare parsed times, a service day can cross into the next month
+func (d *dayIndex) Less(i, j int) bool {
+	if !d.times[i].Equal(d.times[j]) {
+		return d.times[i].Before(d.times[j])
+	}
+
+	return d.schedules[i].StopID < d.schedules[j].StopID
+}
+
+// all returns a copy of the day's trains, a nil day has none
+func (d *dayIndex) all() []Schedule {
+	if d == nil {
+		return []Schedule{}
+	}
+
+	return append([]Schedule{}, d.schedules...)
+}
+
+// lastTrain is the arrival of the last train of the day at any stop
+func (d *dayIndex) lastTrain() (time.Time, bool) {
+	if d == nil || len(d.times) == 0 {
+		return time.Time{}, false
+	}
+
+	return d.times[len(d.times)-1], true
+}
+
+// stopFrom returns the positions of a stop's trains arriving at or after t
+func (d *dayIndex) stopFrom(stopID int64, t time.Time) []int {
+	if d == nil {
+		return nil
+	}
+
+	positions := d.stops[stopID]
+	i := sort.Search(len(positions), func(i int) bool {
+		return !d.times[positions[i]].Before(t)
+	})
+
+	return positions[i:]
+}
+
+// stopAt returns the trains arriving at a stop at exactly t
+func (d *dayIndex) stopAt(stopID int64, t time.Time) []Schedule {
+	trains := []Schedule{}
+	for _, i := range d.stopFrom(stopID, t) {
+		if !d.times[i].Equal(t) {
+			break
+		}
+		trains = append(trains, d.schedules[i])
+	}
+
+	return trains
+}
+
+// sharedArrivals returns the trains arriving at a stop at the same time
+// as at least one other running train, cancelled trains are kept alongside
+func (d *dayIndex) sharedArrivals(stopID int64) []Schedule {
+	return d.sharedArrivalsOf(stopID, nil)
+}
+
+// sharedArrivalsOf is sharedArrivals counting only the trains keep
+// leaves in each group, all of them when keep is nil
+func (d *dayIndex) sharedArrivalsOf(stopID int64, keep func([]Schedule) []Schedule) []Schedule {
+	trains := []Schedule{}
+	if d == nil {
+		return trains
+	}
+
+	positions := d.stops[stopID]
+	for start := 0; start < len(positions); {
+		end := start + 1
+		for end < len(positions) && d.times[positions[end]].Equal(d.times[positions[start]]) {
+			end++
+		}
+
+		group := []Schedule{}
+		for _, i := range positions[start:end] {
+			group = append(group, d.schedules[i])
+		}
+		if keep != nil {
+			group = keep(group)
+		}
+		if runningTrains(group) > 1 {
+			trains = append(trains, group...)
+		}
+		start = end
+	}
+
+	return trains
+}
+
+// indexLocked returns the index of a collection, building it from disk
+// the first time. Readers share the read lock so building is guarded by cacheMu
+func (s *Store) indexLocked(collection string) (*scheduleIndex, error) {
+	s.cacheMu.Lock()
+	defer s.cacheMu.Unlock()
+
+	if idx, ok := s.indexes[collection]; ok && idx.rolloverHour == serviceDayRolloverHour {
+		return idx, nil
+	}
+
+	schedules, err := s.readSchedulesLocked(collection)
+	if err != nil {
+		return nil, err
+	}
+
+	idx, err := buildScheduleIndex(schedules)
+	if err != nil {
+		return nil, err
+	}
+	s.indexes[collection] = idx
+
+	return idx, nil
+}
+
+// baseDayLocked returns the index of a service day,
+// read from the timetable version in effect that day
+func (s *Store) baseDayLocked(day string) (*dayIndex, error) {
+	collection, err := s.scheduleCollectionForLocked(day)
+	if err != nil {
+		return nil, err
+	}
+
+	idx, err := s.indexLocked(collection)
+	if err != nil {
+		return nil, err
+	}
+
+	return idx.days[day], nil
+}
+
+// invalidateLocked drops what is cached of a collection,
+// writers call it while holding the write lock
+func (s *Store) invalidateLocked(collection string) {
+	s.cacheMu.Lock()
+	defer s.cacheMu.Unlock()
+
+	switch collection {
+	case versionDbName:
+		s.versions = nil
+	case alertDbName:
+		s.alerts = nil
+	case cancellationDbName:
+		s.cancellations = nil
+	case frequencyDbName:
+		s.frequencies = nil
+	case stopDbName:
+		s.stops = nil
+		s.stopTree = nil
+	case platformChangeDbName:
+		s.platformChanges = nil
+	}
+	// any write can change a day's actual service
+	s.serviceDays = map[string]*dayIndex{}
+	delete(s.indexes, collection)
+}
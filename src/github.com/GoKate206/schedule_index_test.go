@@ -0,0 +1,128 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestScheduleIndex(t *testing.T) {
+	schedules := mustReadCsv(t, `stopID,route,trainID,time
+2,"C","865a","Jul 31 2021 08:00"
+1,"C","865a","Jul 31 2021 07:42"
+1,"55","465a","Jul 31 2021 07:42"
+1,"C","kpr5","Jul 31 2021 09:00"
+1,"55","465a","Jul 31 2021 25:30"`)
+
+	idx, err := buildScheduleIndex(schedules)
+	require.Nil(t, err)
+	day := idx.days["Jul 31 2021"]
+	require.NotNil(t, day)
+	at := func(value string) time.Time {
+		t, _ := time.Parse(layout, value)
+		return t
+	}
+
+	t.Run("it will order a service day by arrival across months", func(t *testing.T) {
+		last, ok := day.lastTrain()
+		assert.True(t, ok)
+		assert.EqualValues(t, "Aug 01 2021 01:30", last.Format(layout))
+	})
+
+	t.Run("it will find a stop's trains at an exact minute", func(t *testing.T) {
+		assert.Len(t, day.stopAt(1, at("Jul 31 2021 07:42")), 2)
+		assert.Len(t, day.stopAt(1, at("Jul 31 2021 07:43")), 0)
+	})
+
+	t.Run("it will find a stop's trains from a time on", func(t *testing.T) {
+		positions := day.stopFrom(1, at("Jul 31 2021 07:43"))
+		require.Len(t, positions, 2)
+		assert.EqualValues(t, "kpr5", day.schedules[positions[0]].TrainID)
+	})
+
+	t.Run("it will find trains sharing an arrival at a stop", func(t *testing.T) {
+		assert.Len(t, day.sharedArrivals(1), 2)
+		assert.Len(t, day.sharedArrivals(2), 0)
+	})
+
+	t.Run("a missing day will have no trains", func(t *testing.T) {
+		missing := idx.days["Aug 02 2021"]
+		assert.Len(t, missing.all(), 0)
+		assert.Len(t, missing.stopAt(1, at("Aug 02 2021 07:42")), 0)
+	})
+}
+
+func TestStoreIndexInvalidation(t *testing.T) {
+	store := initTestStore(t)
+	defer tearDownStore(store)
+	jul04, _ := time.Parse(layout, "Jul 04 2021 12:00")
+
+	require.Nil(t, store.csvHandler(trainsAt(1, "Jul 04 2021 07:42")))
+	trains, err := store.getTrainsByStopAndTime(1, "Jul 04 2021 07:42")
+	require.Nil(t, err)
+	assert.Len(t, trains, 0)
+
+	t.Run("when more trains are imported", func(t *testing.T) {
+		require.Nil(t, store.insertSchedules([]Schedule{{StopID: 1, Route: "55", TrainID: "465a", Time: "Jul 04 2021 07:42"}}))
+
+		t.Run("queries will see them", func(t *testing.T) {
+			trains, err := store.getTrainsByStopAndTime(1, "Jul 04 2021 07:42")
+			require.Nil(t, err)
+			assert.Len(t, trains, 2)
+		})
+	})
+
+	t.Run("when the store is reopened", func(t *testing.T) {
+		reopened, err := openStore(store.dir)
+		require.Nil(t, err)
+		defer reopened.Close()
+
+		t.Run("it will be indexed on load", func(t *testing.T) {
+			assert.Contains(t, reopened.indexes, scheduleDbName)
+
+			schedules, err := reopened.getScheduleByDate(jul04)
+			require.Nil(t, err)
+			assert.Len(t, schedules, 2)
+		})
+	})
+}
+
+func TestServiceDayCache(t *testing.T) {
+	store := initTestStore(t)
+	defer tearDownStore(store)
+	require.Nil(t, store.csvHandler(`stopID,route,trainID,time
+1,"C","865a","Jul 04 2021 07:42"
+1,"C","866a","Sep 04 2021 07:42"`))
+	at := func(value string) time.Time {
+		t, _ := time.Parse(layout, value)
+		return t
+	}
+
+	t.Run("when days near, far and without service are queried", func(t *testing.T) {
+		for _, date := range []string{"Jul 04 2021 12:00", "Sep 04 2021 12:00", "Jul 06 2021 12:00"} {
+			_, err := store.getScheduleByDate(at(date))
+			require.Nil(t, err)
+		}
+
+		t.Run("only the near day with service will be cached", func(t *testing.T) {
+			assert.Len(t, store.serviceDays, 1)
+			assert.Contains(t, store.serviceDays, "Jul 04 2021")
+		})
+	})
+
+	t.Run("when today moves on", func(t *testing.T) {
+		defer func(now func() time.Time) { timeNow = now }(timeNow)
+		timeNow = func() time.Time { return at("Sep 01 2021 00:00") }
+
+		schedules, err := store.getScheduleByDate(at("Sep 04 2021 12:00"))
+		require.Nil(t, err)
+
+		t.Run("days the window has left will be dropped", func(t *testing.T) {
+			assert.Len(t, schedules, 1)
+			assert.Len(t, store.serviceDays, 1)
+			assert.Contains(t, store.serviceDays, "Sep 04 2021")
+		})
+	})
+}
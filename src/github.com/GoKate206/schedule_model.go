@@ -3,8 +3,6 @@ package main
 import (
 	"encoding/csv"
 	"fmt"
-	"log"
-	"regexp/syntax"
 	"strconv"
 	"strings"
 	"time"
@@ -14,6 +12,36 @@ var (
 	layout          = "Jan 02 2006 15:04"
 	dateLayout      = "Jan 02 2006"
 	expectedHeaders = []string{"stopID", "route", "trainID", "time"}
+	// optionalColumns may follow expectedHeaders in any order,
+	// each validates its value onto the schedule
+	optionalColumns = map[string]func(schedule *Schedule, value string) error{
+		"wheelchair": func(schedule *Schedule, value string) (err error) {
+			schedule.Wheelchair, err = parseAccessible(value)
+			return err
+		},
+		"platform": func(schedule *Schedule, value string) (err error) {
+			schedule.Platform, err = parsePlatform(value)
+			return err
+		},
+		"track": func(schedule *Schedule, value string) (err error) {
+			schedule.Track, err = parsePlatform(value)
+			return err
+		},
+		"direction": func(schedule *Schedule, value string) (err error) {
+			schedule.Direction, err = parseDirection(value)
+			return err
+		},
+		"headsign": func(schedule *Schedule, value string) (err error) {
+			schedule.Headsign, err = parseHeadsign(value)
+			return err
+		},
+	}
+	// lookaheadDays is how many days past the requested day we will
+	// search for the first trains once there are no more trains today
+	lookaheadDays = 7
+	// timeNow is swapped out in tests so fixtures are not judged
+	// against the wall clock
+	timeNow = time.Now
 )
 
 type Schedule struct {
@@ -22,93 +50,106 @@ type Schedule struct {
 	TrainID string `json:"trainID"`
 	Time    string `json:"time"` // TODO: is this the right thing?
 	ID      string `json:"ID,omitempty"`
+	// ServiceDay is set when a train was scheduled past 24:00
+	ServiceDay string `json:"serviceDay,omitempty"`
+	// Status marks cancelled trains and extra services, empty for timetabled trains
+	Status string `json:"status,omitempty"`
+	// HeadwayMinutes is set for trains running every so often rather than at Time
+	HeadwayMinutes int `json:"headwayMinutes,omitempty"`
+	// Wheelchair is yes or no when the train is known to be accessible or not
+	Wheelchair string `json:"wheelchair,omitempty"`
+	Platform   string `json:"platform,omitempty"`
+	Track      string `json:"track,omitempty"`
+	// ScheduledPlatform is the timetabled platform of a train moved by a
+	// platform change, ? when none was timetabled
+	ScheduledPlatform string `json:"scheduledPlatform,omitempty"`
+	// Direction is the way the train heads, Headsign the destination it shows
+	Direction string `json:"direction,omitempty"`
+	Headsign  string `json:"headsign,omitempty"`
+}
+
+// NextTrains is the answer to a stop query, Date is the day the
+// trains run on which may be later than the requested day
+type NextTrains struct {
+	Date   string         `json:"date"`
+	Trains []Schedule     `json:"trains"`
+	Alerts []ServiceAlert `json:"alerts,omitempty"`
+	// Directions groups Trains when asked for
+	Directions []DirectionGroup `json:"directions,omitempty"`
 }
 
 //*====================*
 //    Verifications
 //*====================*
 func validateHeader(headers []string) error {
-	// if the headers are not the expected length, raise an error
-	if len(headers) != len(expectedHeaders) {
+	// if there are fewer headers than expected, raise an error
+	if len(headers) < len(expectedHeaders) {
 		return fmt.Errorf("Expected %d headers, got %d", len(expectedHeaders), len(headers))
 	}
 
 	// if headers are not expected name % order, raise an error
-	for i, header := range headers {
+	for i, header := range headers[:len(expectedHeaders)] {
 		if header != expectedHeaders[i] {
 			return fmt.Errorf("Incorrect header. Expected %s, Got: %s", expectedHeaders[i], header)
 		}
 	}
-	return nil
-}
-
-func validateTrainID(trainID string) (string, error) {
-	const trainIDLength = 4
-	if len(trainID) != trainIDLength {
-		return "", fmt.Errorf("Train Id is invalid, too few characters: %s", trainID)
-	}
 
-	for _, r := range trainID {
-		if !syntax.IsWordChar(r) {
-			return "", fmt.Errorf("Train Id must be alphanumeric: %s", trainID)
+	// anything after them must be an optional column, given once
+	seen := map[string]bool{}
+	for _, header := range headers[len(expectedHeaders):] {
+		if _, ok := optionalColumns[header]; !ok || seen[header] {
+			return fmt.Errorf("Unexpected header: %s", header)
 		}
+		seen[header] = true
 	}
-
-	return trainID, nil
+	return nil
 }
 
-func validateAndParseTime(scheduledTime string) (string, error) {
+// validateAndParseTime returns the calendar time of the train in layout,
+// and the service day when it was given past 24:00
+func validateAndParseTime(scheduledTime string) (string, string, error) {
 	// convert to time.Time for comparisons and validation
-	givenTime, err := time.Parse(layout, scheduledTime)
+	givenTime, serviceDay, err := parseScheduleTime(scheduledTime)
 	if err != nil {
-		return "", err
+		return "", "", err
 	}
 
 	// Do not schedule for trains in the past
-	timeNow := time.Now()
-	if givenTime.Before(timeNow) {
-		return "", fmt.Errorf("Scheduled time must be in the future")
+	if givenTime.Before(timeNow()) {
+		return "", "", fmt.Errorf("Scheduled time must be in the future")
 	}
 
-	return scheduledTime, nil
-}
-
-func isTrainWithinSchedule(requestedTime, scheduleTime string) (bool, error) {
-	// TODO: allow different dateTime formats
-	requested, err := time.Parse(layout, requestedTime)
-	if err != nil {
-		return false, err
+	// only keep the service day of times past 24:00,
+	// the rest follow serviceDayRolloverHour
+	if _, err := time.Parse(layout, scheduledTime); err == nil {
+		serviceDay = ""
 	}
 
-	scheduled, err := time.Parse(layout, scheduleTime)
-	if err != nil {
-		return false, err
-	}
-
-	return requested.Equal(scheduled), nil
+	return givenTime.Format(layout), serviceDay, nil
 }
 
 //*========================*
 //    CSV Read & DB Write
 //*========================*
 
-func csvHandler(schedule string) {
+func (s *Store) csvHandler(schedule string) error {
 	// get slice Schedule struct from csv
-	schedules, err := readCsv(schedule)
+	schedules, err := readCsv(schedule, s.trainIDRules)
 	if err != nil {
-		log.Panicf(fmt.Sprintf("Error reading CSV: %v", err))
-		return
+		return fmt.Errorf("Error reading CSV: %v", err)
 	}
 
 	// insert struct values into db ( Scribble here, ideally PostgreSQL)
-	err = insertSchedules(schedules)
+	err = s.insertSchedules(schedules)
 	if err != nil {
-		log.Panicf(fmt.Sprintf("Insert Schedules error: %v", err))
-		return
+		return fmt.Errorf("Insert Schedules error: %v", err)
 	}
+
+	return nil
 }
 
-func readCsv(givenCsv string) ([]Schedule, error) {
+// readCsv reads an upload, checking train IDs with the rules given
+func readCsv(givenCsv string, rules TrainIDRules) ([]Schedule, error) {
 	schedules := []Schedule{}
 	if givenCsv == "" {
 		return schedules, nil
@@ -128,32 +169,21 @@ func readCsv(givenCsv string) ([]Schedule, error) {
 	}
 
 	// First row is always headers, validate and populate slice
+	headers := records[0]
 	for _, record := range records[1:] {
-		if len(record) != len(expectedHeaders) {
-			return nil, fmt.Errorf("Incorrect number of columns. Expected: %d, Got: %d", len(record), len(expectedHeaders))
+		if len(record) != len(headers) {
+			return nil, fmt.Errorf("Incorrect number of columns. Expected: %d, Got: %d", len(headers), len(record))
 		}
 
-		stopID, err := strconv.ParseInt(record[0], 10, 64)
+		schedule, err := parseScheduleRecord(record, rules)
 		if err != nil {
 			return nil, err
 		}
 
-		trainID, err := validateTrainID(record[2])
-		if err != nil {
-			return nil, err
-		}
-
-		// use go pkg time to validate and parse to expected string
-		trainTime, err := validateAndParseTime(record[3])
-		if err != nil {
-			return nil, err
-		}
-
-		schedule := Schedule{
-			StopID:  stopID,
-			Route:   record[1], // TODO: verify with route in db
-			TrainID: trainID,
-			Time:    trainTime,
+		for i, header := range headers[len(expectedHeaders):] {
+			if err := optionalColumns[header](&schedule, record[len(expectedHeaders)+i]); err != nil {
+				return nil, err
+			}
 		}
 
 		schedules = append(schedules, schedule)
@@ -162,14 +192,68 @@ func readCsv(givenCsv string) ([]Schedule, error) {
 	return schedules, err
 }
 
-func insertSchedules(schedules []Schedule) error {
+// parseScheduleRecord validates one row in expectedHeaders order,
+// imports and edits share it so both validate the same way
+func parseScheduleRecord(record []string, rules TrainIDRules) (Schedule, error) {
+	schedule, err := parseScheduleFields(record, rules)
+	if err != nil {
+		return Schedule{}, err
+	}
+
+	// use go pkg time to validate and parse to expected string
+	schedule.Time, schedule.ServiceDay, err = validateAndParseTime(record[3])
+	if err != nil {
+		return Schedule{}, err
+	}
+
+	return schedule, nil
+}
+
+// parseScheduleFields validates the stop, route and train of a row,
+// everything but its time
+func parseScheduleFields(record []string, rules TrainIDRules) (Schedule, error) {
+	stopID, err := strconv.ParseInt(record[0], 10, 64)
+	if err != nil {
+		return Schedule{}, err
+	}
+
+	trainID, err := rules.validate(record[2])
+	if err != nil {
+		return Schedule{}, err
+	}
+
+	return Schedule{
+		StopID:  stopID,
+		Route:   record[1], // TODO: verify with route in db
+		TrainID: trainID,
+	}, nil
+}
+
+func (s *Store) insertSchedules(schedules []Schedule) error {
+	if err := s.lock(); err != nil {
+		return err
+	}
+	defer s.mu.Unlock()
+
+	if err := s.insertSchedulesLocked(schedules); err != nil {
+		return err
+	}
+	s.publishLocked(changeOf(changeImported, schedules))
+
+	return nil
+}
+
+// insertSchedulesLocked writes schedules under IDs of their own import,
+// so a later import never overwrites an earlier one
+func (s *Store) insertSchedulesLocked(schedules []Schedule) error {
+	batch := newID()
 	for i, schedule := range schedules {
-		id := fmt.Sprintf("%d_%s", i, schedule.TrainID)
-		schedule.ID = id
-		if err := db.Write(scheduleDbName, id, &schedule); err != nil {
+		schedule.ID = fmt.Sprintf("%s_%d_%s", batch, i, schedule.TrainID)
+		if err := s.driver.Write(scheduleDbName, schedule.ID, &schedule); err != nil {
 			return err
 		}
 	}
+	s.invalidateLocked(scheduleDbName)
 
 	return nil
 }
@@ -177,111 +261,127 @@ func insertSchedules(schedules []Schedule) error {
 //*========================*
 //    Get Schedule
 //*========================*
-func getTrainsByStopAndTime(stopID int64, selectedTime string) ([]Schedule, error) {
-	nextTrains := []Schedule{}
-	// Parse given date to time.Time
-	selectedDate, err := time.Parse(layout, selectedTime)
-	if err != nil {
-		return nextTrains, err
+func (s *Store) getTrainsByStopAndTime(stopID int64, selectedTime string) ([]Schedule, error) {
+	next, err := s.getNextTrains(stopID, selectedTime)
+	return next.Trains, err
+}
+
+// getNextTrains answers a stop query along with the service alerts relevant to it
+func (s *Store) getNextTrains(stopID int64, selectedTime string) (NextTrains, error) {
+	return s.getNextTrainsFor(stopID, selectedTime, StopQuery{})
+}
+
+// getNextTrainsFor answers a stop query keeping only the trains a rider
+// with the access options can use, none when the stop does not suit them,
+// and those heading the query's direction
+func (s *Store) getNextTrainsFor(stopID int64, selectedTime string, query StopQuery) (NextTrains, error) {
+	if err := s.rlock(); err != nil {
+		return NextTrains{Trains: []Schedule{}}, err
 	}
+	defer s.mu.RUnlock()
 
-	// Get all trains scheduled for all stops today
-	// If this were sql the query would be easier / faster
-	todaySchedule, err := getScheduleByDate(selectedDate)
+	stops, err := s.getStopsLocked()
 	if err != nil {
-		return nextTrains, err
+		return NextTrains{Trains: []Schedule{}}, err
+	}
+	stop, ok := stops[stopID]
+	if !ok {
+		stop = Stop{ID: stopID}
 	}
 
-	// iterate through schedule for 2+ Trains arriving within range
-	for _, scheduleData := range todaySchedule {
-		if scheduleData.StopID != stopID {
-			continue
+	// the access options and direction narrow the trains before 2+ of them
+	// are looked for so a time where only one such train arrives is not answered
+	next, err := s.getNextTrainsLocked(stopID, selectedTime, func(trains []Schedule) []Schedule {
+		trains = query.Access.filter(stop, trains)
+		if query.Direction != "" {
+			trains = inDirection(trains, query.Direction)
 		}
+		return trains
+	})
+	if err != nil {
+		return next, err
+	}
+	if query.GroupByDirection {
+		next.Directions = groupByDirection(next.Trains)
+	}
 
-		// is the train arriving within five minutes?
-		trainWithinSchedule, err := isTrainWithinSchedule(selectedTime, scheduleData.Time)
-		if err != nil {
-			return nextTrains, err
-		}
+	selectedDate, _, _ := parseScheduleTime(selectedTime)
+	next.Alerts, err = s.relevantAlertsLocked(stopID, selectedDate, next.Trains)
 
-		if trainWithinSchedule {
-			nextTrains = append(nextTrains, scheduleData)
-		}
+	return next, err
+}
 
+// getNextTrainsLocked finds the 2+ trains arriving together at the stop
+// counting only those keep leaves, all of them when keep is nil
+func (s *Store) getNextTrainsLocked(stopID int64, selectedTime string, keep func([]Schedule) []Schedule) (NextTrains, error) {
+	// Parse given date to time.Time
+	selectedDate, day, err := parseScheduleTime(selectedTime)
+	if err != nil {
+		return NextTrains{Trains: []Schedule{}}, err
 	}
 
-	var (
-		lastOfToday        = todaySchedule[len(todaySchedule)-1]
-		showTomorrowTrains = false
-		nextDaySchedule    []Schedule
-	)
-
-	// If lastOfToday has data check if requested time
-	// is after the last train of the day
-	if lastOfToday.Route != "" {
-		lastTrain, _ := time.Parse(layout, lastOfToday.Time)
-		showTomorrowTrains = selectedDate.After(lastTrain)
-
-		nextDaySchedule, err = getFirstTrainsOfDay(selectedDate.Add(time.Hour*24), stopID)
-		if err != nil {
-			return nextTrains, err
-		}
+	// Get all trains scheduled for all stops on the service day the time
+	// was given for, the stop's trains are found by binary search on the index
+	today, err := s.serviceDayLocked(day)
+	if err != nil {
+		return NextTrains{Date: day, Trains: []Schedule{}}, err
+	}
+	nextTrains := today.stopAt(stopID, selectedDate)
+	if keep != nil {
+		nextTrains = keep(nextTrains)
 	}
 
-	if showTomorrowTrains && len(nextDaySchedule) > 1 {
-		return nextDaySchedule, nil
+	// There are no more trains today if nothing runs today at all
+	// or the requested time is after the last train of the day
+	lastTrain, ok := today.lastTrain()
+	if !ok || selectedDate.After(lastTrain) {
+		next, err := s.getNextDayTrainsLocked(selectedDate, stopID, keep)
+		if err != nil || len(next.Trains) > 1 {
+			return next, err
+		}
 	}
 
-	if len(nextTrains) < 2 {
-		return []Schedule{}, nil
+	if runningTrains(nextTrains) < 2 {
+		return NextTrains{Date: day, Trains: []Schedule{}}, nil
 	}
 
-	return nextTrains, nil
+	return NextTrains{Date: day, Trains: nextTrains}, nil
 }
 
-func getFirstTrainsOfDay(date time.Time, stopID int64) ([]Schedule, error) {
-	availableTrains := []Schedule{}
-	// trains will be scheduled by time and stopIds
-	trains, err := getScheduleByDate(date)
-	if err != nil {
-		return availableTrains, err
-	}
-
-	// iterate through all trains looking for the first 2 plus trains
-	// that arrive at the same stop at the same time
-	index := 0
-	max := len(trains)
-	// avoid adding the same train multiple times have boolean determine if
-	// current train should be included in availabile Trains
-	includeCurrent := false
-	for index != max {
-
-		// check that comparisons are within the bounds of trains schedules
-		if (index + 1) >= max {
-			if includeCurrent {
-				availableTrains = append(availableTrains, trains[index])
-			}
-			break
+// getNextDayTrains looks forward one day at a time, up to lookaheadDays,
+// for the first day with 2+ trains arriving together at the stop
+func (s *Store) getNextDayTrainsLocked(selectedDate time.Time, stopID int64, keep func([]Schedule) []Schedule) (NextTrains, error) {
+	for i := 1; i <= lookaheadDays; i++ {
+		date := selectedDate.AddDate(0, 0, i)
+		trains, err := s.getFirstTrainsOfDayLocked(date, stopID, keep)
+		if err != nil {
+			return NextTrains{Trains: []Schedule{}}, err
 		}
 
-		c := trains[index]
-		n := trains[index+1]
-		// Parse to pkg time for easy comparisons
-		currentTime, _ := time.Parse(layout, c.Time)
-		nextTime, _ := time.Parse(layout, n.Time)
-
-		isSameTimeAndStop := currentTime == nextTime && c.StopID == stopID && n.StopID == stopID
-		if isSameTimeAndStop || includeCurrent {
-			availableTrains = append(availableTrains, trains[index])
+		if len(trains) > 1 {
+			return NextTrains{Date: serviceDayOf(date), Trains: trains}, nil
 		}
-		// increase index and mark whether next should be cinluded in availableTrains
-		index++
-		includeCurrent = isSameTimeAndStop
 	}
 
-	if len(availableTrains) == 1 {
-		return []Schedule{}, nil
+	return NextTrains{Trains: []Schedule{}}, nil
+}
+
+func (s *Store) getFirstTrainsOfDay(date time.Time, stopID int64) ([]Schedule, error) {
+	if err := s.rlock(); err != nil {
+		return []Schedule{}, err
+	}
+	defer s.mu.RUnlock()
+
+	return s.getFirstTrainsOfDayLocked(date, stopID, nil)
+}
+
+// getFirstTrainsOfDayLocked returns the trains arriving
+// at the stop at the same time as another train that day, of those keep leaves
+func (s *Store) getFirstTrainsOfDayLocked(date time.Time, stopID int64, keep func([]Schedule) []Schedule) ([]Schedule, error) {
+	day, err := s.dayLocked(date)
+	if err != nil {
+		return []Schedule{}, err
 	}
 
-	return availableTrains, nil
+	return day.sharedArrivalsOf(stopID, keep), nil
 }
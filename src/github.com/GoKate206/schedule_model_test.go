@@ -2,7 +2,8 @@ package main
 
 import (
 	"encoding/json"
-	"fmt"
+	"os"
+	"strings"
 	"testing"
 	"time"
 
@@ -10,10 +11,20 @@ import (
 	"github.com/stretchr/testify/require"
 )
 
+func TestMain(m *testing.M) {
+	// fixtures are written for July 2021, pin the clock before them
+	timeNow = func() time.Time {
+		now, _ := time.Parse(layout, "Jul 01 2021 00:00")
+		return now
+	}
+
+	os.Exit(m.Run())
+}
+
 func TestReadCsv(t *testing.T) {
 	csvHeaders := "stopID,route,trainID,time"
 	invokeRead := func(csv string) []Schedule {
-		schedules, err := readCsv(csv)
+		schedules, err := readCsv(csv, defaultTrainIDRules())
 		require.Nil(t, err)
 		return schedules
 	}
@@ -36,7 +47,7 @@ func TestReadCsv(t *testing.T) {
 		})
 
 		t.Run("when the csv has wrong header names", func(t *testing.T) {
-			_, err := readCsv("stopId,route,trainID,time")
+			_, err := readCsv("stopId,route,trainID,time", defaultTrainIDRules())
 
 			t.Run("it will return an error", func(t *testing.T) {
 				assert.NotNil(t, err)
@@ -45,7 +56,7 @@ func TestReadCsv(t *testing.T) {
 		})
 
 		t.Run("when there are too few headers", func(t *testing.T) {
-			_, err := readCsv("stopId,route")
+			_, err := readCsv("stopId,route", defaultTrainIDRules())
 
 			t.Run("it will return an error", func(t *testing.T) {
 				assert.NotNil(t, err)
@@ -56,14 +67,14 @@ func TestReadCsv(t *testing.T) {
 		t.Run("when stopId is not a valid number", func(t *testing.T) {
 			csv := `stopID,route,trainID,time
 "not-a-number","C","865a","Jul 05 2021 13:14"`
-			_, err := readCsv(csv)
+			_, err := readCsv(csv, defaultTrainIDRules())
 			assert.NotNil(t, err)
 		})
 
 		t.Run("when trainID is not 4 characters", func(t *testing.T) {
 			csv := `stopID,route,trainID,time
 1,"C","865","Jul 05 2021 13:14"`
-			_, err := readCsv(csv)
+			_, err := readCsv(csv, defaultTrainIDRules())
 			assert.NotNil(t, err)
 			assert.EqualValues(t, err.Error(), "Train Id is invalid, too few characters: 865")
 		})
@@ -71,7 +82,7 @@ func TestReadCsv(t *testing.T) {
 		t.Run("when trainID is not alphanumeric", func(t *testing.T) {
 			csv := `stopID,route,trainID,time
 1,"C","a_b@","Jul 05 2021 13:14"`
-			_, err := readCsv(csv)
+			_, err := readCsv(csv, defaultTrainIDRules())
 			assert.NotNil(t, err)
 			assert.EqualValues(t, err.Error(), "Train Id must be alphanumeric: a_b@")
 		})
@@ -91,22 +102,22 @@ func TestReadCsv(t *testing.T) {
 }
 
 func TestInsertSchedules(t *testing.T) {
-	initDb()
-	defer tearDownDb()
+	store := initTestStore(t)
+	defer tearDownStore(store)
 
 	t.Run("when a csv is processed and inserted to Schedule db", func(t *testing.T) {
 		csv := `stopID,route,trainID,time
 1,"C","865a","Jul 05 2021 13:14"
 1,"55","465a","Jul 05 2021 14:14"`
 
-		s, _ := readCsv(csv)
-		err := insertSchedules(s)
+		s, _ := readCsv(csv, defaultTrainIDRules())
+		err := store.insertSchedules(s)
 		if err != nil {
 			t.Fail()
 		}
 
 		t.Run("when we query the Schedule db", func(t *testing.T) {
-			all, err := db.ReadAll(fmt.Sprintf("./%s", scheduleDbName))
+			all, err := store.driver.ReadAll(scheduleDbName)
 			if err != nil {
 				t.Fail()
 			}
@@ -127,16 +138,28 @@ func TestInsertSchedules(t *testing.T) {
 					second = schedules[1]
 				)
 
-				assert.EqualValues(t, first.ID, "0_865a")
-				assert.EqualValues(t, second.ID, "1_465a")
+				assert.True(t, strings.HasSuffix(first.ID, "_0_865a"))
+				assert.True(t, strings.HasSuffix(second.ID, "_1_465a"))
 			})
 		})
 	})
+
+	t.Run("when a second csv is inserted", func(t *testing.T) {
+		s, _ := readCsv(`stopID,route,trainID,time
+2,"C","865a","Jul 05 2021 13:20"`, defaultTrainIDRules())
+		require.Nil(t, store.insertSchedules(s))
+
+		t.Run("it will not overwrite the first", func(t *testing.T) {
+			schedules, err := store.getAllSchedules()
+			require.Nil(t, err)
+			assert.Len(t, schedules, 3)
+		})
+	})
 }
 
 func TestGetTrainsByStopAndTime(t *testing.T) {
-	initDb()
-	defer tearDownDb()
+	store := initTestStore(t)
+	defer tearDownStore(store)
 
 	t.Run("given a database with Schedules", func(t *testing.T) {
 		stopId := int64(1)
@@ -170,17 +193,17 @@ func TestGetTrainsByStopAndTime(t *testing.T) {
 1,"55","465a","Jul 05 2021 02:30"
 1,"C","314p","Jul 05 2021 02:30"
 `
-		csvHandler(csv)
+		store.csvHandler(csv)
 
 		t.Run("given getTrainsByStopAndTime is invoked", func(t *testing.T) {
 			t.Run("when invoked with an invalid time", func(t *testing.T) {
-				_, err := getTrainsByStopAndTime(1, "07/04/21 7:42")
+				_, err := store.getTrainsByStopAndTime(1, "07/04/21 7:42")
 				assert.Error(t, err)
 				assert.EqualValues(t, err.Error(), `parsing time "07/04/21 7:42" as "Jan 02 2006 15:04": cannot parse "07/04/21 7:42" as "Jan"`)
 			})
 
 			t.Run("when invoked with a valid time where there are 2 trains arriving on that minute", func(t *testing.T) {
-				schedules, err := getTrainsByStopAndTime(stopId, "Jul 04 2021 07:42")
+				schedules, err := store.getTrainsByStopAndTime(stopId, "Jul 04 2021 07:42")
 				require.Nil(t, err)
 
 				t.Run("it will return 2 rows", func(t *testing.T) {
@@ -200,7 +223,7 @@ func TestGetTrainsByStopAndTime(t *testing.T) {
 			})
 
 			t.Run("when invoked with a valid time outside of schedule range", func(t *testing.T) {
-				schedules, err := getTrainsByStopAndTime(stopId, "Jul 04 2021 06:30")
+				schedules, err := store.getTrainsByStopAndTime(stopId, "Jul 04 2021 06:30")
 				require.Nil(t, err)
 
 				t.Run("it will return 0 rows", func(t *testing.T) {
@@ -209,7 +232,7 @@ func TestGetTrainsByStopAndTime(t *testing.T) {
 			})
 
 			t.Run("when invoked where there are no available trains that day", func(t *testing.T) {
-				schedules, _ := getTrainsByStopAndTime(stopId, "Jul 04 2021 23:36")
+				schedules, _ := store.getTrainsByStopAndTime(stopId, "Jul 04 2021 23:36")
 				assert.Len(t, schedules, 2)
 			})
 		})
@@ -219,20 +242,20 @@ func TestGetTrainsByStopAndTime(t *testing.T) {
 
 func TestGetFirstMultipleTrainsByDate(t *testing.T) {
 	t.Run("given a database with two applicable trains", func(t *testing.T) {
-		initDb()
-		defer tearDownDb()
+		store := initTestStore(t)
+		defer tearDownStore(store)
 
 		csv := `stopID,route,trainID,time
 1,"55","465a","Jul 05 2021 01:30"
 1,"C","314p","Jul 05 2021 02:30"
 2,"21","159t","Jul 05 2021 02:30"
 1,"21x","159t","Jul 05 2021 02:30"`
-		csvHandler(csv)
+		store.csvHandler(csv)
 
 		t.Run("when getFirstTrainsOfDay is invoked", func(t *testing.T) {
 			stopID := int64(1)
 			d, _ := time.Parse(layout, "Jul 05 2021 12:00")
-			trains, err := getFirstTrainsOfDay(d, stopID)
+			trains, err := store.getFirstTrainsOfDay(d, stopID)
 			require.Nil(t, err)
 
 			t.Run("it will return all trains for the given stop", func(t *testing.T) {
@@ -247,20 +270,20 @@ func TestGetFirstMultipleTrainsByDate(t *testing.T) {
 	})
 
 	t.Run("given a database with no applicable trains", func(t *testing.T) {
-		initDb()
-		defer tearDownDb()
+		store := initTestStore(t)
+		defer tearDownStore(store)
 
 		csv := `stopID,route,trainID,time
 1,"55","465a","Jul 05 2021 01:30"
 2,"C","314p","Jul 05 2021 02:30"
 3,"21","159t","Jul 05 2021 02:30"
 1,"55","159t","Jul 05 2021 02:30"`
-		csvHandler(csv)
+		store.csvHandler(csv)
 
 		t.Run("when getFirstTrainsOfDay is invoked", func(t *testing.T) {
 			stopID := int64(1)
 			d, _ := time.Parse(layout, "Jul 05 2021 12:00")
-			trains, err := getFirstTrainsOfDay(d, stopID)
+			trains, err := store.getFirstTrainsOfDay(d, stopID)
 			require.Nil(t, err)
 
 			t.Run("there will be no trains returned", func(t *testing.T) {
@@ -271,3 +294,53 @@ func TestGetFirstMultipleTrainsByDate(t *testing.T) {
 	})
 
 }
+
+func TestGetNextTrains(t *testing.T) {
+	store := initTestStore(t)
+	defer tearDownStore(store)
+
+	t.Run("given a weekday only line and a Friday night request", func(t *testing.T) {
+		stopID := int64(1)
+		csv := `stopID,route,trainID,time
+1,"C","865a","Jul 02 2021 07:42"
+1,"55","465a","Jul 02 2021 07:42"
+1,"C","865a","Jul 05 2021 07:14"
+1,"55","465a","Jul 05 2021 07:14"
+2,"C","865a","Jul 05 2021 07:20"`
+		store.csvHandler(csv)
+
+		t.Run("when the lookahead reaches the next service", func(t *testing.T) {
+			next, err := store.getNextTrains(stopID, "Jul 02 2021 22:00")
+			require.Nil(t, err)
+
+			t.Run("it will return Monday's first trains and their date", func(t *testing.T) {
+				assert.EqualValues(t, "Jul 05 2021", next.Date)
+				require.Len(t, next.Trains, 2)
+				assert.EqualValues(t, "Jul 05 2021 07:14", next.Trains[0].Time)
+			})
+		})
+
+		t.Run("when the request falls on a day with no trains", func(t *testing.T) {
+			next, err := store.getNextTrains(stopID, "Jul 03 2021 09:00")
+			require.Nil(t, err)
+
+			t.Run("it will still return Monday's first trains", func(t *testing.T) {
+				assert.EqualValues(t, "Jul 05 2021", next.Date)
+				assert.Len(t, next.Trains, 2)
+			})
+		})
+
+		t.Run("when the lookahead is shorter than the gap", func(t *testing.T) {
+			defer func(days int) { lookaheadDays = days }(lookaheadDays)
+			lookaheadDays = 2
+
+			next, err := store.getNextTrains(stopID, "Jul 02 2021 22:00")
+			require.Nil(t, err)
+
+			t.Run("there will be no trains returned", func(t *testing.T) {
+				assert.EqualValues(t, "Jul 02 2021", next.Date)
+				assert.Len(t, next.Trains, 0)
+			})
+		})
+	})
+}
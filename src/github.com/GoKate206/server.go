@@ -0,0 +1,1115 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	// maxUploadBytes bounds the timetable uploads read from a request
+	maxUploadBytes int64 = 32 << 20
+	// maxJSONBytes bounds the JSON objects read from a request
+	maxJSONBytes int64 = 1 << 20
+)
+
+// server exposes the store over HTTP, every handler is safe to run
+// concurrently as the store does its own locking
+type server struct {
+	store *Store
+	mux   *http.ServeMux
+	lint  LintConfig
+	// done ends open streams when the server shuts down
+	done     chan struct{}
+	shutdown func()
+}
+
+func newServer(store *Store) *server {
+	s := &server{store: store, mux: http.NewServeMux(), lint: defaultLintConfig(), done: make(chan struct{})}
+	var once sync.Once
+	s.shutdown = func() { once.Do(func() { close(s.done) }) }
+	s.mux.HandleFunc("/schedules", s.handleSchedules)
+	s.mux.HandleFunc("/schedules/", s.handleSchedule)
+	s.mux.HandleFunc("/timetables", s.handleTimetables)
+	s.mux.HandleFunc("/timetables/", s.handleTimetable)
+	s.mux.HandleFunc("/lint", s.handleLint)
+	s.mux.HandleFunc("/mappings", s.handleMappings)
+	s.mux.HandleFunc("/mappings/", s.handleMapping)
+	s.mux.HandleFunc("/stops", s.handleStopList)
+	s.mux.HandleFunc("/stops/", s.handleStops)
+	s.mux.HandleFunc("/trains/nearby", s.handleTrainsNearby)
+	s.mux.HandleFunc("/calendar.ics", s.handleCalendar)
+	s.mux.HandleFunc("/routes/", s.handleRoutes)
+	s.mux.HandleFunc("/alerts", s.handleAlerts)
+	s.mux.HandleFunc("/alerts/", s.handleAlert)
+	s.mux.HandleFunc("/cancellations", s.handleCancellations)
+	s.mux.HandleFunc("/cancellations/", s.handleOverride(cancellationDbName))
+	s.mux.HandleFunc("/extras", s.handleExtras)
+	s.mux.HandleFunc("/extras/", s.handleOverride(extraDbName))
+	s.mux.HandleFunc("/frequencies", s.handleFrequencies)
+	s.mux.HandleFunc("/frequencies/", s.handleOverride(frequencyDbName))
+	s.mux.HandleFunc("/platform-changes", s.handlePlatformChanges)
+	s.mux.HandleFunc("/platform-changes/", s.handleOverride(platformChangeDbName))
+	s.mux.HandleFunc("/webhooks", s.handleWebhooks)
+	s.mux.HandleFunc("/webhooks/", s.handleWebhook)
+	s.mux.HandleFunc("/subscriptions", s.handleSubscriptions)
+	s.mux.HandleFunc("/subscriptions/", s.handleSubscription)
+
+	return s
+}
+
+func (s *server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mux.ServeHTTP(w, r)
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+// readJSON decodes a request body of at most maxJSONBytes into v
+func readJSON(w http.ResponseWriter, r *http.Request, v interface{}) error {
+	return json.NewDecoder(http.MaxBytesReader(w, r.Body, maxJSONBytes)).Decode(v)
+}
+
+func writeError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, map[string]string{"error": err.Error()})
+}
+
+// requestTime reads the time query param in layout, defaulting to now
+func requestTime(r *http.Request) (string, time.Time, error) {
+	value := r.URL.Query().Get("time")
+	if value == "" {
+		now := timeNow().UTC().Truncate(time.Minute)
+		return now.Format(layout), now, nil
+	}
+
+	t, _, err := parseScheduleTime(value)
+	return value, t, err
+}
+
+// handleSchedules imports with POST and re-uploads with PUT after
+// linting ( ?force=true only warns, ?dryRun=true only sees the diff ),
+// lists a day with GET ?date= and deletes what matches
+// ?stopID=&route=&trainID=&from=&to= with DELETE. Uploads are read
+// through ?mapping=auto or a saved provider mapping
+func (s *server) handleSchedules(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodDelete:
+		filter, err := scheduleFilterFromQuery(r)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+
+		deleted, err := s.store.deleteSchedules(filter)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]int{"deleted": deleted})
+
+	case http.MethodGet:
+		date, err := time.Parse(dateLayout, r.URL.Query().Get("date"))
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+
+		schedules, err := s.store.getScheduleByDate(date)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, schedules)
+
+	case http.MethodPost, http.MethodPut:
+		body, rules, err := s.readCsvBody(w, r)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+
+		cfg := s.lintConfigOf(r)
+		if r.Method == http.MethodPost {
+			report, err := s.store.lintedImport(body, rules, cfg)
+			if report.Blocked {
+				writeJSON(w, http.StatusUnprocessableEntity, report)
+				return
+			}
+			if err != nil {
+				writeError(w, http.StatusBadRequest, err)
+				return
+			}
+			writeJSON(w, http.StatusCreated, report)
+			return
+		}
+
+		diff, err := s.store.replaceSchedules(body, rules, r.URL.Query().Get("dryRun") == "true", cfg)
+		if err != nil && diff.Lint.Blocked {
+			writeJSON(w, http.StatusUnprocessableEntity, diff)
+			return
+		}
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, diff)
+
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+// lintConfigOf is the server's lint config, ?force=true only warns
+func (s *server) lintConfigOf(r *http.Request) LintConfig {
+	cfg := s.lint
+	if r.URL.Query().Get("force") == "true" {
+		cfg.BlockOn = ""
+	}
+
+	return cfg
+}
+
+// readCsvBody reads an upload as CSV, in the ?format= or Content-Type
+// given ( ?sheet= of a workbook ) and through the ?mapping= of the request,
+// with the train ID rules it is to be read with
+func (s *server) readCsvBody(w http.ResponseWriter, r *http.Request) (string, TrainIDRules, error) {
+	body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxUploadBytes))
+	if err != nil {
+		return "", TrainIDRules{}, err
+	}
+
+	query := r.URL.Query()
+	format := query.Get("format")
+	if format == "" {
+		format = uploadFormatOf(r.Header.Get("Content-Type"))
+	}
+
+	csv, err := uploadToCsv(body, format, query.Get("sheet"))
+	if err != nil {
+		return "", TrainIDRules{}, err
+	}
+
+	return s.store.normalizeCsv(csv, query.Get("mapping"))
+}
+
+// handleMappings lists the saved provider mappings
+func (s *server) handleMappings(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	mappings, err := s.store.getMappings()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, mappings)
+}
+
+// handleMapping saves a JSON CsvMapping with PUT /mappings/{provider},
+// GET returns it and DELETE removes it
+func (s *server) handleMapping(w http.ResponseWriter, r *http.Request) {
+	provider := strings.TrimPrefix(r.URL.Path, "/mappings/")
+	switch r.Method {
+	case http.MethodGet:
+		mapping, err := s.store.getMapping(provider)
+		if err != nil {
+			writeError(w, http.StatusNotFound, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, mapping)
+
+	case http.MethodPut:
+		mapping := CsvMapping{}
+		if err := readJSON(w, r, &mapping); err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+
+		mapping.Provider = provider
+		if err := s.store.saveMapping(mapping); err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, mapping)
+
+	case http.MethodDelete:
+		if err := s.store.deleteMapping(provider); err != nil {
+			writeError(w, http.StatusNotFound, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+// handleLint reports on a POSTed CSV without importing it
+func (s *server) handleLint(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	body, rules, err := s.readCsvBody(w, r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	schedules, err := readCsv(body, rules)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, lintSchedules(schedules, s.lint))
+}
+
+func scheduleFilterFromQuery(r *http.Request) (ScheduleFilter, error) {
+	query := r.URL.Query()
+	filter := ScheduleFilter{
+		Route:   query.Get("route"),
+		TrainID: query.Get("trainID"),
+		From:    query.Get("from"),
+		To:      query.Get("to"),
+	}
+
+	if value := query.Get("stopID"); value != "" {
+		stopID, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return filter, err
+		}
+		filter.StopID = &stopID
+	}
+
+	return filter, nil
+}
+
+// handleSchedule deletes /schedules/{id} with DELETE,
+// PATCH takes a JSON ScheduleUpdate to retime or reassign it
+func (s *server) handleSchedule(w http.ResponseWriter, r *http.Request) {
+	id := strings.TrimPrefix(r.URL.Path, "/schedules/")
+	if id == "" || strings.Contains(id, "/") {
+		http.NotFound(w, r)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodDelete:
+		if err := s.store.deleteSchedule(id); err != nil {
+			writeError(w, http.StatusNotFound, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+
+	case http.MethodPatch:
+		update := ScheduleUpdate{}
+		if err := readJSON(w, r, &update); err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+
+		schedule, err := s.store.updateSchedule(id, update)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, schedule)
+
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+// handleTimetables lists the timetable versions with GET and imports
+// an upload as a new inactive version with POST ?effectiveFrom=,
+// linted as POST /schedules is
+func (s *server) handleTimetables(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		versions, err := s.store.getVersions()
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, versions)
+
+	case http.MethodPost:
+		body, rules, err := s.readCsvBody(w, r)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+
+		version, report, err := s.store.importTimetable(body, rules, r.URL.Query().Get("effectiveFrom"), s.lintConfigOf(r))
+		if report.Blocked {
+			writeJSON(w, http.StatusUnprocessableEntity, report)
+			return
+		}
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		writeJSON(w, http.StatusCreated, version)
+
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+// handleTimetable activates /timetables/{id}/activate and rolls back
+// /timetables/{id}/rollback with POST, GET /timetables/{id}/preview?date=
+// lists the version's trains on a service day
+func (s *server) handleTimetable(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/timetables/"), "/")
+	if len(parts) != 2 {
+		http.NotFound(w, r)
+		return
+	}
+
+	switch {
+	case parts[1] == "activate" && r.Method == http.MethodPost:
+		version, err := s.store.activateVersion(parts[0])
+		if err != nil {
+			writeError(w, http.StatusNotFound, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, version)
+
+	case parts[1] == "rollback" && r.Method == http.MethodPost:
+		version, err := s.store.rollbackVersion(parts[0])
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, version)
+
+	case parts[1] == "preview" && r.Method == http.MethodGet:
+		date, err := requestDate(r)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+
+		schedules, err := s.store.previewVersion(parts[0], date.Add(time.Duration(serviceDayRolloverHour)*time.Hour))
+		if err != nil {
+			writeError(w, http.StatusNotFound, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, schedules)
+
+	case parts[1] == "activate" || parts[1] == "rollback" || parts[1] == "preview":
+		w.WriteHeader(http.StatusMethodNotAllowed)
+
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// handleStopList lists the described stops
+func (s *server) handleStopList(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	stops, err := s.store.getStops()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, stops)
+}
+
+// requestPoint reads the lat and lon query params and an optional
+// radius in meters
+func requestPoint(r *http.Request) (float64, float64, float64, error) {
+	query := r.URL.Query()
+	lat, err := strconv.ParseFloat(query.Get("lat"), 64)
+	if err != nil {
+		return 0, 0, 0, fmt.Errorf("lat is required: %v", err)
+	}
+	lon, err := strconv.ParseFloat(query.Get("lon"), 64)
+	if err != nil {
+		return 0, 0, 0, fmt.Errorf("lon is required: %v", err)
+	}
+
+	radius := 0.0
+	if value := query.Get("radius"); value != "" {
+		if radius, err = strconv.ParseFloat(value, 64); err != nil {
+			return 0, 0, 0, err
+		}
+	}
+
+	return lat, lon, radius, nil
+}
+
+// handleNearbyStops finds the ?k= nearest stops to ?lat=&lon=, or
+// those within ?radius= meters
+func (s *server) handleNearbyStops(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	lat, lon, radius, err := requestPoint(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	k := 0
+	if value := r.URL.Query().Get("k"); value != "" {
+		if k, err = strconv.Atoi(value); err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+	}
+
+	nearby, err := s.store.getNearbyStops(lat, lon, k, radius)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, nearby)
+}
+
+// handleTrainsNearby lists the trains that can be walked to from
+// ?lat=&lon= within ?radius= meters, from ?time= or now
+func (s *server) handleTrainsNearby(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	lat, lon, radius, err := requestPoint(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	_, clock, err := requestTime(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	nearby, err := s.store.getTrainsNear(lat, lon, radius, clock)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, nearby)
+}
+
+// handleStop describes /stops/{id} with a JSON Stop on PUT, GET returns it
+func (s *server) handleStop(w http.ResponseWriter, r *http.Request, stopID int64) {
+	switch r.Method {
+	case http.MethodGet:
+		stop, err := s.store.getStop(stopID)
+		if err != nil {
+			writeError(w, http.StatusNotFound, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, stop)
+
+	case http.MethodPut:
+		stop := Stop{}
+		if err := readJSON(w, r, &stop); err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+
+		stop.ID = stopID
+		stop, err := s.store.saveStop(stop)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, stop)
+
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+// handleStops serves /stops/nearby, /stops/{id}, /stops/{id}/next ( ?accessible=true
+// for wheelchair accessible trains, ?stepFree=true for step-free stops,
+// ?direction= to filter and ?groupBy=direction ), /stops/{id}/board and
+// /stops/{id}/stream, streaming upcoming trains filtered the same way
+func (s *server) handleStops(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/stops/"), "/")
+	if len(parts) == 1 && parts[0] == "nearby" {
+		s.handleNearbyStops(w, r)
+		return
+	}
+	if len(parts) == 1 {
+		stopID, err := strconv.ParseInt(parts[0], 10, 64)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		s.handleStop(w, r, stopID)
+		return
+	}
+
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	if len(parts) != 2 {
+		http.NotFound(w, r)
+		return
+	}
+
+	stopID, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	selectedTime, clock, err := requestTime(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	switch parts[1] {
+	case "next":
+		next, err := s.store.getNextTrainsFor(stopID, selectedTime, stopQueryOf(r))
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, next)
+
+	case "stream":
+		query := stopQueryOf(r)
+		query.GroupByDirection = false
+		s.serveStream(w, r, stopID, query)
+
+	case "board":
+		s.serveBoard(w, r, stopID, clock)
+
+	case "timetable":
+		date, err := requestDate(r)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+
+		timetable, err := s.store.buildStopTimetable(stopID, date)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+		serveTimetable(w, r, timetable)
+
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// stopQueryOf reads ?accessible=&stepFree=&direction=&groupBy=direction
+func stopQueryOf(r *http.Request) StopQuery {
+	query := r.URL.Query()
+	return StopQuery{
+		Access: AccessOptions{
+			Wheelchair: query.Get("accessible") == "true",
+			StepFree:   query.Get("stepFree") == "true",
+		},
+		Direction:        query.Get("direction"),
+		GroupByDirection: query.Get("groupBy") == "direction",
+	}
+}
+
+// serveStream pushes the stop's upcoming trains as server-sent events,
+// again whenever the first of them has arrived or a change touches the
+// stop. Unchanged lists are not sent twice
+func (s *server) serveStream(w http.ResponseWriter, r *http.Request, stopID int64, query StopQuery) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeError(w, http.StatusInternalServerError, fmt.Errorf("Streaming is not supported"))
+		return
+	}
+
+	// a change only wakes the stream, it reads the store itself
+	changes := make(chan struct{}, 1)
+	stop := s.store.onChange(func(change ChangeEvent) {
+		if change.affects([]int64{stopID}, nil) {
+			select {
+			case changes <- struct{}{}:
+			default:
+			}
+		}
+	})
+	defer stop()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	heartbeat := time.NewTicker(streamHeartbeat)
+	defer heartbeat.Stop()
+	timer := newStreamTimer()
+	defer timer.stop()
+
+	id, sent := 0, []byte{}
+	for {
+		now := timeNow().UTC()
+		upcoming, err := s.store.getUpcomingTrains(stopID, now.Truncate(time.Minute), streamTrains, query)
+		if err != nil {
+			data, _ := json.Marshal(map[string]string{"error": err.Error()})
+			writeEvent(w, id+1, "error", data)
+			flusher.Flush()
+			return
+		}
+
+		data, err := json.Marshal(upcoming)
+		if err != nil {
+			return
+		}
+		if !bytes.Equal(data, sent) {
+			id++
+			if writeEvent(w, id, "trains", data) != nil {
+				return
+			}
+			flusher.Flush()
+			sent = data
+		}
+
+		timer.reset(nextStreamUpdate(upcoming.Trains, now))
+	wait:
+		for {
+			select {
+			case <-r.Context().Done():
+				return
+			case <-s.done:
+				return
+			case <-changes:
+				break wait
+			case <-timer.wake():
+				break wait
+			case <-heartbeat.C:
+				fmt.Fprint(w, ": keep-alive\n\n")
+				flusher.Flush()
+			}
+		}
+	}
+}
+
+// handleRoutes serves /routes/{route}/timetable?date=&format=
+func (s *server) handleRoutes(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/routes/"), "/")
+	if len(parts) != 2 || parts[1] != "timetable" {
+		http.NotFound(w, r)
+		return
+	}
+
+	date, err := requestDate(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	timetable, err := s.store.buildRouteTimetable(parts[0], date)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	serveTimetable(w, r, timetable)
+}
+
+// requestDate reads the date query param in dateLayout, defaulting to
+// the current service day
+func requestDate(r *http.Request) (time.Time, error) {
+	value := r.URL.Query().Get("date")
+	if value == "" {
+		value = serviceDayOf(timeNow().UTC())
+	}
+
+	return time.Parse(dateLayout, value)
+}
+
+// serveTimetable renders a timetable in the ?format= asked for
+func serveTimetable(w http.ResponseWriter, r *http.Request, timetable printableTimetable) {
+	format := r.URL.Query().Get("format")
+	contentType, ok := timetableContentTypes[format]
+	if !ok {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("Unknown timetable format: %s", format))
+		return
+	}
+
+	body, err := renderTimetable(timetable, format)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", contentType)
+	w.Write(body)
+}
+
+// handleCalendar serves a subscribable iCalendar feed of the trains
+// matching ?stopID=&route=&trainID=&from=&to=
+func (s *server) handleCalendar(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	filter, err := scheduleFilterFromQuery(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	schedules, err := s.store.calendarSchedules(filter)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/calendar; charset=utf-8")
+	w.Header().Set("Content-Disposition", `inline; filename="train-schedule.ics"`)
+	w.Write([]byte(renderICal(calendarName(filter), schedules)))
+}
+
+var boardContentTypes = map[string]string{
+	"":     "application/json",
+	"json": "application/json",
+	"text": "text/plain; charset=utf-8",
+	"html": "text/html; charset=utf-8",
+}
+
+func (s *server) serveBoard(w http.ResponseWriter, r *http.Request, stopID int64, clock time.Time) {
+	format := r.URL.Query().Get("format")
+	contentType, ok := boardContentTypes[format]
+	if !ok {
+		writeError(w, http.StatusBadRequest, errUnknownFormat(format))
+		return
+	}
+
+	board, err := s.store.buildDepartureBoard(stopID, clock)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	b, err := renderBoard(board, format)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", contentType)
+	w.Write(b)
+}
+
+// handleAlerts lists alerts with GET and adds a JSON ServiceAlert with POST
+func (s *server) handleAlerts(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		alerts, err := s.store.getAlerts()
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, alerts)
+
+	case http.MethodPost:
+		alert := ServiceAlert{}
+		if err := readJSON(w, r, &alert); err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+
+		alert, err := s.store.addAlert(alert)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		writeJSON(w, http.StatusCreated, alert)
+
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+// handleAlert deletes /alerts/{id}
+func (s *server) handleAlert(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodDelete {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	if err := s.store.deleteAlert(strings.TrimPrefix(r.URL.Path, "/alerts/")); err != nil {
+		writeError(w, http.StatusNotFound, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handlePlatformChanges lists platform changes with GET and adds a JSON PlatformChange with POST
+func (s *server) handlePlatformChanges(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		changes, err := s.store.getPlatformChanges()
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, changes)
+
+	case http.MethodPost:
+		change := PlatformChange{}
+		if err := readJSON(w, r, &change); err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+
+		change, err := s.store.addPlatformChange(change)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		writeJSON(w, http.StatusCreated, change)
+
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+// handleCancellations lists cancellations with GET and adds a JSON Cancellation with POST
+func (s *server) handleCancellations(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		cancellations, err := s.store.getCancellations()
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, cancellations)
+
+	case http.MethodPost:
+		cancellation := Cancellation{}
+		if err := readJSON(w, r, &cancellation); err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+
+		cancellation, err := s.store.addCancellation(cancellation)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		writeJSON(w, http.StatusCreated, cancellation)
+
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+// handleExtras lists extra services with GET and adds a JSON Schedule with POST
+func (s *server) handleExtras(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		extras, err := s.store.getExtraServices()
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, extras)
+
+	case http.MethodPost:
+		extra := Schedule{}
+		if err := readJSON(w, r, &extra); err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+
+		extra, err := s.store.addExtraService(extra)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		writeJSON(w, http.StatusCreated, extra)
+
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+// handleOverride deletes /cancellations/{id}, /extras/{id} and /frequencies/{id}
+func (s *server) handleOverride(collection string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodDelete {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+
+		id := r.URL.Path[strings.LastIndex(r.URL.Path, "/")+1:]
+		if err := s.store.deleteOverride(collection, id); err != nil {
+			writeError(w, http.StatusNotFound, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// handleFrequencies lists definitions with GET and imports a frequency CSV with POST
+func (s *server) handleFrequencies(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		frequencies, err := s.store.getFrequencies()
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, frequencies)
+
+	case http.MethodPost:
+		body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxUploadBytes))
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+
+		frequencies, err := readFrequencyCsv(string(body), s.store.trainIDRules)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+
+		frequencies, err = s.store.insertFrequencies(frequencies)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+		writeJSON(w, http.StatusCreated, frequencies)
+
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+// handleWebhooks lists webhooks with GET, without their secrets,
+// and subscribes one with POST
+func (s *server) handleWebhooks(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		hooks, err := s.store.getWebhooks()
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+		for i := range hooks {
+			hooks[i].Secret = ""
+		}
+		writeJSON(w, http.StatusOK, hooks)
+
+	case http.MethodPost:
+		hook := Webhook{}
+		if err := readJSON(w, r, &hook); err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+
+		hook, err := s.store.addWebhook(hook)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		writeJSON(w, http.StatusCreated, hook)
+
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+// handleWebhook deletes /webhooks/{id} and lists /webhooks/{id}/deliveries
+func (s *server) handleWebhook(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/webhooks/"), "/")
+	switch {
+	case len(parts) == 1 && r.Method == http.MethodDelete:
+		if err := s.store.deleteWebhook(parts[0]); err != nil {
+			writeError(w, http.StatusNotFound, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+
+	case len(parts) == 2 && parts[1] == "deliveries" && r.Method == http.MethodGet:
+		deliveries, err := s.store.getDeliveries(parts[0])
+		if err != nil {
+			writeError(w, http.StatusNotFound, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, deliveries)
+
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+// handleSubscriptions lists rider subscriptions with GET, one rider's
+// with ?rider=, and adds a JSON RiderSubscription with POST
+func (s *server) handleSubscriptions(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		subscriptions, err := s.store.getRiderSubscriptions(r.URL.Query().Get("rider"))
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, subscriptions)
+
+	case http.MethodPost:
+		subscription := RiderSubscription{}
+		if err := readJSON(w, r, &subscription); err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+
+		subscription, err := s.store.addRiderSubscription(subscription)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		writeJSON(w, http.StatusCreated, subscription)
+
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+// handleSubscription deletes /subscriptions/{id}
+func (s *server) handleSubscription(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodDelete {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	if err := s.store.deleteRiderSubscription(strings.TrimPrefix(r.URL.Path, "/subscriptions/")); err != nil {
+		writeError(w, http.StatusNotFound, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,255 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestServer(t *testing.T) {
+	store := initTestStore(t)
+	defer tearDownStore(store)
+	srv := httptest.NewServer(newServer(store))
+	defer srv.Close()
+
+	csv := `stopID,route,trainID,time
+1,"C","865a","Jul 04 2021 07:42"
+1,"55","465a","Jul 04 2021 07:42"`
+
+	t.Run("when a csv is posted", func(t *testing.T) {
+		res, err := http.Post(srv.URL+"/schedules", "text/csv", strings.NewReader(csv))
+		require.Nil(t, err)
+		res.Body.Close()
+		assert.EqualValues(t, http.StatusCreated, res.StatusCode)
+
+		t.Run("the next trains can be requested for a stop", func(t *testing.T) {
+			res, err := http.Get(srv.URL + "/stops/1/next?time=" + url.QueryEscape("Jul 04 2021 07:42"))
+			require.Nil(t, err)
+			defer res.Body.Close()
+
+			next := NextTrains{}
+			require.Nil(t, json.NewDecoder(res.Body).Decode(&next))
+			assert.EqualValues(t, "Jul 04 2021", next.Date)
+			assert.Len(t, next.Trains, 2)
+		})
+
+		t.Run("the departure board can be requested as text", func(t *testing.T) {
+			res, err := http.Get(srv.URL + "/stops/1/board?format=text&time=" + url.QueryEscape("Jul 04 2021 07:40"))
+			require.Nil(t, err)
+			defer res.Body.Close()
+			assert.EqualValues(t, "text/plain; charset=utf-8", res.Header.Get("Content-Type"))
+		})
+	})
+
+	t.Run("when an invalid csv is posted", func(t *testing.T) {
+		res, err := http.Post(srv.URL+"/schedules", "text/csv", strings.NewReader("stopId,route"))
+		require.Nil(t, err)
+		res.Body.Close()
+		assert.EqualValues(t, http.StatusBadRequest, res.StatusCode)
+	})
+
+	t.Run("when a csv failing lint is posted", func(t *testing.T) {
+		res, err := http.Post(srv.URL+"/schedules", "text/csv", strings.NewReader(`stopID,route,trainID,time
+1,"C","777a","Jul 05 2021 07:42"
+2,"C","777a","Jul 05 2021 07:42"`))
+		require.Nil(t, err)
+		defer res.Body.Close()
+
+		report := LintReport{}
+		require.Nil(t, json.NewDecoder(res.Body).Decode(&report))
+		assert.EqualValues(t, http.StatusUnprocessableEntity, res.StatusCode)
+		assert.True(t, report.Blocked)
+	})
+
+	t.Run("when a re-upload failing lint is put", func(t *testing.T) {
+		req, _ := http.NewRequest(http.MethodPut, srv.URL+"/schedules", strings.NewReader(`stopID,route,trainID,time
+1,"C","777a","Jul 05 2021 07:42"
+2,"C","777a","Jul 05 2021 07:42"`))
+		res, err := http.DefaultClient.Do(req)
+		require.Nil(t, err)
+		defer res.Body.Close()
+
+		diff := ScheduleDiff{}
+		require.Nil(t, json.NewDecoder(res.Body).Decode(&diff))
+		assert.EqualValues(t, http.StatusUnprocessableEntity, res.StatusCode)
+		assert.True(t, diff.Lint.Blocked)
+		assert.False(t, diff.Committed)
+	})
+
+	t.Run("when a re-upload is put as a dry run", func(t *testing.T) {
+		req, _ := http.NewRequest(http.MethodPut, srv.URL+"/schedules?dryRun=true", strings.NewReader(trainsAt(1, "Jul 04 2021 07:42")))
+		res, err := http.DefaultClient.Do(req)
+		require.Nil(t, err)
+		defer res.Body.Close()
+
+		diff := ScheduleDiff{}
+		require.Nil(t, json.NewDecoder(res.Body).Decode(&diff))
+		assert.False(t, diff.Committed)
+		assert.EqualValues(t, 2, diff.Removed)
+		assert.EqualValues(t, 1, diff.Added)
+	})
+
+	t.Run("when a schedule is patched then deleted", func(t *testing.T) {
+		id := scheduleIDOf(t, store, "865a")
+		req, _ := http.NewRequest(http.MethodPatch, srv.URL+"/schedules/"+id, strings.NewReader(`{"time":"Jul 04 2021 08:00"}`))
+		res, err := http.DefaultClient.Do(req)
+		require.Nil(t, err)
+		defer res.Body.Close()
+
+		schedule := Schedule{}
+		require.Nil(t, json.NewDecoder(res.Body).Decode(&schedule))
+		assert.EqualValues(t, "Jul 04 2021 08:00", schedule.Time)
+
+		req, _ = http.NewRequest(http.MethodDelete, srv.URL+"/schedules/"+id, nil)
+		res, err = http.DefaultClient.Do(req)
+		require.Nil(t, err)
+		res.Body.Close()
+		assert.EqualValues(t, http.StatusNoContent, res.StatusCode)
+	})
+
+	t.Run("when schedules are deleted by route", func(t *testing.T) {
+		req, _ := http.NewRequest(http.MethodDelete, srv.URL+"/schedules?route=55", nil)
+		res, err := http.DefaultClient.Do(req)
+		require.Nil(t, err)
+		defer res.Body.Close()
+
+		deleted := map[string]int{}
+		require.Nil(t, json.NewDecoder(res.Body).Decode(&deleted))
+		assert.EqualValues(t, 1, deleted["deleted"])
+	})
+
+	t.Run("when an unknown stop path is requested", func(t *testing.T) {
+		res, err := http.Get(srv.URL + "/stops/1/nowhere")
+		require.Nil(t, err)
+		res.Body.Close()
+		assert.EqualValues(t, http.StatusNotFound, res.StatusCode)
+	})
+}
+
+func TestServerLimits(t *testing.T) {
+	store := initTestStore(t)
+	defer tearDownStore(store)
+	srv := httptest.NewServer(newServer(store))
+	defer srv.Close()
+
+	defer func(upload, object int64) { maxUploadBytes, maxJSONBytes = upload, object }(maxUploadBytes, maxJSONBytes)
+	maxUploadBytes, maxJSONBytes = 100, 16
+
+	t.Run("when an upload is larger than the limit", func(t *testing.T) {
+		uploads := map[string]string{
+			"/schedules":   trainsAt(4, "Jul 04 2021 07:42"),
+			"/lint":        trainsAt(4, "Jul 04 2021 07:42"),
+			"/frequencies": "stopID,route,trainID,serviceDay,startTime,endTime,headwaySecs,exactTimes\n" + `1,"C","f001","Jul 04 2021","06:00","10:00",480,0`,
+		}
+		for path, body := range uploads {
+			res, err := http.Post(srv.URL+path, "text/csv", strings.NewReader(body))
+			require.Nil(t, err)
+			res.Body.Close()
+
+			t.Run("it will be refused on "+path, func(t *testing.T) {
+				assert.EqualValues(t, http.StatusBadRequest, res.StatusCode)
+			})
+		}
+
+		t.Run("it will store nothing", func(t *testing.T) {
+			schedules, err := store.getAllSchedules()
+			require.Nil(t, err)
+			assert.Len(t, schedules, 0)
+			frequencies, err := store.getFrequencies()
+			require.Nil(t, err)
+			assert.Len(t, frequencies, 0)
+		})
+	})
+
+	t.Run("when an upload is within the limit", func(t *testing.T) {
+		res, err := http.Post(srv.URL+"/lint", "text/csv", strings.NewReader(trainsAt(1, "Jul 04 2021 07:42")))
+		require.Nil(t, err)
+		res.Body.Close()
+		assert.EqualValues(t, http.StatusOK, res.StatusCode)
+	})
+
+	t.Run("when a JSON object is larger than the limit", func(t *testing.T) {
+		res, err := http.Post(srv.URL+"/alerts", "application/json", strings.NewReader(`{"severity": "info", "message": "Lifts out of order"}`))
+		require.Nil(t, err)
+		res.Body.Close()
+
+		t.Run("it will be refused", func(t *testing.T) {
+			assert.EqualValues(t, http.StatusBadRequest, res.StatusCode)
+			alerts, err := store.getAlerts()
+			require.Nil(t, err)
+			assert.Len(t, alerts, 0)
+		})
+	})
+
+	t.Run("when a method is not served", func(t *testing.T) {
+		req, _ := http.NewRequest(http.MethodPatch, srv.URL+"/schedules", nil)
+		res, err := http.DefaultClient.Do(req)
+		require.Nil(t, err)
+		res.Body.Close()
+		assert.EqualValues(t, http.StatusMethodNotAllowed, res.StatusCode)
+	})
+}
+
+func TestServerConcurrency(t *testing.T) {
+	store := initTestStore(t)
+	defer tearDownStore(store)
+	srv := httptest.NewServer(newServer(store))
+	defer srv.Close()
+
+	replace := func(count int) error {
+		req, _ := http.NewRequest(http.MethodPut, srv.URL+"/schedules", strings.NewReader(trainsAt(count, "Jul 04 2021 07:42")))
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			return err
+		}
+		res.Body.Close()
+		if res.StatusCode != http.StatusOK {
+			return fmt.Errorf("Replace answered %d", res.StatusCode)
+		}
+		return nil
+	}
+	require.Nil(t, replace(2))
+
+	t.Run("when clients replace and query the schedules at once", func(t *testing.T) {
+		var wg sync.WaitGroup
+		counts := make(chan int, 40)
+		for i := 0; i < 4; i++ {
+			wg.Add(2)
+			go func(i int) {
+				defer wg.Done()
+				for j := 0; j < 5; j++ {
+					assert.Nil(t, replace(2+2*((i+j)%2)))
+				}
+			}(i)
+			go func() {
+				defer wg.Done()
+				for j := 0; j < 10; j++ {
+					res, err := http.Get(srv.URL + "/stops/1/next?time=" + url.QueryEscape("Jul 04 2021 07:42"))
+					if !assert.Nil(t, err) {
+						return
+					}
+					next := NextTrains{}
+					assert.Nil(t, json.NewDecoder(res.Body).Decode(&next))
+					res.Body.Close()
+					counts <- len(next.Trains)
+				}
+			}()
+		}
+		wg.Wait()
+		close(counts)
+
+		t.Run("every query will see a whole upload", func(t *testing.T) {
+			for count := range counts {
+				assert.Contains(t, []int{2, 4}, count)
+			}
+		})
+	})
+}
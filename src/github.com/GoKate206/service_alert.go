@@ -0,0 +1,213 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"time"
+)
+
+var (
+	alertDbName     = "service-alerts"
+	alertSeverities = map[string]int{"info": 0, "warning": 1, "severe": 2}
+)
+
+// ServiceAlert is a disruption notice. It affects any of its stops, routes or
+// trains, one with none of them is network wide. An empty ActiveFrom or
+// ActiveTo leaves that end of the active period open
+type ServiceAlert struct {
+	ID         string   `json:"ID"`
+	StopIDs    []int64  `json:"stopIDs,omitempty"`
+	Routes     []string `json:"routes,omitempty"`
+	TrainIDs   []string `json:"trainIDs,omitempty"`
+	ActiveFrom string   `json:"activeFrom,omitempty"`
+	ActiveTo   string   `json:"activeTo,omitempty"`
+	Severity   string   `json:"severity"`
+	Message    string   `json:"message"`
+}
+
+func newID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+func (a ServiceAlert) validate() error {
+	if _, ok := alertSeverities[a.Severity]; !ok {
+		return fmt.Errorf("Severity must be info, warning or severe, got: %s", a.Severity)
+	}
+	if a.Message == "" {
+		return fmt.Errorf("Alert message is required")
+	}
+
+	for _, value := range []string{a.ActiveFrom, a.ActiveTo} {
+		if value == "" {
+			continue
+		}
+		if _, err := time.Parse(layout, value); err != nil {
+			return err
+		}
+	}
+
+	// an alert ending before it starts would never be active
+	if a.ActiveFrom != "" && a.ActiveTo != "" {
+		from, _ := time.Parse(layout, a.ActiveFrom)
+		to, _ := time.Parse(layout, a.ActiveTo)
+		if to.Before(from) {
+			return fmt.Errorf("Active to must not be before active from: %s - %s", a.ActiveTo, a.ActiveFrom)
+		}
+	}
+
+	return nil
+}
+
+func (a ServiceAlert) activeAt(t time.Time) bool {
+	from, fromErr := time.Parse(layout, a.ActiveFrom)
+	to, toErr := time.Parse(layout, a.ActiveTo)
+
+	return (fromErr != nil || !t.Before(from)) && (toErr != nil || !t.After(to))
+}
+
+// affects reports whether the alert applies to a stop or any of the trains
+func (a ServiceAlert) affects(stopID int64, trains []Schedule) bool {
+	if len(a.StopIDs) == 0 && len(a.Routes) == 0 && len(a.TrainIDs) == 0 {
+		return true
+	}
+
+	for _, id := range a.StopIDs {
+		if id == stopID {
+			return true
+		}
+	}
+
+	for _, train := range trains {
+		for _, route := range a.Routes {
+			if route == train.Route {
+				return true
+			}
+		}
+		for _, trainID := range a.TrainIDs {
+			if trainID == train.TrainID {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+func (s *Store) addAlert(alert ServiceAlert) (ServiceAlert, error) {
+	if err := alert.validate(); err != nil {
+		return alert, err
+	}
+
+	if err := s.lock(); err != nil {
+		return alert, err
+	}
+	defer s.mu.Unlock()
+
+	alert.ID = newID()
+	s.invalidateLocked(alertDbName)
+
+	if err := s.driver.Write(alertDbName, alert.ID, &alert); err != nil {
+		return alert, err
+	}
+	s.publishLocked(alertChange(changeAlertAdded, alert))
+
+	return alert, nil
+}
+
+func (s *Store) deleteAlert(id string) error {
+	if err := s.lock(); err != nil {
+		return err
+	}
+	defer s.mu.Unlock()
+
+	alert := ServiceAlert{}
+	if err := s.driver.Read(alertDbName, id, &alert); err != nil {
+		return fmt.Errorf("Alert not found: %s", id)
+	}
+	s.invalidateLocked(alertDbName)
+
+	if err := s.driver.Delete(alertDbName, id); err != nil {
+		return err
+	}
+	s.publishLocked(alertChange(changeAlertRemoved, alert))
+
+	return nil
+}
+
+func (s *Store) getAlerts() ([]ServiceAlert, error) {
+	if err := s.rlock(); err != nil {
+		return []ServiceAlert{}, err
+	}
+	defer s.mu.RUnlock()
+
+	return s.getAlertsLocked()
+}
+
+// getAlertsLocked returns every alert, cached until an alert is written
+func (s *Store) getAlertsLocked() ([]ServiceAlert, error) {
+	s.cacheMu.Lock()
+	defer s.cacheMu.Unlock()
+
+	if s.alerts != nil {
+		return s.alerts, nil
+	}
+
+	alerts := []ServiceAlert{}
+	bytes, err := s.driver.ReadAll(alertDbName)
+	// ReadAll will error if there are no rows,
+	// only error if there are rows
+	if len(bytes) > 0 && err != nil {
+		return alerts, err
+	}
+
+	for _, b := range bytes {
+		alert := ServiceAlert{}
+		if err := json.Unmarshal(b, &alert); err != nil {
+			return alerts, err
+		}
+		alerts = append(alerts, alert)
+	}
+	s.alerts = alerts
+
+	return alerts, nil
+}
+
+// relevantAlertsLocked returns the alerts affecting a stop query, active when
+// it was asked or when any of its trains arrive, most severe first
+func (s *Store) relevantAlertsLocked(stopID int64, at time.Time, trains []Schedule) ([]ServiceAlert, error) {
+	relevant := []ServiceAlert{}
+	alerts, err := s.getAlertsLocked()
+	if err != nil {
+		return relevant, err
+	}
+
+	times := []time.Time{at}
+	for _, train := range trains {
+		trainTime, _ := time.Parse(layout, train.Time)
+		times = append(times, trainTime)
+	}
+
+	for _, alert := range alerts {
+		if !alert.affects(stopID, trains) {
+			continue
+		}
+
+		for _, t := range times {
+			if alert.activeAt(t) {
+				relevant = append(relevant, alert)
+				break
+			}
+		}
+	}
+
+	sort.SliceStable(relevant, func(i, j int) bool {
+		return alertSeverities[relevant[i].Severity] > alertSeverities[relevant[j].Severity]
+	})
+
+	return relevant, nil
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestServiceAlerts(t *testing.T) {
+	store := initTestStore(t)
+	defer tearDownStore(store)
+	require.Nil(t, store.csvHandler(`stopID,route,trainID,time
+1,"C","865a","Jul 04 2021 07:42"
+1,"55","465a","Jul 04 2021 07:42"
+2,"21","159t","Jul 04 2021 08:00"
+2,"21","kpr5","Jul 04 2021 08:00"`))
+
+	t.Run("when an invalid alert is added", func(t *testing.T) {
+		_, err := store.addAlert(ServiceAlert{Severity: "meh", Message: "Stop closed"})
+		assert.EqualValues(t, "Severity must be info, warning or severe, got: meh", err.Error())
+
+		_, err = store.addAlert(ServiceAlert{Severity: "info"})
+		assert.EqualValues(t, "Alert message is required", err.Error())
+
+		_, err = store.addAlert(ServiceAlert{Severity: "info", Message: "Stop closed", ActiveFrom: "Jul 04 2021 10:00", ActiveTo: "Jul 04 2021 06:00"})
+		assert.EqualValues(t, "Active to must not be before active from: Jul 04 2021 06:00 - Jul 04 2021 10:00", err.Error())
+	})
+
+	closed, err := store.addAlert(ServiceAlert{
+		StopIDs: []int64{1}, Severity: "severe", Message: "Stop 1 is closed",
+		ActiveFrom: "Jul 04 2021 06:00", ActiveTo: "Jul 04 2021 10:00",
+	})
+	require.Nil(t, err)
+	_, err = store.addAlert(ServiceAlert{Routes: []string{"C"}, Severity: "warning", Message: "Route C is on a bus replacement"})
+	require.Nil(t, err)
+	_, err = store.addAlert(ServiceAlert{TrainIDs: []string{"159t"}, Severity: "info", Message: "159t runs short"})
+	require.Nil(t, err)
+
+	t.Run("when trains are requested at an affected stop", func(t *testing.T) {
+		next, err := store.getNextTrains(1, "Jul 04 2021 07:42")
+		require.Nil(t, err)
+
+		t.Run("it will return alerts for the stop and the trains' routes, most severe first", func(t *testing.T) {
+			require.Len(t, next.Alerts, 2)
+			assert.EqualValues(t, "Stop 1 is closed", next.Alerts[0].Message)
+			assert.EqualValues(t, "Route C is on a bus replacement", next.Alerts[1].Message)
+		})
+	})
+
+	t.Run("when trains are requested outside an alert's active period", func(t *testing.T) {
+		next, err := store.getNextTrains(1, "Jul 04 2021 11:00")
+		require.Nil(t, err)
+
+		t.Run("the expired stop alert will not be returned", func(t *testing.T) {
+			assert.Len(t, next.Trains, 0)
+			assert.Len(t, next.Alerts, 0)
+		})
+	})
+
+	t.Run("when trains are requested at another stop", func(t *testing.T) {
+		next, err := store.getNextTrains(2, "Jul 04 2021 08:00")
+		require.Nil(t, err)
+
+		t.Run("it will return the alert for its trains", func(t *testing.T) {
+			require.Len(t, next.Alerts, 1)
+			assert.EqualValues(t, "159t runs short", next.Alerts[0].Message)
+		})
+	})
+
+	t.Run("when an alert is deleted", func(t *testing.T) {
+		require.Nil(t, store.deleteAlert(closed.ID))
+
+		alerts, err := store.getAlerts()
+		require.Nil(t, err)
+		assert.Len(t, alerts, 2)
+
+		err = store.deleteAlert(closed.ID)
+		assert.EqualValues(t, "Alert not found: "+closed.ID, err.Error())
+	})
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	// serviceDayRolloverHour is the hour a new service day starts,
+	// trains before it run on the previous day's service
+	// ex: with 3, a train at Jul 05 02:30 belongs to the Jul 04 service day
+	serviceDayRolloverHour = 0
+	// maxServiceHour bounds GTFS style times, 26:30 is fine 52:00 is not
+	maxServiceHour = 48
+)
+
+// serviceDayOf returns the service day (in dateLayout) a moment belongs to
+func serviceDayOf(t time.Time) string {
+	return t.Add(-time.Duration(serviceDayRolloverHour) * time.Hour).Format(dateLayout)
+}
+
+// parseScheduleTime parses a time in layout and the service day it belongs to.
+// Hours may run past 24:00 GTFS style ( ex: Jul 04 2021 26:30 ), those trains
+// run on the calendar day after but belong to the service day written
+func parseScheduleTime(scheduledTime string) (time.Time, string, error) {
+	if i := strings.LastIndex(scheduledTime, " "); i > 0 {
+		clock := strings.Split(scheduledTime[i+1:], ":")
+		hour, err := strconv.Atoi(clock[0])
+		if err == nil && hour >= 24 && len(clock) == 2 {
+			return parseExtendedTime(scheduledTime[:i], hour, clock[1])
+		}
+	}
+
+	t, err := time.Parse(layout, scheduledTime)
+	if err != nil {
+		return t, "", err
+	}
+
+	return t, serviceDayOf(t), nil
+}
+
+func parseExtendedTime(date string, hour int, minutes string) (time.Time, string, error) {
+	serviceDay, err := time.Parse(dateLayout, date)
+	if err != nil {
+		return time.Time{}, "", err
+	}
+
+	if hour >= maxServiceHour {
+		return time.Time{}, "", fmt.Errorf("Hour must be before %d:00, got: %d", maxServiceHour, hour)
+	}
+
+	if len(minutes) != 2 || minutes[0] < '0' || minutes[0] > '5' || minutes[1] < '0' || minutes[1] > '9' {
+		return time.Time{}, "", fmt.Errorf("Invalid minutes: %s", minutes)
+	}
+	minute, _ := strconv.Atoi(minutes)
+
+	t := serviceDay.Add(time.Duration(hour)*time.Hour + time.Duration(minute)*time.Minute)
+	return t, serviceDay.Format(dateLayout), nil
+}
+
+// scheduleServiceDay is the service day a stored schedule runs on.
+// ServiceDay is only stored when the time was given past 24:00,
+// otherwise it follows serviceDayRolloverHour
+func scheduleServiceDay(schedule Schedule) (string, time.Time, error) {
+	trainTime, err := time.Parse(layout, schedule.Time)
+	if err != nil {
+		return "", trainTime, err
+	}
+
+	if schedule.ServiceDay != "" {
+		return schedule.ServiceDay, trainTime, nil
+	}
+
+	return serviceDayOf(trainTime), trainTime, nil
+}
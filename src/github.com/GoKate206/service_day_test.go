@@ -0,0 +1,124 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseScheduleTime(t *testing.T) {
+	t.Run("when given a time within the day", func(t *testing.T) {
+		trainTime, serviceDay, err := parseScheduleTime("Jul 05 2021 02:30")
+		require.Nil(t, err)
+
+		t.Run("it will belong to the calendar day", func(t *testing.T) {
+			assert.EqualValues(t, "Jul 05 2021 02:30", trainTime.Format(layout))
+			assert.EqualValues(t, "Jul 05 2021", serviceDay)
+		})
+	})
+
+	t.Run("when given a time past 24:00", func(t *testing.T) {
+		trainTime, serviceDay, err := parseScheduleTime("Jul 04 2021 26:30")
+		require.Nil(t, err)
+
+		t.Run("it will run the next calendar day on the given service day", func(t *testing.T) {
+			assert.EqualValues(t, "Jul 05 2021 02:30", trainTime.Format(layout))
+			assert.EqualValues(t, "Jul 04 2021", serviceDay)
+		})
+	})
+
+	t.Run("when given a time past the last service hour", func(t *testing.T) {
+		_, _, err := parseScheduleTime("Jul 04 2021 48:00")
+		assert.EqualValues(t, "Hour must be before 48:00, got: 48", err.Error())
+	})
+
+	t.Run("when given invalid minutes past 24:00", func(t *testing.T) {
+		_, _, err := parseScheduleTime("Jul 04 2021 25:7")
+		assert.EqualValues(t, "Invalid minutes: 7", err.Error())
+	})
+
+	t.Run("when given signed minutes past 24:00", func(t *testing.T) {
+		for _, value := range []string{"Jul 04 2021 25:-5", "Jul 04 2021 25:+5"} {
+			_, _, err := parseScheduleTime(value)
+			require.Error(t, err)
+			assert.EqualValues(t, "Invalid minutes: "+value[len(value)-2:], err.Error())
+		}
+	})
+
+	t.Run("when the rollover hour is set", func(t *testing.T) {
+		defer func(hour int) { serviceDayRolloverHour = hour }(serviceDayRolloverHour)
+		serviceDayRolloverHour = 3
+
+		_, serviceDay, err := parseScheduleTime("Jul 05 2021 02:30")
+		require.Nil(t, err)
+
+		t.Run("trains before it will belong to the previous day", func(t *testing.T) {
+			assert.EqualValues(t, "Jul 04 2021", serviceDay)
+		})
+	})
+}
+
+func TestGetScheduleByServiceDay(t *testing.T) {
+	store := initTestStore(t)
+	defer tearDownStore(store)
+
+	csv := `stopID,route,trainID,time
+1,"55","465a","Jul 04 2021 23:35"
+1,"55","465a","Jul 05 2021 02:30"
+1,"C","314p","Jul 05 2021 02:30"
+1,"21","159t","Jul 04 2021 25:10"
+1,"C","865a","Jul 05 2021 07:14"`
+	store.csvHandler(csv)
+	jul04, _ := time.Parse(layout, "Jul 04 2021 12:00")
+
+	t.Run("given the default rollover at midnight", func(t *testing.T) {
+		schedules, err := store.getScheduleByDate(jul04)
+		require.Nil(t, err)
+
+		t.Run("only trains given past 24:00 join the day before", func(t *testing.T) {
+			require.Len(t, schedules, 2)
+			assert.EqualValues(t, "Jul 04 2021 23:35", schedules[0].Time)
+			assert.EqualValues(t, "Jul 05 2021 01:10", schedules[1].Time)
+			assert.EqualValues(t, "Jul 04 2021", schedules[1].ServiceDay)
+		})
+	})
+
+	t.Run("given a rollover at 03:00", func(t *testing.T) {
+		defer func(hour int) { serviceDayRolloverHour = hour }(serviceDayRolloverHour)
+		serviceDayRolloverHour = 3
+
+		schedules, err := store.getScheduleByDate(jul04)
+		require.Nil(t, err)
+
+		t.Run("after midnight trains are grouped with the Jul 04 service day", func(t *testing.T) {
+			require.Len(t, schedules, 4)
+			assert.EqualValues(t, "Jul 05 2021 02:30", schedules[3].Time)
+		})
+
+		t.Run("when a stop is queried after midnight", func(t *testing.T) {
+			next, err := store.getNextTrains(1, "Jul 05 2021 02:30")
+			require.Nil(t, err)
+
+			t.Run("it will report the service day the trains run on", func(t *testing.T) {
+				assert.EqualValues(t, "Jul 04 2021", next.Date)
+				assert.Len(t, next.Trains, 2)
+			})
+		})
+	})
+
+	t.Run("when a stop is queried with a time past 24:00", func(t *testing.T) {
+		require.Nil(t, store.csvHandler(`stopID,route,trainID,time
+2,"21","159t","Jul 04 2021 25:10"
+2,"C","316p","Jul 04 2021 25:10"`))
+		next, err := store.getNextTrains(2, "Jul 04 2021 25:10")
+		require.Nil(t, err)
+
+		t.Run("it will find the trains of the given service day", func(t *testing.T) {
+			assert.EqualValues(t, "Jul 04 2021", next.Date)
+			require.Len(t, next.Trains, 2)
+			assert.EqualValues(t, "Jul 05 2021 01:10", next.Trains[0].Time)
+		})
+	})
+}
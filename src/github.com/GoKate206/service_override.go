@@ -0,0 +1,308 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"time"
+)
+
+const (
+	statusCancelled = "cancelled"
+	statusExtra     = "extra"
+)
+
+var (
+	cancellationDbName = "cancellations"
+	extraDbName        = "extra-services"
+	// serviceDayCacheDays is how many days either side of today
+	// keep their actual service built between queries
+	serviceDayCacheDays = 14
+)
+
+// Cancellation cancels a train run on a service day,
+// at one stop when StopID is set or at every stop otherwise
+type Cancellation struct {
+	ID         string `json:"ID"`
+	TrainID    string `json:"trainID"`
+	ServiceDay string `json:"serviceDay"`
+	StopID     *int64 `json:"stopID,omitempty"`
+	Reason     string `json:"reason,omitempty"`
+}
+
+func (c Cancellation) cancels(schedule Schedule) bool {
+	return c.TrainID == schedule.TrainID && (c.StopID == nil || *c.StopID == schedule.StopID)
+}
+
+// runningTrains counts the trains that are not cancelled
+func runningTrains(schedules []Schedule) int {
+	running := 0
+	for _, schedule := range schedules {
+		if schedule.Status != statusCancelled {
+			running++
+		}
+	}
+
+	return running
+}
+
+func (s *Store) addCancellation(cancellation Cancellation) (Cancellation, error) {
+	if _, err := s.trainIDRules.validate(cancellation.TrainID); err != nil {
+		return cancellation, err
+	}
+
+	day, err := time.Parse(dateLayout, cancellation.ServiceDay)
+	if err != nil {
+		return cancellation, err
+	}
+	cancellation.ServiceDay = day.Format(dateLayout)
+
+	if err := s.lock(); err != nil {
+		return cancellation, err
+	}
+	defer s.mu.Unlock()
+
+	cancellation.ID = newID()
+	s.invalidateLocked(cancellationDbName)
+
+	if err := s.driver.Write(cancellationDbName, cancellation.ID, &cancellation); err != nil {
+		return cancellation, err
+	}
+	s.publishOverrideLocked(changeOverrideAdded, cancellationDbName, cancellation)
+
+	return cancellation, nil
+}
+
+func (s *Store) getCancellations() ([]Cancellation, error) {
+	if err := s.rlock(); err != nil {
+		return []Cancellation{}, err
+	}
+	defer s.mu.RUnlock()
+
+	return s.getCancellationsLocked()
+}
+
+// getCancellationsLocked returns every cancellation, cached until one is written
+func (s *Store) getCancellationsLocked() ([]Cancellation, error) {
+	s.cacheMu.Lock()
+	defer s.cacheMu.Unlock()
+
+	if s.cancellations != nil {
+		return s.cancellations, nil
+	}
+
+	cancellations := []Cancellation{}
+	bytes, err := s.driver.ReadAll(cancellationDbName)
+	// ReadAll will error if there are no rows,
+	// only error if there are rows
+	if len(bytes) > 0 && err != nil {
+		return cancellations, err
+	}
+
+	for _, b := range bytes {
+		cancellation := Cancellation{}
+		if err := json.Unmarshal(b, &cancellation); err != nil {
+			return cancellations, err
+		}
+		cancellations = append(cancellations, cancellation)
+	}
+	s.cancellations = cancellations
+
+	return cancellations, nil
+}
+
+// addExtraService schedules an unscheduled train, validated as an import row
+func (s *Store) addExtraService(extra Schedule) (Schedule, error) {
+	schedule, err := parseScheduleRecord([]string{strconv.FormatInt(extra.StopID, 10), extra.Route, extra.TrainID, extra.Time}, s.trainIDRules)
+	if err != nil {
+		return schedule, err
+	}
+	if schedule.Wheelchair, err = parseAccessible(extra.Wheelchair); err != nil {
+		return schedule, err
+	}
+	if schedule.Platform, err = parsePlatform(extra.Platform); err != nil {
+		return schedule, err
+	}
+	if schedule.Track, err = parsePlatform(extra.Track); err != nil {
+		return schedule, err
+	}
+	if schedule.Direction, err = parseDirection(extra.Direction); err != nil {
+		return schedule, err
+	}
+	if schedule.Headsign, err = parseHeadsign(extra.Headsign); err != nil {
+		return schedule, err
+	}
+
+	if err := s.lock(); err != nil {
+		return schedule, err
+	}
+	defer s.mu.Unlock()
+
+	schedule.ID = newID()
+	schedule.Status = statusExtra
+	s.invalidateLocked(extraDbName)
+
+	if err := s.driver.Write(extraDbName, schedule.ID, &schedule); err != nil {
+		return schedule, err
+	}
+	s.publishOverrideLocked(changeOverrideAdded, extraDbName, schedule)
+
+	return schedule, nil
+}
+
+func (s *Store) getExtraServices() ([]Schedule, error) {
+	if err := s.rlock(); err != nil {
+		return []Schedule{}, err
+	}
+	defer s.mu.RUnlock()
+
+	return s.readSchedulesLocked(extraDbName)
+}
+
+// deleteOverride removes a cancellation or an extra service by ID
+func (s *Store) deleteOverride(collection string, id string) error {
+	if err := s.lock(); err != nil {
+		return err
+	}
+	defer s.mu.Unlock()
+
+	override := json.RawMessage{}
+	if err := s.driver.Read(collection, id, &override); err != nil {
+		return fmt.Errorf("Not found: %s", id)
+	}
+	s.invalidateLocked(collection)
+
+	if err := s.driver.Delete(collection, id); err != nil {
+		return err
+	}
+	s.publishLocked(s.overrideChangeLocked(changeOverrideRemoved, collection, override))
+
+	return nil
+}
+
+// dayLocked returns the actual service of the day givenDate falls in
+func (s *Store) dayLocked(givenDate time.Time) (*dayIndex, error) {
+	return s.serviceDayLocked(serviceDayOf(givenDate))
+}
+
+// serviceDayLocked returns the actual service of a service day, the
+// timetabled trains with cancellations marked, platform changes applied,
+// extras and frequencies added
+func (s *Store) serviceDayLocked(day string) (*dayIndex, error) {
+	if cached, ok := s.cachedServiceDayLocked(day); ok {
+		return cached, nil
+	}
+
+	base, err := s.baseDayLocked(day)
+	if err != nil {
+		return nil, err
+	}
+
+	extras, err := s.indexLocked(extraDbName)
+	if err != nil {
+		return nil, err
+	}
+
+	cancellations, err := s.getCancellationsLocked()
+	if err != nil {
+		return nil, err
+	}
+
+	todays := []Cancellation{}
+	for _, cancellation := range cancellations {
+		if cancellation.ServiceDay == day {
+			todays = append(todays, cancellation)
+		}
+	}
+
+	frequent, err := s.frequencyDayLocked(day)
+	if err != nil {
+		return nil, err
+	}
+
+	changes, err := s.getPlatformChangesLocked()
+	if err != nil {
+		return nil, err
+	}
+
+	moves := []PlatformChange{}
+	for _, change := range changes {
+		if change.ServiceDay == day {
+			moves = append(moves, change)
+		}
+	}
+
+	actual := base
+	if extra := extras.days[day]; extra != nil || frequent != nil || len(todays) > 0 || len(moves) > 0 {
+		actual = &dayIndex{}
+		for _, part := range []*dayIndex{base, extra, frequent} {
+			if part != nil {
+				actual.schedules = append(actual.schedules, part.schedules...)
+				actual.times = append(actual.times, part.times...)
+			}
+		}
+
+		for i := range actual.schedules {
+			for _, cancellation := range todays {
+				if cancellation.cancels(actual.schedules[i]) {
+					actual.schedules[i].Status = statusCancelled
+				}
+			}
+			for _, move := range moves {
+				if move.applies(actual.schedules[i]) {
+					move.apply(&actual.schedules[i])
+				}
+			}
+		}
+		actual.reindex()
+	}
+
+	s.cacheServiceDayLocked(day, actual)
+
+	return actual, nil
+}
+
+// cacheServiceDayLocked keeps a built day when it has service and is
+// within serviceDayCacheDays of today, dropping days the window has left
+func (s *Store) cacheServiceDayLocked(day string, actual *dayIndex) {
+	if actual == nil || !inServiceDayCache(day) {
+		return
+	}
+
+	s.cacheMu.Lock()
+	defer s.cacheMu.Unlock()
+
+	for cached := range s.serviceDays {
+		if !inServiceDayCache(cached) {
+			delete(s.serviceDays, cached)
+		}
+	}
+	s.serviceDays[day] = actual
+}
+
+// inServiceDayCache tells if a service day is close enough to today's
+// to be cached, days further out are rarely queried twice
+func inServiceDayCache(day string) bool {
+	date, err := time.Parse(dateLayout, day)
+	if err != nil {
+		return false
+	}
+	today, _ := time.Parse(dateLayout, serviceDayOf(timeNow().UTC()))
+
+	days := int(date.Sub(today).Hours() / 24)
+	return days >= -serviceDayCacheDays && days <= serviceDayCacheDays
+}
+
+func (s *Store) cachedServiceDayLocked(day string) (*dayIndex, bool) {
+	s.cacheMu.Lock()
+	defer s.cacheMu.Unlock()
+
+	// days are bucketed with the rollover hour they were built with
+	if s.serviceDaysRollover != serviceDayRolloverHour {
+		s.serviceDays = map[string]*dayIndex{}
+		s.serviceDaysRollover = serviceDayRolloverHour
+	}
+	cached, ok := s.serviceDays[day]
+
+	return cached, ok
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestServiceOverrides(t *testing.T) {
+	store := initTestStore(t)
+	defer tearDownStore(store)
+	require.Nil(t, store.csvHandler(`stopID,route,trainID,time
+1,"C","865a","Jul 04 2021 07:42"
+1,"55","465a","Jul 04 2021 07:42"
+1,"21","159t","Jul 04 2021 07:42"
+2,"C","865a","Jul 04 2021 07:50"
+1,"C","865a","Jul 05 2021 07:42"`))
+	jul04, _ := time.Parse(layout, "Jul 04 2021 12:00")
+	jul05, _ := time.Parse(layout, "Jul 05 2021 12:00")
+
+	t.Run("when an invalid cancellation is added", func(t *testing.T) {
+		_, err := store.addCancellation(Cancellation{TrainID: "865", ServiceDay: "Jul 04 2021"})
+		assert.EqualValues(t, "Train Id is invalid, too few characters: 865", err.Error())
+
+		_, err = store.addCancellation(Cancellation{TrainID: "865a", ServiceDay: "04/07/2021"})
+		assert.Error(t, err)
+	})
+
+	cancelled, err := store.addCancellation(Cancellation{TrainID: "865a", ServiceDay: "Jul 04 2021", Reason: "Crew shortage"})
+	require.Nil(t, err)
+
+	t.Run("when a train run is cancelled", func(t *testing.T) {
+		schedules, err := store.getScheduleByDate(jul04)
+		require.Nil(t, err)
+
+		t.Run("it will be marked cancelled at every stop that day", func(t *testing.T) {
+			require.Len(t, schedules, 4)
+			for _, schedule := range schedules {
+				if schedule.TrainID == "865a" {
+					assert.EqualValues(t, statusCancelled, schedule.Status)
+				} else {
+					assert.EqualValues(t, "", schedule.Status)
+				}
+			}
+		})
+
+		t.Run("other days will run as timetabled", func(t *testing.T) {
+			schedules, err := store.getScheduleByDate(jul05)
+			require.Nil(t, err)
+			require.Len(t, schedules, 1)
+			assert.EqualValues(t, "", schedules[0].Status)
+		})
+
+		t.Run("stop queries will return it marked among the running trains", func(t *testing.T) {
+			trains, err := store.getTrainsByStopAndTime(1, "Jul 04 2021 07:42")
+			require.Nil(t, err)
+			assert.Len(t, trains, 3)
+			assert.EqualValues(t, 2, runningTrains(trains))
+		})
+	})
+
+	t.Run("when a second train at the stop is cancelled", func(t *testing.T) {
+		stopID := int64(1)
+		second, err := store.addCancellation(Cancellation{TrainID: "465a", ServiceDay: "Jul 04 2021", StopID: &stopID})
+		require.Nil(t, err)
+		defer store.deleteOverride(cancellationDbName, second.ID)
+
+		t.Run("one running train will not be enough to return", func(t *testing.T) {
+			trains, err := store.getTrainsByStopAndTime(1, "Jul 04 2021 07:42")
+			require.Nil(t, err)
+			assert.Len(t, trains, 0)
+		})
+	})
+
+	t.Run("when an extra service is added", func(t *testing.T) {
+		extra, err := store.addExtraService(Schedule{StopID: 1, Route: "C", TrainID: "x001", Time: "Jul 04 2021 07:42"})
+		require.Nil(t, err)
+		assert.EqualValues(t, statusExtra, extra.Status)
+
+		t.Run("it will run alongside the timetabled trains", func(t *testing.T) {
+			trains, err := store.getTrainsByStopAndTime(1, "Jul 04 2021 07:42")
+			require.Nil(t, err)
+			require.Len(t, trains, 4)
+			assert.EqualValues(t, 3, runningTrains(trains))
+		})
+
+		t.Run("an invalid extra will be refused like an import row", func(t *testing.T) {
+			_, err := store.addExtraService(Schedule{StopID: 2, Route: "C", TrainID: "x00!", Time: "Jul 04 2021 07:50"})
+			assert.EqualValues(t, "Train Id must be alphanumeric: x00!", err.Error())
+		})
+	})
+
+	t.Run("when a cancellation is removed", func(t *testing.T) {
+		require.Nil(t, store.deleteOverride(cancellationDbName, cancelled.ID))
+
+		schedules, err := store.getScheduleByDate(jul04)
+		require.Nil(t, err)
+		assert.EqualValues(t, len(schedules), runningTrains(schedules))
+	})
+}
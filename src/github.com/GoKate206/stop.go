@@ -0,0 +1,188 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	accessibleYes = "yes"
+	accessibleNo  = "no"
+)
+
+var stopDbName = "stops"
+
+// Stop describes a stop beyond its ID. Wheelchair is yes or no when
+// known, StepFree is level or ramped access from the street to the trains.
+// Lat and Lon are WGS84 degrees, stops without them are never nearby
+type Stop struct {
+	ID         int64    `json:"ID"`
+	Name       string   `json:"name,omitempty"`
+	Wheelchair string   `json:"wheelchair,omitempty"`
+	StepFree   bool     `json:"stepFree,omitempty"`
+	Lat        *float64 `json:"lat,omitempty"`
+	Lon        *float64 `json:"lon,omitempty"`
+}
+
+// AccessOptions narrow a query to what a rider can use
+type AccessOptions struct {
+	Wheelchair bool `json:"wheelchair,omitempty"`
+	StepFree   bool `json:"stepFree,omitempty"`
+}
+
+// parseAccessible reads GTFS style 0, 1 and 2 as well as yes and no
+func parseAccessible(value string) (string, error) {
+	switch strings.ToLower(strings.TrimSpace(value)) {
+	case "", "0", "unknown":
+		return "", nil
+	case "1", "yes", "y", "true":
+		return accessibleYes, nil
+	case "2", "no", "n", "false":
+		return accessibleNo, nil
+	}
+
+	return "", fmt.Errorf("Wheelchair must be yes, no or empty, got: %s", value)
+}
+
+// usable reports whether a rider with the options can use the stop,
+// unknown accessibility is not assumed
+func (o AccessOptions) usable(stop Stop) bool {
+	return (!o.Wheelchair || stop.Wheelchair == accessibleYes) && (!o.StepFree || stop.StepFree)
+}
+
+// filter keeps the trains a rider with the options can board at the stop
+func (o AccessOptions) filter(stop Stop, trains []Schedule) []Schedule {
+	if !o.Wheelchair && !o.StepFree {
+		return trains
+	}
+
+	usable := []Schedule{}
+	if !o.usable(stop) {
+		return usable
+	}
+	for _, train := range trains {
+		if !o.Wheelchair || train.Wheelchair == accessibleYes {
+			usable = append(usable, train)
+		}
+	}
+
+	return usable
+}
+
+func (stop Stop) validate() (Stop, error) {
+	wheelchair, err := parseAccessible(stop.Wheelchair)
+	stop.Wheelchair = wheelchair
+	if err != nil {
+		return stop, err
+	}
+
+	if (stop.Lat == nil) != (stop.Lon == nil) {
+		return stop, fmt.Errorf("Stop needs both lat and lon or neither")
+	}
+	if stop.Lat != nil {
+		return stop, validateCoordinates(*stop.Lat, *stop.Lon)
+	}
+
+	return stop, nil
+}
+
+func (s *Store) saveStop(stop Stop) (Stop, error) {
+	stop, err := stop.validate()
+	if err != nil {
+		return stop, err
+	}
+
+	if err := s.lock(); err != nil {
+		return stop, err
+	}
+	defer s.mu.Unlock()
+
+	s.invalidateLocked(stopDbName)
+
+	if err := s.driver.Write(stopDbName, strconv.FormatInt(stop.ID, 10), &stop); err != nil {
+		return stop, err
+	}
+	s.publishLocked(ChangeEvent{Event: changeStopSaved, StopIDs: []int64{stop.ID}, Count: 1})
+
+	return stop, nil
+}
+
+func (s *Store) getStop(id int64) (Stop, error) {
+	if err := s.rlock(); err != nil {
+		return Stop{}, err
+	}
+	defer s.mu.RUnlock()
+
+	stops, err := s.getStopsLocked()
+	if err != nil {
+		return Stop{}, err
+	}
+	stop, ok := stops[id]
+	if !ok {
+		return Stop{ID: id}, fmt.Errorf("Stop not found: %d", id)
+	}
+
+	return stop, nil
+}
+
+func (s *Store) getStops() ([]Stop, error) {
+	if err := s.rlock(); err != nil {
+		return []Stop{}, err
+	}
+	defer s.mu.RUnlock()
+
+	stops, err := s.getStopsLocked()
+	if err != nil {
+		return []Stop{}, err
+	}
+
+	list := []Stop{}
+	for _, stop := range stops {
+		list = append(list, stop)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].ID < list[j].ID })
+
+	return list, nil
+}
+
+// getStopMap returns the described stops by ID
+func (s *Store) getStopMap() (map[int64]Stop, error) {
+	if err := s.rlock(); err != nil {
+		return map[int64]Stop{}, err
+	}
+	defer s.mu.RUnlock()
+
+	return s.getStopsLocked()
+}
+
+// getStopsLocked returns every described stop by ID, cached until a stop is written
+func (s *Store) getStopsLocked() (map[int64]Stop, error) {
+	s.cacheMu.Lock()
+	defer s.cacheMu.Unlock()
+
+	if s.stops != nil {
+		return s.stops, nil
+	}
+
+	stops := map[int64]Stop{}
+	bytes, err := s.driver.ReadAll(stopDbName)
+	// ReadAll will error if there are no rows,
+	// only error if there are rows
+	if len(bytes) > 0 && err != nil {
+		return stops, err
+	}
+
+	for _, b := range bytes {
+		stop := Stop{}
+		if err := json.Unmarshal(b, &stop); err != nil {
+			return stops, err
+		}
+		stops[stop.ID] = stop
+	}
+	s.stops = stops
+
+	return stops, nil
+}
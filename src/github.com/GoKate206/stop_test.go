@@ -0,0 +1,160 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReadCsvOptionalColumns(t *testing.T) {
+	t.Run("when a wheelchair column follows the expected headers", func(t *testing.T) {
+		schedules, err := readCsv(`stopID,route,trainID,time,wheelchair
+1,"C","865a","Jul 04 2021 07:42",1
+1,"55","465a","Jul 04 2021 07:42",no
+1,"C","866a","Jul 04 2021 08:42",`, defaultTrainIDRules())
+		require.Nil(t, err)
+
+		t.Run("it will read yes, no and unknown", func(t *testing.T) {
+			assert.EqualValues(t, accessibleYes, schedules[0].Wheelchair)
+			assert.EqualValues(t, accessibleNo, schedules[1].Wheelchair)
+			assert.EqualValues(t, "", schedules[2].Wheelchair)
+		})
+	})
+
+	t.Run("when the column is invalid or unknown", func(t *testing.T) {
+		cases := map[string]string{
+			"stopID,route,trainID,time,wheelchair\n1,C,865a,Jul 04 2021 07:42,maybe": "Wheelchair must be yes, no or empty, got: maybe",
+			"stopID,route,trainID,time,notes\n1,C,865a,Jul 04 2021 07:42,x":          "Unexpected header: notes",
+		}
+
+		for csv, expected := range cases {
+			_, err := readCsv(csv, defaultTrainIDRules())
+			require.Error(t, err)
+			assert.EqualValues(t, expected, err.Error())
+		}
+	})
+}
+
+func TestAccessibleQueries(t *testing.T) {
+	store := initTestStore(t)
+	defer tearDownStore(store)
+	require.Nil(t, store.csvHandler(`stopID,route,trainID,time,wheelchair
+1,"C","865a","Jul 04 2021 07:42",yes
+1,"55","465a","Jul 04 2021 07:42",no
+1,"D","965a","Jul 04 2021 07:42",yes
+2,"C","865a","Jul 04 2021 07:50",yes
+2,"D","965a","Jul 04 2021 07:50",yes`))
+	_, err := store.saveStop(Stop{ID: 1, Name: "Central", Wheelchair: "1", StepFree: true})
+	require.Nil(t, err)
+	_, err = store.saveStop(Stop{ID: 2, Name: "Market", Wheelchair: "yes"})
+	require.Nil(t, err)
+
+	t.Run("when asking for accessible trains at an accessible stop", func(t *testing.T) {
+		next, err := store.getNextTrainsFor(1, "Jul 04 2021 07:42", StopQuery{Access: AccessOptions{Wheelchair: true}})
+		require.Nil(t, err)
+
+		t.Run("it will only return accessible trains", func(t *testing.T) {
+			require.Len(t, next.Trains, 2)
+			for _, train := range next.Trains {
+				assert.EqualValues(t, accessibleYes, train.Wheelchair)
+			}
+		})
+	})
+
+	t.Run("when asking for a step-free stop that is not", func(t *testing.T) {
+		next, err := store.getNextTrainsFor(2, "Jul 04 2021 07:50", StopQuery{Access: AccessOptions{StepFree: true}})
+		require.Nil(t, err)
+
+		t.Run("it will return no trains", func(t *testing.T) {
+			assert.Len(t, next.Trains, 0)
+		})
+	})
+
+	t.Run("when only one train arriving together is accessible", func(t *testing.T) {
+		store := initTestStore(t)
+		defer tearDownStore(store)
+		require.Nil(t, store.csvHandler(`stopID,route,trainID,time,wheelchair
+1,"C","865a","Jul 04 2021 07:42",yes
+1,"55","465a","Jul 04 2021 07:42",no
+1,"C","866a","Jul 05 2021 07:42",yes
+1,"55","466a","Jul 05 2021 07:42",no
+1,"C","867a","Jul 05 2021 08:00",yes
+1,"D","967a","Jul 05 2021 08:00",yes`))
+		_, err := store.saveStop(Stop{ID: 1, Name: "Central", Wheelchair: "yes"})
+		require.Nil(t, err)
+		access := StopQuery{Access: AccessOptions{Wheelchair: true}}
+
+		t.Run("it will not answer with the lone train", func(t *testing.T) {
+			next, err := store.getNextTrainsFor(1, "Jul 04 2021 07:42", access)
+			require.Nil(t, err)
+			assert.Len(t, next.Trains, 0)
+		})
+
+		t.Run("it will look on for 2+ accessible trains the next day", func(t *testing.T) {
+			next, err := store.getNextTrainsFor(1, "Jul 04 2021 08:00", access)
+			require.Nil(t, err)
+			require.Len(t, next.Trains, 2)
+			assert.EqualValues(t, "Jul 05 2021", next.Date)
+			assert.EqualValues(t, "867a", next.Trains[0].TrainID)
+			assert.EqualValues(t, "967a", next.Trains[1].TrainID)
+		})
+	})
+
+	t.Run("when a stop has not been described", func(t *testing.T) {
+		assert.False(t, AccessOptions{Wheelchair: true}.usable(Stop{ID: 3}))
+		assert.True(t, AccessOptions{}.usable(Stop{ID: 3}))
+	})
+
+	t.Run("when a schedule is edited", func(t *testing.T) {
+		schedules, err := store.getAllSchedules()
+		require.Nil(t, err)
+		var edited Schedule
+		for _, schedule := range schedules {
+			if schedule.StopID == 2 && schedule.TrainID == "865a" {
+				edited = schedule
+			}
+		}
+		retime := "Jul 04 2021 07:52"
+		updated, err := store.updateSchedule(edited.ID, ScheduleUpdate{Time: &retime})
+		require.Nil(t, err)
+
+		t.Run("it will keep its accessibility", func(t *testing.T) {
+			assert.EqualValues(t, accessibleYes, updated.Wheelchair)
+		})
+	})
+
+	t.Run("when stops are described over the server", func(t *testing.T) {
+		srv := httptest.NewServer(newServer(store))
+		defer srv.Close()
+
+		req, _ := http.NewRequest(http.MethodPut, srv.URL+"/stops/3", strings.NewReader(`{"name": "Harbour", "wheelchair": "2"}`))
+		res, err := http.DefaultClient.Do(req)
+		require.Nil(t, err)
+		defer res.Body.Close()
+		stop := Stop{}
+		require.Nil(t, json.NewDecoder(res.Body).Decode(&stop))
+
+		t.Run("it will normalize and save them", func(t *testing.T) {
+			assert.EqualValues(t, Stop{ID: 3, Name: "Harbour", Wheelchair: accessibleNo}, stop)
+			stops, err := store.getStops()
+			require.Nil(t, err)
+			assert.Len(t, stops, 3)
+		})
+
+		t.Run("next trains can be asked for accessible only", func(t *testing.T) {
+			res, err := http.Get(srv.URL + "/stops/1/next?accessible=true&time=" + url.QueryEscape("Jul 04 2021 07:42"))
+			require.Nil(t, err)
+			defer res.Body.Close()
+
+			next := NextTrains{}
+			require.Nil(t, json.NewDecoder(res.Body).Decode(&next))
+			assert.Len(t, next.Trains, 2)
+		})
+	})
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"time"
+)
+
+var (
+	// streamHeartbeat keeps idle streams open through proxies
+	streamHeartbeat = 30 * time.Second
+	// streamRecheck bounds the wait between updates, for
+	// stops without trains and alerts coming into effect
+	streamRecheck = time.Hour
+	// newStreamTimer makes the one timer a stream waits on, tests swap
+	// it to move the clock
+	newStreamTimer = func() streamTimer { return clockTimer{time.NewTimer(streamRecheck)} }
+	// streamTrains is how many upcoming trains a stream lists
+	streamTrains = 10
+)
+
+// UpcomingTrains are the next trains at a stop from a clock, what a
+// stream sends. Cancelled trains are listed with their status
+type UpcomingTrains struct {
+	StopID int64          `json:"stopID"`
+	Trains []Schedule     `json:"trains"`
+	Alerts []ServiceAlert `json:"alerts,omitempty"`
+}
+
+// getUpcomingTrains lists up to limit trains arriving at a stop from
+// clock on that the query lets through, looking up to lookaheadDays ahead
+func (s *Store) getUpcomingTrains(stopID int64, clock time.Time, limit int, query StopQuery) (UpcomingTrains, error) {
+	upcoming := UpcomingTrains{StopID: stopID, Trains: []Schedule{}}
+	if err := s.rlock(); err != nil {
+		return upcoming, err
+	}
+	defer s.mu.RUnlock()
+
+	stops, err := s.getStopsLocked()
+	if err != nil {
+		return upcoming, err
+	}
+	stop, ok := stops[stopID]
+	if !ok {
+		stop = Stop{ID: stopID}
+	}
+
+	for i := 0; i <= lookaheadDays && len(upcoming.Trains) < limit; i++ {
+		day, err := s.dayLocked(clock.AddDate(0, 0, i))
+		if err != nil {
+			return upcoming, err
+		}
+
+		trains := []Schedule{}
+		for _, n := range day.stopFrom(stopID, clock) {
+			trains = append(trains, day.schedules[n])
+		}
+		trains = query.Access.filter(stop, trains)
+		if query.Direction != "" {
+			trains = inDirection(trains, query.Direction)
+		}
+		upcoming.Trains = append(upcoming.Trains, trains...)
+	}
+	if len(upcoming.Trains) > limit {
+		upcoming.Trains = upcoming.Trains[:limit]
+	}
+
+	alerts, err := s.relevantAlertsLocked(stopID, clock, upcoming.Trains)
+	if len(alerts) > 0 {
+		upcoming.Alerts = alerts
+	}
+
+	return upcoming, err
+}
+
+// streamTimer wakes a stream once reset, each stream resets the same
+// timer rather than leaving one behind per update
+type streamTimer interface {
+	wake() <-chan time.Time
+	reset(d time.Duration)
+	stop()
+}
+
+// clockTimer is a streamTimer on the wall clock
+type clockTimer struct {
+	timer *time.Timer
+}
+
+func (t clockTimer) wake() <-chan time.Time {
+	return t.timer.C
+}
+
+// reset drains a fire that was not waited on, so it cannot wake the
+// stream early once reset
+func (t clockTimer) reset(d time.Duration) {
+	if !t.timer.Stop() {
+		select {
+		case <-t.timer.C:
+		default:
+		}
+	}
+	t.timer.Reset(d)
+}
+
+func (t clockTimer) stop() {
+	t.timer.Stop()
+}
+
+// nextStreamUpdate is how long from now until the first listed train has
+// arrived and drops off the list, at most streamRecheck
+func nextStreamUpdate(trains []Schedule, now time.Time) time.Duration {
+	wait := streamRecheck
+	for _, train := range trains {
+		arrival, _, err := parseScheduleTime(train.Time)
+		if err != nil {
+			continue
+		}
+
+		// trains are listed until the minute after they arrive
+		if until := arrival.Add(time.Minute).Sub(now); until < wait {
+			wait = until
+		}
+	}
+
+	if wait <= 0 {
+		return time.Minute
+	}
+
+	return wait
+}
+
+// writeEvent writes a server-sent event, data must be a single line
+func writeEvent(w io.Writer, id int, event string, data []byte) error {
+	_, err := fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", id, event, data)
+	return err
+}
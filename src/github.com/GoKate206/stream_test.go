@@ -0,0 +1,219 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type streamEvent struct {
+	id       int
+	event    string
+	upcoming UpcomingTrains
+}
+
+type streamWait struct {
+	wait time.Duration
+	wake chan time.Time
+}
+
+// waitTimer hands each reset to the test, which fires it by hand
+type waitTimer struct {
+	waits chan streamWait
+	c     chan time.Time
+}
+
+func (t waitTimer) wake() <-chan time.Time {
+	return t.c
+}
+
+func (t waitTimer) reset(d time.Duration) {
+	t.waits <- streamWait{d, t.c}
+}
+
+func (t waitTimer) stop() {}
+
+// readEvents sends the server-sent events of body until it ends
+func readEvents(t *testing.T, body *bufio.Reader, events chan<- streamEvent) {
+	defer close(events)
+	event := streamEvent{}
+	for {
+		line, err := body.ReadString('\n')
+		if err != nil {
+			return
+		}
+
+		line = strings.TrimSuffix(line, "\n")
+		switch {
+		case line == "":
+			if event.event != "" {
+				events <- event
+			}
+			event = streamEvent{}
+		case strings.HasPrefix(line, "id: "):
+			event.id, _ = strconv.Atoi(strings.TrimPrefix(line, "id: "))
+		case strings.HasPrefix(line, "event: "):
+			event.event = strings.TrimPrefix(line, "event: ")
+		case strings.HasPrefix(line, "data: "):
+			assert.Nil(t, json.Unmarshal([]byte(strings.TrimPrefix(line, "data: ")), &event.upcoming))
+		}
+	}
+}
+
+func streamTrainIDs(upcoming UpcomingTrains) []string {
+	trainIDs := []string{}
+	for _, train := range upcoming.Trains {
+		trainIDs = append(trainIDs, train.TrainID)
+	}
+	return trainIDs
+}
+
+func TestNextStreamUpdate(t *testing.T) {
+	now, _ := time.Parse(layout, "Jul 04 2021 07:40")
+
+	t.Run("when trains are listed", func(t *testing.T) {
+		trains := []Schedule{{Time: "Jul 04 2021 07:50"}, {Time: "Jul 04 2021 07:42"}}
+
+		t.Run("it will wake when the first has arrived", func(t *testing.T) {
+			assert.EqualValues(t, 3*time.Minute, nextStreamUpdate(trains, now))
+		})
+	})
+
+	t.Run("when no trains are listed", func(t *testing.T) {
+		assert.EqualValues(t, streamRecheck, nextStreamUpdate([]Schedule{}, now))
+	})
+}
+
+func TestClockTimer(t *testing.T) {
+	timer := newStreamTimer()
+	defer timer.stop()
+
+	t.Run("when a fire was not waited on", func(t *testing.T) {
+		timer.reset(time.Millisecond)
+		time.Sleep(10 * time.Millisecond)
+		timer.reset(time.Hour)
+
+		t.Run("it will not wake early once reset", func(t *testing.T) {
+			select {
+			case <-timer.wake():
+				t.Fatal("woke from the fire before the reset")
+			case <-time.After(20 * time.Millisecond):
+			}
+		})
+	})
+}
+
+func TestStream(t *testing.T) {
+	store := initTestStore(t)
+	defer tearDownStore(store)
+	require.Nil(t, store.csvHandler(`stopID,route,trainID,time
+1,"C","865a","Jul 04 2021 07:42"
+1,"C","866a","Jul 04 2021 07:50"
+1,"C","867a","Jul 04 2021 08:10"
+2,"C","865a","Jul 04 2021 07:50"`))
+
+	var clockMu sync.Mutex
+	clock, _ := time.Parse(layout, "Jul 04 2021 07:40")
+	setClock := func(value string) {
+		clockMu.Lock()
+		defer clockMu.Unlock()
+		clock, _ = time.Parse(layout, value)
+	}
+	now, newTimer := timeNow, newStreamTimer
+	waits := make(chan streamWait, 16)
+	timeNow = func() time.Time {
+		clockMu.Lock()
+		defer clockMu.Unlock()
+		return clock
+	}
+	newStreamTimer = func() streamTimer {
+		return waitTimer{waits: waits, c: make(chan time.Time, 1)}
+	}
+	defer func() { timeNow, newStreamTimer = now, newTimer }()
+
+	handler := newServer(store)
+	srv := httptest.NewServer(handler)
+	defer srv.Close()
+
+	res, err := http.Get(srv.URL + "/stops/1/stream")
+	require.Nil(t, err)
+	defer res.Body.Close()
+	require.EqualValues(t, "text/event-stream", res.Header.Get("Content-Type"))
+
+	events := make(chan streamEvent)
+	go readEvents(t, bufio.NewReader(res.Body), events)
+
+	t.Run("when a stream opens", func(t *testing.T) {
+		event := <-events
+		wait := <-waits
+
+		t.Run("it will send the upcoming trains", func(t *testing.T) {
+			assert.EqualValues(t, 1, event.id)
+			assert.EqualValues(t, "trains", event.event)
+			assert.EqualValues(t, []string{"865a", "866a", "867a"}, streamTrainIDs(event.upcoming))
+		})
+
+		t.Run("it will wait until the first train has arrived", func(t *testing.T) {
+			assert.EqualValues(t, 3*time.Minute, wait.wait)
+		})
+
+		setClock("Jul 04 2021 07:43")
+		wait.wake <- time.Time{}
+	})
+
+	t.Run("when the clock crosses an arrival", func(t *testing.T) {
+		event := <-events
+		<-waits
+
+		t.Run("it will send the list without the train", func(t *testing.T) {
+			assert.EqualValues(t, 2, event.id)
+			assert.EqualValues(t, []string{"866a", "867a"}, streamTrainIDs(event.upcoming))
+		})
+	})
+
+	t.Run("when a train at the stop is cancelled", func(t *testing.T) {
+		_, err := store.addCancellation(Cancellation{TrainID: "866a", ServiceDay: "Jul 04 2021"})
+		require.Nil(t, err)
+		event := <-events
+		<-waits
+
+		t.Run("it will send the train as cancelled", func(t *testing.T) {
+			assert.EqualValues(t, 3, event.id)
+			assert.EqualValues(t, statusCancelled, event.upcoming.Trains[0].Status)
+		})
+	})
+
+	t.Run("when changes leave the list as it was", func(t *testing.T) {
+		_, err := store.saveStop(Stop{ID: 1, Name: "Central"})
+		require.Nil(t, err)
+		<-waits
+		_, err = store.addAlert(ServiceAlert{StopIDs: []int64{1}, Severity: "warning", Message: "Lifts out of order"})
+		require.Nil(t, err)
+		event := <-events
+		<-waits
+
+		t.Run("it will only send the next list that differs", func(t *testing.T) {
+			assert.EqualValues(t, 4, event.id)
+			require.Len(t, event.upcoming.Alerts, 1)
+			assert.EqualValues(t, "Lifts out of order", event.upcoming.Alerts[0].Message)
+		})
+	})
+
+	t.Run("when the server shuts down", func(t *testing.T) {
+		handler.shutdown()
+		_, open := <-events
+
+		t.Run("it will end the stream", func(t *testing.T) {
+			assert.False(t, open)
+		})
+	})
+}
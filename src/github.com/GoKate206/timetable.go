@@ -0,0 +1,324 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"sort"
+	"strings"
+	"time"
+)
+
+// TimetableEntry is an arrival in an hour of a stop timetable, Label is
+// its minute with the route when the stop has more than one, in
+// brackets when the train is cancelled
+type TimetableEntry struct {
+	Minute    int    `json:"minute"`
+	Route     string `json:"route"`
+	TrainID   string `json:"trainID"`
+	Cancelled bool   `json:"cancelled,omitempty"`
+	Label     string `json:"label"`
+}
+
+// TimetableHour counts from midnight of the service day, trains
+// after midnight are in hour 24 and on
+type TimetableHour struct {
+	Hour    int              `json:"hour"`
+	Entries []TimetableEntry `json:"entries"`
+}
+
+// StopTimetable is the stop by hour grid posted at a station
+type StopTimetable struct {
+	StopID int64           `json:"stopID"`
+	Date   string          `json:"date"`
+	Hours  []TimetableHour `json:"hours"`
+}
+
+// RouteTrain is a column of a route timetable, Times line up with its Stops
+// and are empty where the train does not call
+type RouteTrain struct {
+	TrainID   string   `json:"trainID"`
+	Times     []string `json:"times"`
+	Cancelled bool     `json:"cancelled,omitempty"`
+}
+
+// RouteTimetable is the route by stop matrix, stops in the order the
+// trains call at them and trains in the order they start
+type RouteTimetable struct {
+	Route  string       `json:"route"`
+	Date   string       `json:"date"`
+	Stops  []int64      `json:"stops"`
+	Trains []RouteTrain `json:"trains"`
+}
+
+// printableTimetable is a timetable laid out as monospaced lines
+type printableTimetable interface {
+	title() string
+	lines() []string
+}
+
+var timetableContentTypes = map[string]string{
+	"":     "application/json",
+	"json": "application/json",
+	"text": "text/plain; charset=utf-8",
+	"html": "text/html; charset=utf-8",
+	"pdf":  "application/pdf",
+}
+
+// serviceDayStart is midnight of the service day a schedule runs on
+func serviceDayStart(date time.Time) time.Time {
+	return time.Date(date.Year(), date.Month(), date.Day(), 0, 0, 0, 0, time.UTC)
+}
+
+// timetableSchedules returns the day's actual service from the same
+// query as getScheduleByDate
+func (s *Store) timetableSchedules(date time.Time) ([]Schedule, error) {
+	return s.getScheduleByDate(date.Add(time.Duration(serviceDayRolloverHour) * time.Hour))
+}
+
+func (s *Store) buildStopTimetable(stopID int64, date time.Time) (StopTimetable, error) {
+	timetable := StopTimetable{StopID: stopID, Date: date.Format(dateLayout), Hours: []TimetableHour{}}
+	schedules, err := s.timetableSchedules(date)
+	if err != nil {
+		return timetable, err
+	}
+
+	routes := map[string]bool{}
+	atStop := []Schedule{}
+	for _, schedule := range schedules {
+		if schedule.StopID == stopID {
+			atStop = append(atStop, schedule)
+			routes[schedule.Route] = true
+		}
+	}
+
+	times := map[string]time.Time{}
+	for _, schedule := range atStop {
+		times[schedule.Time], _ = time.Parse(layout, schedule.Time)
+	}
+	// trains at the same minute are listed by route
+	sort.SliceStable(atStop, func(i, j int) bool {
+		a, b := times[atStop[i].Time], times[atStop[j].Time]
+		return a.Before(b) || (a.Equal(b) && atStop[i].Route < atStop[j].Route)
+	})
+
+	start := serviceDayStart(date)
+	for _, schedule := range atStop {
+		at := times[schedule.Time]
+		elapsed := int(at.Sub(start).Minutes())
+		entry := TimetableEntry{
+			Minute:    elapsed % 60,
+			Route:     schedule.Route,
+			TrainID:   schedule.TrainID,
+			Cancelled: schedule.Status == statusCancelled,
+			Label:     fmt.Sprintf("%02d", elapsed%60),
+		}
+		if len(routes) > 1 {
+			entry.Label += "/" + schedule.Route
+		}
+		if entry.Cancelled {
+			entry.Label = "(" + entry.Label + ")"
+		}
+
+		hour := elapsed / 60
+		if n := len(timetable.Hours); n == 0 || timetable.Hours[n-1].Hour != hour {
+			timetable.Hours = append(timetable.Hours, TimetableHour{Hour: hour})
+		}
+		last := &timetable.Hours[len(timetable.Hours)-1]
+		last.Entries = append(last.Entries, entry)
+	}
+
+	return timetable, nil
+}
+
+func (s *Store) buildRouteTimetable(route string, date time.Time) (RouteTimetable, error) {
+	timetable := RouteTimetable{Route: route, Date: date.Format(dateLayout), Stops: []int64{}, Trains: []RouteTrain{}}
+	schedules, err := s.timetableSchedules(date)
+	if err != nil {
+		return timetable, err
+	}
+
+	// schedules come sorted by time, so runs are in calling order
+	runs := map[string][]Schedule{}
+	trainIDs := []string{}
+	for _, schedule := range schedules {
+		if schedule.Route != route {
+			continue
+		}
+		if _, ok := runs[schedule.TrainID]; !ok {
+			trainIDs = append(trainIDs, schedule.TrainID)
+		}
+		runs[schedule.TrainID] = append(runs[schedule.TrainID], schedule)
+	}
+
+	// merge the calling orders, longest runs first, placing a new stop
+	// after the one the train called at before it
+	longest := append([]string{}, trainIDs...)
+	sort.SliceStable(longest, func(i, j int) bool { return len(runs[longest[i]]) > len(runs[longest[j]]) })
+	position := map[int64]int{}
+	for _, trainID := range longest {
+		previous := -1
+		for _, schedule := range runs[trainID] {
+			if i, ok := position[schedule.StopID]; ok {
+				previous = i
+				continue
+			}
+
+			previous++
+			timetable.Stops = append(timetable.Stops, 0)
+			copy(timetable.Stops[previous+1:], timetable.Stops[previous:])
+			timetable.Stops[previous] = schedule.StopID
+			for i, stopID := range timetable.Stops {
+				position[stopID] = i
+			}
+		}
+	}
+
+	for _, trainID := range trainIDs {
+		train := RouteTrain{TrainID: trainID, Times: make([]string, len(timetable.Stops)), Cancelled: true}
+		for _, schedule := range runs[trainID] {
+			at, _ := time.Parse(layout, schedule.Time)
+			if i := position[schedule.StopID]; train.Times[i] == "" {
+				train.Times[i] = at.Format("15:04")
+			}
+			train.Cancelled = train.Cancelled && schedule.Status == statusCancelled
+		}
+		timetable.Trains = append(timetable.Trains, train)
+	}
+
+	return timetable, nil
+}
+
+func (t StopTimetable) title() string {
+	return fmt.Sprintf("Stop %d timetable %s", t.StopID, t.Date)
+}
+
+func (t StopTimetable) lines() []string {
+	lines := []string{}
+	cancelled := false
+	for _, hour := range t.Hours {
+		labels := []string{}
+		for _, entry := range hour.Entries {
+			labels = append(labels, entry.Label)
+			cancelled = cancelled || entry.Cancelled
+		}
+		lines = append(lines, fmt.Sprintf("%02d | %s", hour.Hour, strings.Join(labels, " ")))
+	}
+
+	if len(lines) == 0 {
+		return []string{"No trains scheduled"}
+	}
+	if cancelled {
+		lines = append(lines, "", "( ) cancelled")
+	}
+
+	return lines
+}
+
+func (t RouteTimetable) title() string {
+	return fmt.Sprintf("Route %s timetable %s", t.Route, t.Date)
+}
+
+// lines lay the stops down the side and the trains across
+func (t RouteTimetable) lines() []string {
+	if len(t.Trains) == 0 {
+		return []string{"No trains scheduled"}
+	}
+
+	header := fmt.Sprintf("%-10s", "Train")
+	cancelled := false
+	for _, train := range t.Trains {
+		trainID := train.TrainID
+		if train.Cancelled {
+			trainID += "*"
+			cancelled = true
+		}
+		header += fmt.Sprintf(" %-6s", trainID)
+	}
+	lines := []string{strings.TrimRight(header, " ")}
+
+	for i, stopID := range t.Stops {
+		line := fmt.Sprintf("%-10s", fmt.Sprintf("Stop %d", stopID))
+		for _, train := range t.Trains {
+			at := train.Times[i]
+			if at == "" {
+				at = "  |"
+			}
+			line += fmt.Sprintf(" %-6s", at)
+		}
+		lines = append(lines, strings.TrimRight(line, " "))
+	}
+
+	if cancelled {
+		lines = append(lines, "", "* cancelled")
+	}
+
+	return lines
+}
+
+var stopTimetableTemplate = template.Must(template.New("stop").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>{{.Title}}</title>
+<style>table { border-collapse: collapse } th, td { border: 1px solid #000; padding: 2px 6px; text-align: left }</style>
+</head>
+<body>
+<h1>{{.Title}}</h1>
+<table>
+<tr><th>Hour</th><th>Minutes</th></tr>
+{{- range .Timetable.Hours}}
+<tr><th>{{printf "%02d" .Hour}}</th><td>{{range .Entries}}{{.Label}} {{end}}</td></tr>
+{{- else}}
+<tr><td colspan="2">No trains scheduled</td></tr>
+{{- end}}
+</table>
+</body>
+</html>
+`))
+
+var routeTimetableTemplate = template.Must(template.New("route").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>{{.Title}}</title>
+<style>table { border-collapse: collapse } th, td { border: 1px solid #000; padding: 2px 6px; text-align: center }</style>
+</head>
+<body>
+<h1>{{.Title}}</h1>
+<table>
+<tr><th>Train</th>{{range .Timetable.Trains}}<th>{{.TrainID}}{{if .Cancelled}} cancelled{{end}}</th>{{end}}</tr>
+{{- range $i, $stop := .Timetable.Stops}}
+<tr><th>Stop {{$stop}}</th>{{range $.Timetable.Trains}}<td>{{index .Times $i}}</td>{{end}}</tr>
+{{- end}}
+</table>
+</body>
+</html>
+`))
+
+// renderTimetable renders a timetable as json, text, html or pdf
+func renderTimetable(timetable printableTimetable, format string) ([]byte, error) {
+	switch format {
+	case "", "json":
+		return json.MarshalIndent(timetable, "", "\t")
+	case "text":
+		return []byte(timetable.title() + "\n\n" + strings.Join(timetable.lines(), "\n") + "\n"), nil
+	case "pdf":
+		return renderPDF(timetable.title(), timetable.lines()), nil
+	case "html":
+		tmpl := stopTimetableTemplate
+		if _, ok := timetable.(RouteTimetable); ok {
+			tmpl = routeTimetableTemplate
+		}
+
+		var b bytes.Buffer
+		err := tmpl.Execute(&b, struct {
+			Title     string
+			Timetable interface{}
+		}{timetable.title(), timetable})
+		return b.Bytes(), err
+	}
+
+	return nil, fmt.Errorf("Unknown timetable format: %s", format)
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTimetables(t *testing.T) {
+	store := initTestStore(t)
+	defer tearDownStore(store)
+	require.Nil(t, store.csvHandler(`stopID,route,trainID,time
+1,"C","865a","Jul 04 2021 07:42"
+2,"C","865a","Jul 04 2021 07:50"
+3,"C","865a","Jul 04 2021 08:05"
+1,"C","866a","Jul 04 2021 07:12"
+3,"C","866a","Jul 04 2021 07:35"
+2,"C","867a","Jul 04 2021 25:10"
+1,"55","465a","Jul 04 2021 07:42"`))
+	_, err := store.addCancellation(Cancellation{TrainID: "866a", ServiceDay: "Jul 04 2021"})
+	require.Nil(t, err)
+	date, _ := time.Parse(dateLayout, "Jul 04 2021")
+
+	t.Run("when building a stop timetable", func(t *testing.T) {
+		timetable, err := store.buildStopTimetable(1, date)
+		require.Nil(t, err)
+
+		t.Run("it will group minutes by hour with routes and cancellations", func(t *testing.T) {
+			assert.EqualValues(t, []string{"07 | (12/C) 42/55 42/C", "", "( ) cancelled"}, timetable.lines())
+		})
+	})
+
+	t.Run("when a train runs past midnight", func(t *testing.T) {
+		timetable, err := store.buildStopTimetable(2, date)
+		require.Nil(t, err)
+
+		t.Run("it will be in an hour past 24", func(t *testing.T) {
+			assert.EqualValues(t, []string{"07 | 50", "25 | 10"}, timetable.lines())
+		})
+	})
+
+	t.Run("when building a route timetable", func(t *testing.T) {
+		timetable, err := store.buildRouteTimetable("C", date)
+		require.Nil(t, err)
+
+		t.Run("it will order stops by calling order and trains by start", func(t *testing.T) {
+			assert.EqualValues(t, []int64{1, 2, 3}, timetable.Stops)
+			assert.EqualValues(t, []string{
+				"Train      866a*  865a   867a",
+				"Stop 1     07:12  07:42    |",
+				"Stop 2       |    07:50  01:10",
+				"Stop 3     07:35  08:05    |",
+				"",
+				"* cancelled",
+			}, timetable.lines())
+		})
+	})
+
+	t.Run("when rendered as html", func(t *testing.T) {
+		timetable, _ := store.buildRouteTimetable("C", date)
+		html, err := renderTimetable(timetable, "html")
+		require.Nil(t, err)
+
+		t.Run("it will be a table of the matrix", func(t *testing.T) {
+			assert.Contains(t, string(html), "<h1>Route C timetable Jul 04 2021</h1>")
+			assert.Contains(t, string(html), "<tr><th>Stop 2</th><td></td><td>07:50</td><td>01:10</td></tr>")
+		})
+	})
+
+	t.Run("when a timetable is requested from the server as a pdf", func(t *testing.T) {
+		srv := httptest.NewServer(newServer(store))
+		defer srv.Close()
+		res, err := http.Get(srv.URL + "/stops/1/timetable?format=pdf&date=" + strings.Replace("Jul 04 2021", " ", "%20", -1))
+		require.Nil(t, err)
+		defer res.Body.Close()
+
+		t.Run("it will serve a pdf", func(t *testing.T) {
+			assert.EqualValues(t, "application/pdf", res.Header.Get("Content-Type"))
+			var b bytes.Buffer
+			b.ReadFrom(res.Body)
+			assert.True(t, strings.HasPrefix(b.String(), "%PDF-1.4"))
+		})
+	})
+}
+
+func TestRenderPDF(t *testing.T) {
+	lines := []string{}
+	for i := 0; i < 100; i++ {
+		lines = append(lines, fmt.Sprintf("line (%d)", i))
+	}
+	pdf := string(renderPDF("Route C timetable", lines))
+
+	t.Run("it will split lines over pages", func(t *testing.T) {
+		assert.Contains(t, pdf, "/Count 3")
+		assert.Contains(t, pdf, `(line \(99\)) Tj T*`)
+	})
+
+	t.Run("it will point the xref at each object", func(t *testing.T) {
+		offsets := regexp.MustCompile(`(\d{10}) 00000 n `).FindAllStringSubmatch(pdf, -1)
+		require.NotEmpty(t, offsets)
+		for i, match := range offsets {
+			offset, _ := strconv.Atoi(match[1])
+			assert.True(t, strings.HasPrefix(pdf[offset:], fmt.Sprintf("%d 0 obj", i+1)))
+		}
+
+		start := regexp.MustCompile(`startxref\n(\d+)`).FindStringSubmatch(pdf)
+		xref, _ := strconv.Atoi(start[1])
+		assert.True(t, strings.HasPrefix(pdf[xref:], "xref"))
+	})
+}
@@ -0,0 +1,253 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"time"
+)
+
+var versionDbName = "timetable-versions"
+
+// TimetableVersion is one imported timetable. Once activated it is in effect
+// from EffectiveFrom until a later activated version takes over
+type TimetableVersion struct {
+	ID            string `json:"ID"`
+	EffectiveFrom string `json:"effectiveFrom"` // service day, dateLayout
+	ImportedAt    string `json:"importedAt"`
+	Trains        int    `json:"trains"`
+	Active        bool   `json:"active"`
+	ActivatedAt   string `json:"activatedAt,omitempty"`
+	// Activation orders versions effective on the same day,
+	// the last activated wins
+	Activation int `json:"activation,omitempty"`
+}
+
+func versionCollection(versionID string) string {
+	return fmt.Sprintf("timetable-%s", versionID)
+}
+
+func (s *Store) getVersions() ([]TimetableVersion, error) {
+	if err := s.rlock(); err != nil {
+		return []TimetableVersion{}, err
+	}
+	defer s.mu.RUnlock()
+
+	return s.getVersionsLocked()
+}
+
+// getVersionsLocked returns the versions by ID, cached until a version is written
+func (s *Store) getVersionsLocked() ([]TimetableVersion, error) {
+	s.cacheMu.Lock()
+	defer s.cacheMu.Unlock()
+
+	if s.versions != nil {
+		return append([]TimetableVersion{}, s.versions...), nil
+	}
+
+	versions := []TimetableVersion{}
+	bytes, err := s.driver.ReadAll(versionDbName)
+	// ReadAll will error if there are no rows,
+	// only error if there are rows
+	if len(bytes) > 0 && err != nil {
+		return versions, err
+	}
+
+	for _, b := range bytes {
+		version := TimetableVersion{}
+		if err := json.Unmarshal(b, &version); err != nil {
+			return versions, err
+		}
+		versions = append(versions, version)
+	}
+
+	sort.Slice(versions, func(i, j int) bool { return versions[i].ID < versions[j].ID })
+	s.versions = versions
+
+	return append([]TimetableVersion{}, versions...), nil
+}
+
+func (s *Store) getVersionLocked(versionID string) (TimetableVersion, error) {
+	version := TimetableVersion{}
+	if err := s.driver.Read(versionDbName, versionID, &version); err != nil {
+		return version, fmt.Errorf("Timetable version not found: %s", versionID)
+	}
+
+	return version, nil
+}
+
+// importTimetable lints a CSV and stores it as a new inactive version
+// unless the report blocks it, it has no effect on queries until activated
+func (s *Store) importTimetable(givenCsv string, rules TrainIDRules, effectiveFrom string, cfg LintConfig) (TimetableVersion, LintReport, error) {
+	effective, err := time.Parse(dateLayout, effectiveFrom)
+	if err != nil {
+		return TimetableVersion{}, LintReport{}, err
+	}
+
+	schedules, report, err := s.lintCsv(givenCsv, rules, cfg)
+	if err != nil {
+		return TimetableVersion{}, report, err
+	}
+
+	if err := s.lock(); err != nil {
+		return TimetableVersion{}, report, err
+	}
+	defer s.mu.Unlock()
+
+	versions, err := s.getVersionsLocked()
+	if err != nil {
+		return TimetableVersion{}, report, err
+	}
+
+	version := TimetableVersion{
+		ID:            fmt.Sprintf("v%04d", len(versions)+1),
+		EffectiveFrom: effective.Format(dateLayout),
+		ImportedAt:    timeNow().Format(layout),
+		Trains:        len(schedules),
+	}
+
+	for i, schedule := range schedules {
+		schedule.ID = fmt.Sprintf("%d_%s", i, schedule.TrainID)
+		if err := s.driver.Write(versionCollection(version.ID), schedule.ID, &schedule); err != nil {
+			return version, report, err
+		}
+	}
+	s.invalidateLocked(versionCollection(version.ID))
+
+	return version, report, s.writeVersionLocked(version)
+}
+
+func (s *Store) writeVersionLocked(version TimetableVersion) error {
+	s.invalidateLocked(versionDbName)
+	return s.driver.Write(versionDbName, version.ID, &version)
+}
+
+func (s *Store) activateVersion(versionID string) (TimetableVersion, error) {
+	if err := s.lock(); err != nil {
+		return TimetableVersion{}, err
+	}
+	defer s.mu.Unlock()
+
+	version, err := s.getVersionLocked(versionID)
+	if err != nil {
+		return version, err
+	}
+
+	versions, err := s.getVersionsLocked()
+	if err != nil {
+		return version, err
+	}
+
+	for _, v := range versions {
+		if v.Activation >= version.Activation {
+			version.Activation = v.Activation + 1
+		}
+	}
+	version.Active = true
+	version.ActivatedAt = timeNow().Format(layout)
+
+	if err := s.writeVersionLocked(version); err != nil {
+		return version, err
+	}
+	s.publishLocked(ChangeEvent{Event: changeTimetableActivated, Count: version.Trains})
+
+	return version, nil
+}
+
+// rollbackVersion takes a version out of effect, the version
+// that was in effect before it is used again
+func (s *Store) rollbackVersion(versionID string) (TimetableVersion, error) {
+	if err := s.lock(); err != nil {
+		return TimetableVersion{}, err
+	}
+	defer s.mu.Unlock()
+
+	version, err := s.getVersionLocked(versionID)
+	if err != nil {
+		return version, err
+	}
+
+	if !version.Active {
+		return version, fmt.Errorf("Timetable version is not active: %s", versionID)
+	}
+	version.Active = false
+	version.ActivatedAt = ""
+
+	if err := s.writeVersionLocked(version); err != nil {
+		return version, err
+	}
+	s.publishLocked(ChangeEvent{Event: changeTimetableRolledBack, Count: version.Trains})
+
+	return version, nil
+}
+
+// previewVersion returns a version's trains for the service day
+// givenDate falls in, whether or not the version is active
+func (s *Store) previewVersion(versionID string, givenDate time.Time) ([]Schedule, error) {
+	if err := s.rlock(); err != nil {
+		return []Schedule{}, err
+	}
+	defer s.mu.RUnlock()
+
+	if _, err := s.getVersionLocked(versionID); err != nil {
+		return []Schedule{}, err
+	}
+
+	return s.getServiceDayScheduleLocked(versionCollection(versionID), serviceDayOf(givenDate))
+}
+
+// getVersionAsOf returns the active version in effect on a service day,
+// found is false when no version covers it
+func (s *Store) getVersionAsOf(day string) (TimetableVersion, bool, error) {
+	if err := s.rlock(); err != nil {
+		return TimetableVersion{}, false, err
+	}
+	defer s.mu.RUnlock()
+
+	return s.getVersionAsOfLocked(day)
+}
+
+func (s *Store) getVersionAsOfLocked(day string) (TimetableVersion, bool, error) {
+	asOf, err := time.Parse(dateLayout, day)
+	if err != nil {
+		return TimetableVersion{}, false, err
+	}
+
+	versions, err := s.getVersionsLocked()
+	if err != nil {
+		return TimetableVersion{}, false, err
+	}
+
+	var (
+		inEffect  TimetableVersion
+		found     bool
+		effective time.Time
+	)
+	for _, v := range versions {
+		from, err := time.Parse(dateLayout, v.EffectiveFrom)
+		if err != nil {
+			return inEffect, false, err
+		}
+
+		if !v.Active || from.After(asOf) {
+			continue
+		}
+
+		if !found || from.After(effective) || (from.Equal(effective) && v.Activation > inEffect.Activation) {
+			inEffect, found, effective = v, true, from
+		}
+	}
+
+	return inEffect, found, nil
+}
+
+// scheduleCollectionFor is where the trains of a service day are read from,
+// uploads outside of versioning are used when no version is in effect
+func (s *Store) scheduleCollectionForLocked(day string) (string, error) {
+	version, found, err := s.getVersionAsOfLocked(day)
+	if err != nil || !found {
+		return scheduleDbName, err
+	}
+
+	return versionCollection(version.ID), nil
+}
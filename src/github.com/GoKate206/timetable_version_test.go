@@ -0,0 +1,196 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTimetableVersions(t *testing.T) {
+	store := initTestStore(t)
+	defer tearDownStore(store)
+
+	summer := `stopID,route,trainID,time
+1,"C","865a","Jul 04 2021 07:42"
+1,"55","465a","Jul 04 2021 07:42"
+1,"C","865a","Jul 10 2021 07:42"
+1,"55","465a","Jul 10 2021 07:42"`
+	retimed := `stopID,route,trainID,time
+1,"C","865a","Jul 10 2021 08:00"
+1,"55","465a","Jul 10 2021 08:00"`
+	jul04, _ := time.Parse(layout, "Jul 04 2021 12:00")
+	jul10, _ := time.Parse(layout, "Jul 10 2021 12:00")
+
+	t.Run("when a timetable is imported with an invalid effective date", func(t *testing.T) {
+		_, _, err := store.importTimetable(summer, store.trainIDRules, "2021-07-04", defaultLintConfig())
+		assert.Error(t, err)
+	})
+
+	first, _, err := store.importTimetable(summer, store.trainIDRules, "Jul 01 2021", defaultLintConfig())
+	require.Nil(t, err)
+	second, _, err := store.importTimetable(retimed, store.trainIDRules, "Jul 08 2021", defaultLintConfig())
+	require.Nil(t, err)
+
+	t.Run("when timetables are imported", func(t *testing.T) {
+		t.Run("they will be numbered in order and inactive", func(t *testing.T) {
+			assert.EqualValues(t, "v0001", first.ID)
+			assert.EqualValues(t, "v0002", second.ID)
+			assert.EqualValues(t, 4, first.Trains)
+			assert.False(t, first.Active)
+		})
+
+		t.Run("queries will not see them until activated", func(t *testing.T) {
+			schedules, err := store.getScheduleByDate(jul04)
+			require.Nil(t, err)
+			assert.Len(t, schedules, 0)
+		})
+
+		t.Run("an inactive version can be previewed", func(t *testing.T) {
+			schedules, err := store.previewVersion(second.ID, jul10)
+			require.Nil(t, err)
+			require.Len(t, schedules, 2)
+			assert.EqualValues(t, "Jul 10 2021 08:00", schedules[0].Time)
+		})
+	})
+
+	t.Run("when both versions are activated", func(t *testing.T) {
+		_, err := store.activateVersion(first.ID)
+		require.Nil(t, err)
+		_, err = store.activateVersion(second.ID)
+		require.Nil(t, err)
+
+		t.Run("each date will use the version in effect as of that date", func(t *testing.T) {
+			schedules, err := store.getScheduleByDate(jul04)
+			require.Nil(t, err)
+			assert.Len(t, schedules, 2)
+
+			version, found, err := store.getVersionAsOf("Jul 10 2021")
+			require.Nil(t, err)
+			assert.True(t, found)
+			assert.EqualValues(t, second.ID, version.ID)
+
+			trains, err := store.getTrainsByStopAndTime(1, "Jul 10 2021 08:00")
+			require.Nil(t, err)
+			assert.Len(t, trains, 2)
+		})
+	})
+
+	t.Run("when the latest version is rolled back", func(t *testing.T) {
+		_, err := store.rollbackVersion(second.ID)
+		require.Nil(t, err)
+
+		t.Run("the previous version will be in effect again", func(t *testing.T) {
+			trains, err := store.getTrainsByStopAndTime(1, "Jul 10 2021 07:42")
+			require.Nil(t, err)
+			assert.Len(t, trains, 2)
+		})
+
+		t.Run("it can not be rolled back twice", func(t *testing.T) {
+			_, err := store.rollbackVersion(second.ID)
+			assert.EqualValues(t, "Timetable version is not active: v0002", err.Error())
+		})
+	})
+
+	t.Run("when an unknown version is activated", func(t *testing.T) {
+		_, err := store.activateVersion("v0099")
+		assert.EqualValues(t, "Timetable version not found: v0099", err.Error())
+	})
+}
+
+func TestTimetableServer(t *testing.T) {
+	store := initTestStore(t)
+	defer tearDownStore(store)
+	srv := httptest.NewServer(newServer(store))
+	defer srv.Close()
+
+	post := func(path string, body string) (*http.Response, error) {
+		return http.Post(srv.URL+path, "text/csv", strings.NewReader(body))
+	}
+
+	res, err := post("/timetables?effectiveFrom="+url.QueryEscape("Jul 01 2021"), `stopID,route,trainID,time
+1,"C","865a","Jul 04 2021 07:42"
+1,"55","465a","Jul 04 2021 07:42"`)
+	require.Nil(t, err)
+	defer res.Body.Close()
+	version := TimetableVersion{}
+	require.Nil(t, json.NewDecoder(res.Body).Decode(&version))
+
+	t.Run("when a timetable is posted", func(t *testing.T) {
+		t.Run("it will be imported as an inactive version", func(t *testing.T) {
+			assert.EqualValues(t, http.StatusCreated, res.StatusCode)
+			assert.EqualValues(t, "v0001", version.ID)
+			assert.False(t, version.Active)
+
+			res, err := http.Get(srv.URL + "/timetables")
+			require.Nil(t, err)
+			defer res.Body.Close()
+			versions := []TimetableVersion{}
+			require.Nil(t, json.NewDecoder(res.Body).Decode(&versions))
+			assert.EqualValues(t, []TimetableVersion{version}, versions)
+		})
+
+		t.Run("it will not be imported without an effective date", func(t *testing.T) {
+			res, err := post("/timetables", "stopID,route,trainID,time\n")
+			require.Nil(t, err)
+			res.Body.Close()
+			assert.EqualValues(t, http.StatusBadRequest, res.StatusCode)
+		})
+	})
+
+	t.Run("when a version is previewed", func(t *testing.T) {
+		res, err := http.Get(srv.URL + "/timetables/v0001/preview?date=" + url.QueryEscape("Jul 04 2021"))
+		require.Nil(t, err)
+		defer res.Body.Close()
+		schedules := []Schedule{}
+		require.Nil(t, json.NewDecoder(res.Body).Decode(&schedules))
+
+		t.Run("it will list its trains before it is active", func(t *testing.T) {
+			assert.Len(t, schedules, 2)
+			next, err := store.getNextTrains(1, "Jul 04 2021 07:42")
+			require.Nil(t, err)
+			assert.Len(t, next.Trains, 0)
+		})
+	})
+
+	t.Run("when a version is activated then rolled back", func(t *testing.T) {
+		res, err := post("/timetables/v0001/activate", "")
+		require.Nil(t, err)
+		res.Body.Close()
+		assert.EqualValues(t, http.StatusOK, res.StatusCode)
+		next, err := store.getNextTrains(1, "Jul 04 2021 07:42")
+		require.Nil(t, err)
+		assert.Len(t, next.Trains, 2)
+
+		res, err = post("/timetables/v0001/rollback", "")
+		require.Nil(t, err)
+		res.Body.Close()
+		assert.EqualValues(t, http.StatusOK, res.StatusCode)
+
+		t.Run("it will go out of effect", func(t *testing.T) {
+			next, err := store.getNextTrains(1, "Jul 04 2021 07:42")
+			require.Nil(t, err)
+			assert.Len(t, next.Trains, 0)
+		})
+
+		t.Run("it cannot be rolled back twice", func(t *testing.T) {
+			res, err := post("/timetables/v0001/rollback", "")
+			require.Nil(t, err)
+			res.Body.Close()
+			assert.EqualValues(t, http.StatusBadRequest, res.StatusCode)
+		})
+	})
+
+	t.Run("when an unknown version is activated", func(t *testing.T) {
+		res, err := post("/timetables/v0009/activate", "")
+		require.Nil(t, err)
+		res.Body.Close()
+		assert.EqualValues(t, http.StatusNotFound, res.StatusCode)
+	})
+}
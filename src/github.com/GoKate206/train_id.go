@@ -0,0 +1,150 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"regexp"
+	"strings"
+	"unicode"
+)
+
+// character classes a train ID may be built from
+var trainIDClasses = map[string]func(r rune) bool{
+	"letter":     func(r rune) bool { return r < unicode.MaxASCII && unicode.IsLetter(r) },
+	"digit":      func(r rune) bool { return r >= '0' && r <= '9' },
+	"dash":       func(r rune) bool { return r == '-' },
+	"underscore": func(r rune) bool { return r == '_' },
+	"dot":        func(r rune) bool { return r == '.' },
+}
+
+// TrainIDRules are the format an agency gives its train numbers
+type TrainIDRules struct {
+	MinLength int      `json:"minLength"`
+	MaxLength int      `json:"maxLength"`
+	Classes   []string `json:"classes"`
+	// Pattern is matched against the whole ID after case normalization
+	Pattern string `json:"pattern,omitempty"`
+	// Case is upper or lower to normalize IDs before they are stored
+	Case string `json:"case,omitempty"`
+
+	pattern *regexp.Regexp
+}
+
+func defaultTrainIDRules() TrainIDRules {
+	return TrainIDRules{MinLength: 4, MaxLength: 4, Classes: []string{"letter", "digit"}}
+}
+
+// compile checks the rules make sense and prepares the pattern
+func (rules *TrainIDRules) compile() error {
+	if rules.MinLength < 1 || rules.MaxLength < rules.MinLength {
+		return fmt.Errorf("Train Id length range is invalid: %d - %d", rules.MinLength, rules.MaxLength)
+	}
+
+	if len(rules.Classes) == 0 {
+		return fmt.Errorf("Train Id rules need at least one character class")
+	}
+	for _, class := range rules.Classes {
+		if _, ok := trainIDClasses[class]; !ok {
+			return fmt.Errorf("Unknown train Id character class: %s", class)
+		}
+	}
+
+	if rules.Case != "" && rules.Case != "upper" && rules.Case != "lower" {
+		return fmt.Errorf("Train Id case must be upper or lower, got: %s", rules.Case)
+	}
+
+	rules.pattern = nil
+	if rules.Pattern != "" {
+		pattern, err := regexp.Compile("^(?:" + rules.Pattern + ")$")
+		if err != nil {
+			return fmt.Errorf("Train Id pattern is invalid: %v", err)
+		}
+		rules.pattern = pattern
+	}
+
+	return nil
+}
+
+// describeClasses names the allowed characters for error messages
+func (rules TrainIDRules) describeClasses() string {
+	if len(rules.Classes) == 2 && rules.allows("letter") && rules.allows("digit") {
+		return "alphanumeric"
+	}
+
+	names := map[string]string{"letter": "letters", "digit": "digits", "dash": "dashes", "underscore": "underscores", "dot": "dots"}
+	described := []string{}
+	for _, class := range rules.Classes {
+		described = append(described, names[class])
+	}
+
+	return "only " + strings.Join(described, ", ")
+}
+
+func (rules TrainIDRules) allows(class string) bool {
+	for _, allowed := range rules.Classes {
+		if allowed == class {
+			return true
+		}
+	}
+
+	return false
+}
+
+// validate returns the normalized train ID or why it breaks the rules
+func (rules TrainIDRules) validate(trainID string) (string, error) {
+	switch rules.Case {
+	case "upper":
+		trainID = strings.ToUpper(trainID)
+	case "lower":
+		trainID = strings.ToLower(trainID)
+	}
+
+	length := len([]rune(trainID))
+	if length < rules.MinLength {
+		return "", fmt.Errorf("Train Id is invalid, too few characters: %s", trainID)
+	}
+	if length > rules.MaxLength {
+		return "", fmt.Errorf("Train Id is invalid, too many characters: %s", trainID)
+	}
+
+	for _, r := range trainID {
+		allowed := false
+		for _, class := range rules.Classes {
+			if trainIDClasses[class](r) {
+				allowed = true
+				break
+			}
+		}
+		if !allowed {
+			return "", fmt.Errorf("Train Id must be %s: %s", rules.describeClasses(), trainID)
+		}
+	}
+
+	if rules.pattern != nil && !rules.pattern.MatchString(trainID) {
+		return "", fmt.Errorf("Train Id does not match %s: %s", rules.Pattern, trainID)
+	}
+
+	return trainID, nil
+}
+
+// loadTrainIDRules reads the rules of an agency from a JSON file
+// of agency name to rules
+func loadTrainIDRules(path, agency string) (TrainIDRules, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return TrainIDRules{}, err
+	}
+
+	agencies := map[string]TrainIDRules{}
+	if err := json.Unmarshal(b, &agencies); err != nil {
+		return TrainIDRules{}, fmt.Errorf("Error reading train Id rules: %v", err)
+	}
+
+	rules, ok := agencies[agency]
+	if !ok {
+		return TrainIDRules{}, fmt.Errorf("No train Id rules for agency: %s", agency)
+	}
+
+	return rules, rules.compile()
+}
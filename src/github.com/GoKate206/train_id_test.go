@@ -0,0 +1,96 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTrainIDRules(t *testing.T) {
+	t.Run("when using the default rules", func(t *testing.T) {
+		rules := defaultTrainIDRules()
+		require.Nil(t, rules.compile())
+
+		t.Run("it will reject underscores as not alphanumeric", func(t *testing.T) {
+			_, err := rules.validate("a_b1")
+			require.Error(t, err)
+			assert.EqualValues(t, "Train Id must be alphanumeric: a_b1", err.Error())
+		})
+
+		t.Run("it will say when an ID is too long", func(t *testing.T) {
+			_, err := rules.validate("865aa")
+			require.Error(t, err)
+			assert.EqualValues(t, "Train Id is invalid, too many characters: 865aa", err.Error())
+		})
+	})
+
+	t.Run("when an agency uses a range, dashes, a pattern and upper case", func(t *testing.T) {
+		rules := TrainIDRules{MinLength: 3, MaxLength: 6, Classes: []string{"letter", "digit", "dash"}, Pattern: `[A-Z]+-\d+`, Case: "upper"}
+		require.Nil(t, rules.compile())
+
+		t.Run("it will normalize the case of valid IDs", func(t *testing.T) {
+			trainID, err := rules.validate("ic-12")
+			require.Nil(t, err)
+			assert.EqualValues(t, "IC-12", trainID)
+		})
+
+		t.Run("it will name the allowed characters", func(t *testing.T) {
+			_, err := rules.validate("ic.12")
+			require.Error(t, err)
+			assert.EqualValues(t, "Train Id must be only letters, digits, dashes: IC.12", err.Error())
+		})
+
+		t.Run("it will reject IDs not matching the pattern", func(t *testing.T) {
+			_, err := rules.validate("12-ic")
+			require.Error(t, err)
+			assert.EqualValues(t, `Train Id does not match [A-Z]+-\d+: 12-IC`, err.Error())
+		})
+	})
+
+	t.Run("when the rules are invalid", func(t *testing.T) {
+		cases := map[string]TrainIDRules{
+			"Train Id length range is invalid: 5 - 4":          {MinLength: 5, MaxLength: 4, Classes: []string{"digit"}},
+			"Unknown train Id character class: emoji":          {MinLength: 1, MaxLength: 4, Classes: []string{"emoji"}},
+			"Train Id case must be upper or lower, got: title": {MinLength: 1, MaxLength: 4, Classes: []string{"digit"}, Case: "title"},
+		}
+
+		for expected, rules := range cases {
+			err := rules.compile()
+			require.Error(t, err)
+			assert.EqualValues(t, expected, err.Error())
+		}
+	})
+
+	t.Run("when rules are loaded for an agency", func(t *testing.T) {
+		dir, err := ioutil.TempDir("", "train-id-rules")
+		require.Nil(t, err)
+		defer os.RemoveAll(dir)
+		path := filepath.Join(dir, "rules.json")
+		require.Nil(t, ioutil.WriteFile(path, []byte(`{"metro": {"minLength": 2, "maxLength": 5, "classes": ["digit"]}}`), 0644))
+
+		rules, err := loadTrainIDRules(path, "metro")
+		require.Nil(t, err)
+		assert.EqualValues(t, 5, rules.MaxLength)
+
+		t.Run("imports read with them will follow them", func(t *testing.T) {
+			csv := `stopID,route,trainID,time
+1,"C","12345","Jul 04 2021 07:42"`
+			schedules, err := readCsv(csv, rules)
+			require.Nil(t, err)
+			assert.EqualValues(t, "12345", schedules[0].TrainID)
+
+			_, err = readCsv(csv, defaultTrainIDRules())
+			assert.Error(t, err)
+		})
+
+		t.Run("it will fail for an unknown agency", func(t *testing.T) {
+			_, err := loadTrainIDRules(path, "tram")
+			require.Error(t, err)
+			assert.EqualValues(t, "No train Id rules for agency: tram", err.Error())
+		})
+	})
+}
@@ -0,0 +1,368 @@
+package main
+
+import (
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"math"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	formatCsv    = "csv"
+	formatXlsx   = "xlsx"
+	formatJSON   = "json"
+	formatNDJSON = "ndjson"
+)
+
+var (
+	uploadContentTypes = map[string]string{
+		"text/csv":             formatCsv,
+		"application/json":     formatJSON,
+		"application/x-ndjson": formatNDJSON,
+		"application/vnd.openxmlformats-officedocument.spreadsheetml.sheet": formatXlsx,
+	}
+	// excelEpoch is day 0 of spreadsheet serial dates
+	excelEpoch = time.Date(1899, 12, 30, 0, 0, 0, 0, time.UTC)
+	// xlsxMaxColumns is the last column a sheet can have, XFD
+	xlsxMaxColumns = 16384
+	// maxXlsxPartBytes caps how much of one workbook part is unzipped
+	maxXlsxPartBytes int64 = 64 << 20
+	// maxXlsxCells caps rows times the widest row, as every row is padded
+	// to that width, so one far off cell cannot widen a long sheet
+	maxXlsxCells = 4 << 20
+)
+
+// uploadFormatOf picks the format from a file extension or content type
+func uploadFormatOf(name string) string {
+	if format, ok := uploadContentTypes[strings.TrimSpace(strings.Split(name, ";")[0])]; ok {
+		return format
+	}
+
+	switch strings.ToLower(strings.TrimPrefix(filepath.Ext(name), ".")) {
+	case formatXlsx:
+		return formatXlsx
+	case formatJSON:
+		return formatJSON
+	case formatNDJSON, "jsonl":
+		return formatNDJSON
+	}
+
+	return formatCsv
+}
+
+// uploadToCsv turns an upload into CSV text so every format shares
+// the mapping, linting and validation of the CSV path
+func uploadToCsv(body []byte, format string, sheet string) (string, error) {
+	switch format {
+	case "", formatCsv:
+		return string(body), nil
+	case formatXlsx:
+		rows, err := readXlsx(body, sheet)
+		if err != nil {
+			return "", err
+		}
+		return rowsToCsv(rows)
+	case formatJSON, formatNDJSON:
+		return jsonToCsv(body, format)
+	}
+
+	return "", fmt.Errorf("Unknown upload format: %s, expected csv, xlsx, json or ndjson", format)
+}
+
+func rowsToCsv(rows [][]string) (string, error) {
+	var b strings.Builder
+	w := csv.NewWriter(&b)
+	w.WriteAll(rows)
+
+	return strings.TrimSuffix(b.String(), "\n"), w.Error()
+}
+
+// jsonToCsv reads Schedule shaped objects, a JSON array or one object
+// per line for NDJSON. Optional columns are kept when any object has them
+func jsonToCsv(body []byte, format string) (string, error) {
+	objects := []map[string]interface{}{}
+	if format == formatJSON {
+		decoder := json.NewDecoder(bytes.NewReader(body))
+		decoder.UseNumber()
+		if err := decoder.Decode(&objects); err != nil {
+			return "", fmt.Errorf("Error reading JSON: %v", err)
+		}
+	} else {
+		scanner := bufio.NewScanner(bytes.NewReader(body))
+		for line := 1; scanner.Scan(); line++ {
+			if strings.TrimSpace(scanner.Text()) == "" {
+				continue
+			}
+
+			object := map[string]interface{}{}
+			decoder := json.NewDecoder(bytes.NewReader(scanner.Bytes()))
+			decoder.UseNumber()
+			if err := decoder.Decode(&object); err != nil {
+				return "", fmt.Errorf("Error reading NDJSON line %d: %v", line, err)
+			}
+			objects = append(objects, object)
+		}
+		if err := scanner.Err(); err != nil {
+			return "", err
+		}
+	}
+
+	headers := append([]string{}, expectedHeaders...)
+	for _, header := range optionalHeaders() {
+		for _, object := range objects {
+			if _, ok := object[header]; ok {
+				headers = append(headers, header)
+				break
+			}
+		}
+	}
+
+	rows := [][]string{headers}
+	for _, object := range objects {
+		row := []string{}
+		for _, header := range headers {
+			value := ""
+			if v, ok := object[header]; ok && v != nil {
+				value = fmt.Sprint(v)
+			}
+			row = append(row, value)
+		}
+		rows = append(rows, row)
+	}
+
+	return rowsToCsv(rows)
+}
+
+// xlsx workbooks are zipped XML, only what holds cell values is decoded
+type xlsxWorkbook struct {
+	Sheets []struct {
+		Name string `xml:"name,attr"`
+		RID  string `xml:"http://schemas.openxmlformats.org/officeDocument/2006/relationships id,attr"`
+	} `xml:"sheets>sheet"`
+}
+
+type xlsxRelationships struct {
+	Relationships []struct {
+		ID     string `xml:"Id,attr"`
+		Target string `xml:"Target,attr"`
+	} `xml:"Relationship"`
+}
+
+type xlsxText struct {
+	Text string `xml:"t"`
+	Runs []struct {
+		Text string `xml:"t"`
+	} `xml:"r"`
+}
+
+func (t xlsxText) String() string {
+	text := t.Text
+	for _, run := range t.Runs {
+		text += run.Text
+	}
+
+	return text
+}
+
+type xlsxSharedStrings struct {
+	Items []xlsxText `xml:"si"`
+}
+
+type xlsxSheet struct {
+	Rows []struct {
+		Cells []struct {
+			Ref    string   `xml:"r,attr"`
+			Type   string   `xml:"t,attr"`
+			Value  string   `xml:"v"`
+			Inline xlsxText `xml:"is"`
+		} `xml:"c"`
+	} `xml:"sheetData>row"`
+}
+
+func readZipXML(files map[string]*zip.File, name string, v interface{}) error {
+	file, ok := files[name]
+	if !ok {
+		return fmt.Errorf("Workbook is missing %s", name)
+	}
+
+	if file.UncompressedSize64 > uint64(maxXlsxPartBytes) {
+		return fmt.Errorf("Workbook part %s is larger than %d bytes", name, maxXlsxPartBytes)
+	}
+
+	r, err := file.Open()
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	// the size in the zip header can lie so the read is limited too
+	return xml.NewDecoder(io.LimitReader(r, maxXlsxPartBytes)).Decode(v)
+}
+
+// readXlsx returns the rows of a sheet, the first one when sheet is empty.
+// Numbers in a time column are spreadsheet dates and are written in layout
+func readXlsx(body []byte, sheet string) ([][]string, error) {
+	archive, err := zip.NewReader(bytes.NewReader(body), int64(len(body)))
+	if err != nil {
+		return nil, fmt.Errorf("Error reading XLSX: %v", err)
+	}
+
+	files := map[string]*zip.File{}
+	for _, file := range archive.File {
+		files[file.Name] = file
+	}
+
+	workbook := xlsxWorkbook{}
+	if err := readZipXML(files, "xl/workbook.xml", &workbook); err != nil {
+		return nil, err
+	}
+	rels := xlsxRelationships{}
+	if err := readZipXML(files, "xl/_rels/workbook.xml.rels", &rels); err != nil {
+		return nil, err
+	}
+	shared := xlsxSharedStrings{}
+	if _, ok := files["xl/sharedStrings.xml"]; ok {
+		if err := readZipXML(files, "xl/sharedStrings.xml", &shared); err != nil {
+			return nil, err
+		}
+	}
+
+	target, names := "", []string{}
+	for _, s := range workbook.Sheets {
+		names = append(names, s.Name)
+		if target != "" || (sheet != "" && s.Name != sheet) {
+			continue
+		}
+		for _, rel := range rels.Relationships {
+			if rel.ID == s.RID {
+				target = rel.Target
+			}
+		}
+	}
+	if target == "" {
+		return nil, fmt.Errorf("Sheet not found: %s, Got: %s", sheet, strings.Join(names, ", "))
+	}
+	if strings.HasPrefix(target, "/") {
+		target = strings.TrimPrefix(target, "/")
+	} else {
+		target = path.Join("xl", target)
+	}
+
+	data := xlsxSheet{}
+	if err := readZipXML(files, target, &data); err != nil {
+		return nil, err
+	}
+
+	rows := [][]string{}
+	timeColumn := -1
+	width := 0
+	for _, row := range data.Rows {
+		values := []string{}
+		for i, cell := range row.Cells {
+			column := i
+			if cell.Ref != "" {
+				column, err = xlsxColumn(cell.Ref)
+				if err != nil {
+					return nil, err
+				}
+			}
+			if column >= xlsxMaxColumns {
+				return nil, fmt.Errorf("Sheet has more than %d columns", xlsxMaxColumns)
+			}
+			for len(values) <= column {
+				values = append(values, "")
+			}
+
+			value := cell.Value
+			switch cell.Type {
+			case "s":
+				index, err := strconv.Atoi(value)
+				if err != nil || index < 0 || index >= len(shared.Items) {
+					return nil, fmt.Errorf("Invalid shared string in cell %s", cell.Ref)
+				}
+				value = shared.Items[index].String()
+			case "inlineStr":
+				value = cell.Inline.String()
+			case "", "n":
+				if column == timeColumn && len(rows) > 0 {
+					if serial, err := strconv.ParseFloat(value, 64); err == nil {
+						value = excelTime(serial).Format(layout)
+					}
+				}
+			}
+			values[column] = value
+		}
+
+		if len(rows) == 0 {
+			timeColumn = xlsxTimeColumn(values)
+		}
+		rows = append(rows, values)
+		if len(values) > width {
+			width = len(values)
+		}
+		if len(rows)*width > maxXlsxCells {
+			return nil, fmt.Errorf("Sheet has more than %d cells", maxXlsxCells)
+		}
+	}
+
+	// pad short rows as csv wants the same number of fields in each
+	for i := range rows {
+		for len(rows[i]) < width {
+			rows[i] = append(rows[i], "")
+		}
+	}
+
+	return rows, nil
+}
+
+// xlsxColumn is the zero based column of a cell reference like AB12
+func xlsxColumn(ref string) (int, error) {
+	column := 0
+	letters := 0
+	for _, r := range ref {
+		if r < 'A' || r > 'Z' {
+			break
+		}
+		column = column*26 + int(r-'A'+1)
+		letters++
+		if column > xlsxMaxColumns {
+			return 0, fmt.Errorf("Cell %s is past column XFD", ref)
+		}
+	}
+
+	row := ref[letters:]
+	if letters == 0 || row == "" || strings.TrimLeft(row, "0123456789") != "" {
+		return 0, fmt.Errorf("Invalid cell reference: %s", ref)
+	}
+
+	return column - 1, nil
+}
+
+func xlsxTimeColumn(headers []string) int {
+	for _, alias := range headerAliases["time"] {
+		for i, header := range headers {
+			if canonicalHeader(header) == alias {
+				return i
+			}
+		}
+	}
+
+	return -1
+}
+
+// excelTime converts a serial date to the nearest minute
+func excelTime(serial float64) time.Time {
+	minutes := math.Round(serial * 24 * 60)
+
+	return excelEpoch.Add(time.Duration(minutes) * time.Minute)
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testWorkbook builds an xlsx with a notes sheet before a schedule sheet
+// using shared strings, inline strings and a serial date time
+func testWorkbook(t *testing.T) []byte {
+	return testWorkbookWith(t, "")
+}
+
+// testWorkbookWith builds testWorkbook with its notes sheet swapped for
+// the given rows when there are some
+func testWorkbookWith(t *testing.T, notes string) []byte {
+	files := map[string]string{
+		"xl/workbook.xml": `<workbook xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main" xmlns:r="http://schemas.openxmlformats.org/officeDocument/2006/relationships">
+<sheets><sheet name="Notes" sheetId="1" r:id="rId1"/><sheet name="Weekday" sheetId="2" r:id="rId2"/></sheets></workbook>`,
+		"xl/_rels/workbook.xml.rels": `<Relationships xmlns="http://schemas.openxmlformats.org/package/2006/relationships">
+<Relationship Id="rId1" Target="worksheets/sheet1.xml"/><Relationship Id="rId2" Target="worksheets/sheet2.xml"/></Relationships>`,
+		"xl/sharedStrings.xml": `<sst xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main">
+<si><t>stopID</t></si><si><t>route</t></si><si><r><t>train</t></r><r><t>ID</t></r></si><si><t>time</t></si></sst>`,
+		"xl/worksheets/sheet1.xml": `<worksheet xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main"><sheetData>
+<row r="1"><c r="A1" t="inlineStr"><is><t>not a schedule</t></is></c></row></sheetData></worksheet>`,
+		"xl/worksheets/sheet2.xml": `<worksheet xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main"><sheetData>
+<row r="1"><c r="A1" t="s"><v>0</v></c><c r="B1" t="s"><v>1</v></c><c r="C1" t="s"><v>2</v></c><c r="D1" t="s"><v>3</v></c></row>
+<row r="2"><c r="A2"><v>1</v></c><c r="B2" t="inlineStr"><is><t>C</t></is></c><c r="C2" t="inlineStr"><is><t>865a</t></is></c><c r="D2"><v>44381.320833333</v></c></row>
+<row r="3"><c r="A3"><v>2</v></c><c r="B3" t="inlineStr"><is><t>C</t></is></c><c r="C3" t="inlineStr"><is><t>865a</t></is></c><c r="D3" t="str"><v>Jul 04 2021 07:50</v></c></row>
+</sheetData></worksheet>`,
+	}
+	if notes != "" {
+		files["xl/worksheets/sheet1.xml"] = `<worksheet xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main"><sheetData>` +
+			notes + `</sheetData></worksheet>`
+	}
+
+	var b bytes.Buffer
+	w := zip.NewWriter(&b)
+	for name, content := range files {
+		f, err := w.Create(name)
+		require.Nil(t, err)
+		f.Write([]byte(content))
+	}
+	require.Nil(t, w.Close())
+
+	return b.Bytes()
+}
+
+func TestUploadToCsv(t *testing.T) {
+	expected := "stopID,route,trainID,time\n1,C,865a,Jul 04 2021 07:42\n2,C,865a,Jul 04 2021 07:50"
+
+	t.Run("when given a workbook and a sheet", func(t *testing.T) {
+		csv, err := uploadToCsv(testWorkbook(t), formatXlsx, "Weekday")
+		require.Nil(t, err)
+
+		t.Run("it will read the sheet with serial dates as times", func(t *testing.T) {
+			assert.EqualValues(t, expected, csv)
+		})
+
+		t.Run("it will say which sheets there are when one is missing", func(t *testing.T) {
+			_, err := uploadToCsv(testWorkbook(t), formatXlsx, "Sunday")
+			require.Error(t, err)
+			assert.EqualValues(t, "Sheet not found: Sunday, Got: Notes, Weekday", err.Error())
+		})
+
+		t.Run("it will read the first sheet by default", func(t *testing.T) {
+			csv, err := uploadToCsv(testWorkbook(t), formatXlsx, "")
+			require.Nil(t, err)
+			assert.EqualValues(t, "not a schedule", csv)
+		})
+	})
+
+	t.Run("when a sheet has bad cell references", func(t *testing.T) {
+		t.Run("it will reject references without a column", func(t *testing.T) {
+			for _, ref := range []string{"a1", "1", "A", "A1B"} {
+				_, err := uploadToCsv(testWorkbookWith(t, `<row r="1"><c r="`+ref+`"><v>1</v></c></row>`), formatXlsx, "")
+				require.Error(t, err, ref)
+				assert.EqualValues(t, "Invalid cell reference: "+ref, err.Error())
+			}
+		})
+
+		t.Run("it will reject columns past XFD", func(t *testing.T) {
+			_, err := uploadToCsv(testWorkbookWith(t, `<row r="1"><c r="ZZZZZZZZ1"><v>1</v></c></row>`), formatXlsx, "")
+			require.Error(t, err)
+			assert.EqualValues(t, "Cell ZZZZZZZZ1 is past column XFD", err.Error())
+
+			_, err = uploadToCsv(testWorkbookWith(t, `<row r="1"><c r="XFD1"><v>1</v></c></row>`), formatXlsx, "")
+			assert.Nil(t, err)
+		})
+	})
+
+	t.Run("when a sheet would pad out to too many cells", func(t *testing.T) {
+		defer func(limit int) { maxXlsxCells = limit }(maxXlsxCells)
+		maxXlsxCells = 16384 * 2
+
+		rows := `<row r="1"><c r="XFD1"><v>1</v></c></row>`
+		for i := 2; i <= 3; i++ {
+			rows += fmt.Sprintf(`<row r="%d"><c r="A%d"><v>1</v></c></row>`, i, i)
+		}
+
+		t.Run("it will fail before padding the rows", func(t *testing.T) {
+			_, err := uploadToCsv(testWorkbookWith(t, rows), formatXlsx, "")
+			require.Error(t, err)
+			assert.EqualValues(t, "Sheet has more than 32768 cells", err.Error())
+		})
+	})
+
+	t.Run("when a workbook part is too large", func(t *testing.T) {
+		defer func(limit int64) { maxXlsxPartBytes = limit }(maxXlsxPartBytes)
+		maxXlsxPartBytes = 64
+
+		t.Run("it will not unzip it", func(t *testing.T) {
+			_, err := uploadToCsv(testWorkbook(t), formatXlsx, "Weekday")
+			require.Error(t, err)
+			assert.Contains(t, err.Error(), "is larger than 64 bytes")
+		})
+	})
+
+	t.Run("when given JSON or NDJSON", func(t *testing.T) {
+		fromJSON, err := uploadToCsv([]byte(`[{"stopID": 1, "route": "C", "trainID": "865a", "time": "Jul 04 2021 07:42"},
+{"stopID": "2", "route": "C", "trainID": "865a", "time": "Jul 04 2021 07:50", "note": "ignored"}]`), formatJSON, "")
+		require.Nil(t, err)
+		fromNDJSON, err := uploadToCsv([]byte(`{"stopID": 1, "route": "C", "trainID": "865a", "time": "Jul 04 2021 07:42"}
+
+{"stopID": 2, "route": "C", "trainID": "865a", "time": "Jul 04 2021 07:50"}
+`), formatNDJSON, "")
+		require.Nil(t, err)
+
+		t.Run("it will read both as the same CSV", func(t *testing.T) {
+			assert.EqualValues(t, expected, fromJSON)
+			assert.EqualValues(t, expected, fromNDJSON)
+		})
+
+		t.Run("it will validate like a CSV", func(t *testing.T) {
+			csv, err := uploadToCsv([]byte(`[{"stopID": 1, "route": "C", "trainID": "86", "time": "Jul 04 2021 07:42"}]`), formatJSON, "")
+			require.Nil(t, err)
+			_, err = readCsv(csv, defaultTrainIDRules())
+			require.Error(t, err)
+			assert.EqualValues(t, "Train Id is invalid, too few characters: 86", err.Error())
+		})
+
+		t.Run("it will give the line of bad NDJSON", func(t *testing.T) {
+			_, err := uploadToCsv([]byte("{\"stopID\": 1}\n{"), formatNDJSON, "")
+			require.Error(t, err)
+			assert.EqualValues(t, "Error reading NDJSON line 2: unexpected EOF", err.Error())
+		})
+	})
+
+	t.Run("when picking a format", func(t *testing.T) {
+		assert.EqualValues(t, formatXlsx, uploadFormatOf("weekday.XLSX"))
+		assert.EqualValues(t, formatNDJSON, uploadFormatOf("application/x-ndjson; charset=utf-8"))
+		assert.EqualValues(t, formatCsv, uploadFormatOf("schedule.txt"))
+	})
+}
+
+func TestServerUploadFormats(t *testing.T) {
+	store := initTestStore(t)
+	defer tearDownStore(store)
+	srv := httptest.NewServer(newServer(store))
+	defer srv.Close()
+
+	t.Run("when a workbook is posted", func(t *testing.T) {
+		res, err := http.Post(srv.URL+"/schedules?sheet=Weekday", "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet", bytes.NewReader(testWorkbook(t)))
+		require.Nil(t, err)
+		res.Body.Close()
+
+		t.Run("it will import the sheet", func(t *testing.T) {
+			assert.EqualValues(t, http.StatusCreated, res.StatusCode)
+			schedules, err := store.getAllSchedules()
+			require.Nil(t, err)
+			assert.Len(t, schedules, 2)
+		})
+	})
+}
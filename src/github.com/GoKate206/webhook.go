@@ -0,0 +1,467 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+var (
+	webhookDbName         = "webhooks"
+	webhookDeliveryDbName = "webhook-deliveries"
+	// webhookAttempts is how often a delivery is tried, waiting
+	// webhookBackoff after the first failure and twice as long each time after
+	webhookAttempts = 3
+	webhookBackoff  = time.Second
+	webhookTimeout  = 10 * time.Second
+	// webhookWorkers deliver changes, up to webhookQueue changes wait for
+	// them and any more are dropped rather than holding up writes
+	webhookWorkers = 4
+	webhookQueue   = 256
+	// webhookDrainTimeout is how long closing waits on queued deliveries
+	webhookDrainTimeout = 30 * time.Second
+	// webhookDeliveryRetention is how many deliveries are logged per
+	// webhook, older ones are deleted
+	webhookDeliveryRetention = 100
+	// privateNetworks are the loopback, link-local, private and
+	// unspecified addresses webhooks are not sent to unless allowed
+	privateNetworks = mustParseNetworks("0.0.0.0/8", "10.0.0.0/8", "100.64.0.0/10", "127.0.0.0/8",
+		"169.254.0.0/16", "172.16.0.0/12", "192.168.0.0/16", "::/128", "::1/128", "fc00::/7", "fe80::/10")
+)
+
+// deliveryLayout is the wall clock time of an attempt, with fixed width
+// nanoseconds so the log sorts in the order attempts were made
+const deliveryLayout = "2006-01-02T15:04:05.000000000Z07:00"
+
+// Webhook subscribes a URL to the changes touching its stops and routes,
+// none of either subscribes to every change. Payloads are signed with Secret
+type Webhook struct {
+	ID        string   `json:"ID"`
+	URL       string   `json:"url"`
+	StopIDs   []int64  `json:"stopIDs,omitempty"`
+	Routes    []string `json:"routes,omitempty"`
+	Secret    string   `json:"secret,omitempty"`
+	CreatedAt string   `json:"createdAt"`
+}
+
+// WebhookDelivery logs how sending one change to a webhook went
+type WebhookDelivery struct {
+	ID         string `json:"ID"`
+	WebhookID  string `json:"webhookID"`
+	Event      string `json:"event"`
+	Attempts   int    `json:"attempts"`
+	StatusCode int    `json:"statusCode,omitempty"`
+	Delivered  bool   `json:"delivered"`
+	Error      string `json:"error,omitempty"`
+	At         string `json:"at"`
+}
+
+// webhookPayload is the body posted to a webhook
+type webhookPayload struct {
+	Delivery string `json:"delivery"`
+	ChangeEvent
+}
+
+// WebhookAllowlist are private networks webhooks may be sent to anyway,
+// such as a receiver on the same host or network
+type WebhookAllowlist []*net.IPNet
+
+func mustParseNetworks(cidrs ...string) []*net.IPNet {
+	networks, err := parseNetworks(cidrs)
+	if err != nil {
+		panic(err)
+	}
+
+	return networks
+}
+
+// parseNetworks reads CIDRs, a lone address is a network of itself
+func parseNetworks(cidrs []string) ([]*net.IPNet, error) {
+	networks := []*net.IPNet{}
+	for _, cidr := range cidrs {
+		cidr = strings.TrimSpace(cidr)
+		if ip := net.ParseIP(cidr); ip != nil {
+			bits := 128
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 32
+			}
+			networks = append(networks, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return networks, fmt.Errorf("Network must be an address or CIDR, got: %s", cidr)
+		}
+		networks = append(networks, network)
+	}
+
+	return networks, nil
+}
+
+// parseWebhookAllowlist reads comma separated networks
+func parseWebhookAllowlist(value string) (WebhookAllowlist, error) {
+	if strings.TrimSpace(value) == "" {
+		return WebhookAllowlist{}, nil
+	}
+
+	networks, err := parseNetworks(strings.Split(value, ","))
+	return WebhookAllowlist(networks), err
+}
+
+// permits tells if a webhook may be sent to the address, public ones
+// always are and private ones only when allowed
+func (a WebhookAllowlist) permits(ip net.IP) bool {
+	for _, private := range privateNetworks {
+		if !private.Contains(ip) {
+			continue
+		}
+		for _, allowed := range a {
+			if allowed.Contains(ip) {
+				return true
+			}
+		}
+		return false
+	}
+
+	return true
+}
+
+// permitsHost resolves a host and tells if all of its addresses are permitted
+func (a WebhookAllowlist) permitsHost(host string) error {
+	ips, err := net.LookupIP(host)
+	if err != nil || len(ips) == 0 {
+		return fmt.Errorf("Webhook host cannot be resolved: %s", host)
+	}
+	for _, ip := range ips {
+		if !a.permits(ip) {
+			return fmt.Errorf("Webhook host is a private address: %s", host)
+		}
+	}
+
+	return nil
+}
+
+// client is an HTTP client that refuses to connect to addresses that are
+// not permitted, checked when dialing as a host can resolve differently
+// by then. Proxies are not used so the check sees the receiver
+func (a WebhookAllowlist) client(timeout time.Duration) *http.Client {
+	dialer := &net.Dialer{
+		Timeout: timeout,
+		Control: func(network, address string, _ syscall.RawConn) error {
+			host, _, err := net.SplitHostPort(address)
+			if err != nil {
+				return err
+			}
+			if ip := net.ParseIP(host); ip == nil || !a.permits(ip) {
+				return fmt.Errorf("Webhook address is not allowed: %s", host)
+			}
+			return nil
+		},
+	}
+
+	return &http.Client{Timeout: timeout, Transport: &http.Transport{DialContext: dialer.DialContext}}
+}
+
+func (h Webhook) validate(allow WebhookAllowlist) error {
+	u, err := url.Parse(h.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("Webhook URL must be an absolute http or https URL, got: %s", h.URL)
+	}
+
+	return allow.permitsHost(u.Hostname())
+}
+
+// signPayload is the hex HMAC-SHA256 of body with the webhook's secret
+func signPayload(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// addWebhook saves a subscription, a secret is generated when none is given.
+// It is only returned here, listing webhooks leaves it out
+func (s *Store) addWebhook(hook Webhook) (Webhook, error) {
+	if err := hook.validate(s.webhookAllowlist); err != nil {
+		return hook, err
+	}
+	if hook.Secret == "" {
+		hook.Secret = newID() + newID()
+	}
+
+	if err := s.lock(); err != nil {
+		return hook, err
+	}
+	defer s.mu.Unlock()
+
+	hook.ID = newID()
+	hook.CreatedAt = timeNow().Format(layout)
+
+	return hook, s.driver.Write(webhookDbName, hook.ID, &hook)
+}
+
+func (s *Store) deleteWebhook(id string) error {
+	if err := s.lock(); err != nil {
+		return err
+	}
+	defer s.mu.Unlock()
+
+	if err := s.driver.Read(webhookDbName, id, &Webhook{}); err != nil {
+		return fmt.Errorf("Webhook not found: %s", id)
+	}
+
+	return s.driver.Delete(webhookDbName, id)
+}
+
+// getWebhooks returns every webhook, secrets included
+func (s *Store) getWebhooks() ([]Webhook, error) {
+	hooks := []Webhook{}
+	if err := s.rlock(); err != nil {
+		return hooks, err
+	}
+	defer s.mu.RUnlock()
+
+	bytes, err := s.driver.ReadAll(webhookDbName)
+	// ReadAll will error if there are no rows,
+	// only error if there are rows
+	if len(bytes) > 0 && err != nil {
+		return hooks, err
+	}
+
+	for _, b := range bytes {
+		hook := Webhook{}
+		if err := json.Unmarshal(b, &hook); err != nil {
+			return hooks, err
+		}
+		hooks = append(hooks, hook)
+	}
+	sort.Slice(hooks, func(i, j int) bool { return hooks[i].CreatedAt+hooks[i].ID < hooks[j].CreatedAt+hooks[j].ID })
+
+	return hooks, nil
+}
+
+// logDelivery saves a delivery, deleting the webhook's oldest ones past
+// webhookDeliveryRetention
+func (s *Store) logDelivery(delivery WebhookDelivery) error {
+	if err := s.lock(); err != nil {
+		return err
+	}
+	defer s.mu.Unlock()
+
+	if err := s.driver.Write(webhookDeliveryDbName, delivery.ID, &delivery); err != nil {
+		return err
+	}
+
+	deliveries, err := s.getDeliveriesLocked(delivery.WebhookID)
+	if err != nil {
+		return err
+	}
+	for len(deliveries) > webhookDeliveryRetention {
+		if err := s.driver.Delete(webhookDeliveryDbName, deliveries[0].ID); err != nil {
+			return err
+		}
+		deliveries = deliveries[1:]
+	}
+
+	return nil
+}
+
+// getDeliveries returns a webhook's delivery log, oldest first
+func (s *Store) getDeliveries(webhookID string) ([]WebhookDelivery, error) {
+	deliveries := []WebhookDelivery{}
+	if err := s.rlock(); err != nil {
+		return deliveries, err
+	}
+	defer s.mu.RUnlock()
+
+	if err := s.driver.Read(webhookDbName, webhookID, &Webhook{}); err != nil {
+		return deliveries, fmt.Errorf("Webhook not found: %s", webhookID)
+	}
+
+	return s.getDeliveriesLocked(webhookID)
+}
+
+func (s *Store) getDeliveriesLocked(webhookID string) ([]WebhookDelivery, error) {
+	deliveries := []WebhookDelivery{}
+	bytes, err := s.driver.ReadAll(webhookDeliveryDbName)
+	// ReadAll will error if there are no rows,
+	// only error if there are rows
+	if len(bytes) > 0 && err != nil {
+		return deliveries, err
+	}
+
+	for _, b := range bytes {
+		delivery := WebhookDelivery{}
+		if err := json.Unmarshal(b, &delivery); err != nil {
+			return deliveries, err
+		}
+		if delivery.WebhookID == webhookID {
+			deliveries = append(deliveries, delivery)
+		}
+	}
+	sort.Slice(deliveries, func(i, j int) bool {
+		if deliveries[i].At != deliveries[j].At {
+			return deliveries[i].At < deliveries[j].At
+		}
+		return deliveries[i].ID < deliveries[j].ID
+	})
+
+	return deliveries, nil
+}
+
+// webhookDispatcher posts every change to the webhooks it affects. Changes
+// are queued for a fixed pool of workers so a slow receiver never holds up
+// the write that caused it, nor starts a goroutine per change
+type webhookDispatcher struct {
+	store   *Store
+	client  *http.Client
+	stop    func()
+	changes chan ChangeEvent
+	// wg counts the changes queued or being delivered
+	wg sync.WaitGroup
+}
+
+func startWebhooks(store *Store) *webhookDispatcher {
+	d := &webhookDispatcher{
+		store:   store,
+		client:  store.webhookAllowlist.client(webhookTimeout),
+		changes: make(chan ChangeEvent, webhookQueue),
+	}
+	for i := 0; i < webhookWorkers; i++ {
+		go d.work()
+	}
+	d.stop = store.onChange(func(change ChangeEvent) {
+		d.wg.Add(1)
+		select {
+		case d.changes <- change:
+		default:
+			d.wg.Done()
+			log.Printf("Webhook queue is full, dropped %s", change.Event)
+		}
+	})
+
+	return d
+}
+
+// close stops listening and waits on the deliveries queued and in flight,
+// up to webhookDrainTimeout. It reports whether they all finished
+func (d *webhookDispatcher) close() bool {
+	d.stop()
+	close(d.changes)
+
+	drained := make(chan struct{})
+	go func() {
+		d.wg.Wait()
+		close(drained)
+	}()
+
+	timeout := time.NewTimer(webhookDrainTimeout)
+	defer timeout.Stop()
+	select {
+	case <-drained:
+		return true
+	case <-timeout.C:
+		log.Printf("Webhook deliveries still running after %v, not waiting on them", webhookDrainTimeout)
+		return false
+	}
+}
+
+func (d *webhookDispatcher) work() {
+	for change := range d.changes {
+		d.dispatch(change)
+	}
+}
+
+func (d *webhookDispatcher) dispatch(change ChangeEvent) {
+	defer d.wg.Done()
+
+	// waits for the write that published the change to unlock the store
+	hooks, err := d.store.getWebhooks()
+	if err != nil {
+		log.Printf("Cannot read webhooks for %s: %v", change.Event, err)
+		return
+	}
+
+	for _, hook := range hooks {
+		if !change.affects(hook.StopIDs, hook.Routes) {
+			continue
+		}
+
+		delivery := d.deliver(hook, change)
+		if err := d.store.logDelivery(delivery); err != nil {
+			log.Printf("Cannot log webhook delivery %s: %v", delivery.ID, err)
+		}
+	}
+}
+
+// deliver posts the change until the receiver accepts it or the attempts
+// run out. Only network errors, 429 and 5xx answers are retried
+func (d *webhookDispatcher) deliver(hook Webhook, change ChangeEvent) WebhookDelivery {
+	delivery := WebhookDelivery{ID: newID(), WebhookID: hook.ID, Event: change.Event}
+	body, err := json.Marshal(webhookPayload{Delivery: delivery.ID, ChangeEvent: change})
+	if err != nil {
+		delivery.Error = err.Error()
+		return delivery
+	}
+
+	backoff := webhookBackoff
+	for delivery.Attempts < webhookAttempts {
+		if delivery.Attempts > 0 {
+			time.Sleep(backoff)
+			backoff *= 2
+		}
+		delivery.Attempts++
+		delivery.At = time.Now().UTC().Format(deliveryLayout)
+
+		retry := false
+		delivery.StatusCode, retry, err = d.post(hook, delivery.ID, change.Event, body)
+		if err == nil {
+			delivery.Delivered = true
+			delivery.Error = ""
+			break
+		}
+		delivery.Error = err.Error()
+		if !retry {
+			break
+		}
+	}
+
+	return delivery
+}
+
+// post sends one attempt and tells if a failure is worth retrying
+func (d *webhookDispatcher) post(hook Webhook, deliveryID string, event string, body []byte) (int, bool, error) {
+	req, err := http.NewRequest(http.MethodPost, hook.URL, bytes.NewReader(body))
+	if err != nil {
+		return 0, false, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Webhook-Event", event)
+	req.Header.Set("X-Webhook-Delivery", deliveryID)
+	req.Header.Set("X-Webhook-Signature", signPayload(hook.Secret, body))
+
+	res, err := d.client.Do(req)
+	if err != nil {
+		return 0, true, err
+	}
+	res.Body.Close()
+
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		retry := res.StatusCode == http.StatusTooManyRequests || res.StatusCode >= 500
+		return res.StatusCode, retry, fmt.Errorf("Webhook answered %d", res.StatusCode)
+	}
+
+	return res.StatusCode, false, nil
+}
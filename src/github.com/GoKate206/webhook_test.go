@@ -0,0 +1,362 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type receivedHook struct {
+	payload   webhookPayload
+	event     string
+	signature string
+	body      []byte
+}
+
+// webhookReceiver answers with statuses in turn, then 200
+type webhookReceiver struct {
+	mu       sync.Mutex
+	statuses []int
+	received []receivedHook
+}
+
+func (rec *webhookReceiver) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, _ := ioutil.ReadAll(r.Body)
+	hook := receivedHook{event: r.Header.Get("X-Webhook-Event"), signature: r.Header.Get("X-Webhook-Signature"), body: body}
+	json.Unmarshal(body, &hook.payload)
+
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	rec.received = append(rec.received, hook)
+	if len(rec.statuses) > 0 {
+		w.WriteHeader(rec.statuses[0])
+		rec.statuses = rec.statuses[1:]
+	}
+}
+
+func (rec *webhookReceiver) answer(statuses ...int) {
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	rec.statuses = statuses
+}
+
+func (rec *webhookReceiver) take() []receivedHook {
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	received := rec.received
+	rec.received = nil
+	return received
+}
+
+func TestChangeEvents(t *testing.T) {
+	t.Run("when schedules change", func(t *testing.T) {
+		change := changeOf(changeImported, []Schedule{
+			{StopID: 2, Route: "C", TrainID: "865a"},
+			{StopID: 1, Route: "C", TrainID: "865a"},
+			{StopID: 1, Route: "55", TrainID: "465a"},
+		})
+
+		t.Run("it will list the stops, routes and trains touched once", func(t *testing.T) {
+			assert.EqualValues(t, []int64{1, 2}, change.StopIDs)
+			assert.EqualValues(t, []string{"55", "C"}, change.Routes)
+			assert.EqualValues(t, []string{"465a", "865a"}, change.TrainIDs)
+			assert.EqualValues(t, 3, change.Count)
+		})
+
+		t.Run("it will affect filters on any of them", func(t *testing.T) {
+			assert.True(t, change.affects(nil, nil))
+			assert.True(t, change.affects([]int64{2, 9}, []string{"C"}))
+			assert.False(t, change.affects([]int64{9}, nil))
+			assert.False(t, change.affects([]int64{1}, []string{"D"}))
+		})
+	})
+
+	t.Run("when a change touched the whole network", func(t *testing.T) {
+		assert.True(t, ChangeEvent{Event: changeTimetableActivated}.affects([]int64{9}, []string{"D"}))
+	})
+}
+
+func TestWebhooks(t *testing.T) {
+	store := initTestStore(t)
+	defer tearDownStore(store)
+	backoff := webhookBackoff
+	webhookBackoff = time.Millisecond
+	defer func() { webhookBackoff = backoff }()
+
+	receiver := &webhookReceiver{}
+	srv := httptest.NewServer(receiver)
+	defer srv.Close()
+
+	store.webhookAllowlist = WebhookAllowlist(mustParseNetworks("127.0.0.1"))
+	dispatcher := startWebhooks(store)
+	defer dispatcher.close()
+
+	hook, err := store.addWebhook(Webhook{URL: srv.URL, StopIDs: []int64{1}})
+	require.Nil(t, err)
+	require.NotEmpty(t, hook.Secret)
+
+	t.Run("when schedules at a subscribed stop are imported", func(t *testing.T) {
+		require.Nil(t, store.csvHandler(`stopID,route,trainID,time
+1,"C","865a","Jul 04 2021 07:42"
+2,"C","865a","Jul 04 2021 07:50"`))
+		dispatcher.wg.Wait()
+		received := receiver.take()
+
+		t.Run("it will post a signed payload", func(t *testing.T) {
+			require.Len(t, received, 1)
+			assert.EqualValues(t, changeImported, received[0].event)
+			assert.EqualValues(t, signPayload(hook.Secret, received[0].body), received[0].signature)
+			assert.EqualValues(t, []int64{1, 2}, received[0].payload.StopIDs)
+			assert.EqualValues(t, 2, received[0].payload.Count)
+		})
+
+		t.Run("it will log the delivery", func(t *testing.T) {
+			deliveries, err := store.getDeliveries(hook.ID)
+			require.Nil(t, err)
+			require.Len(t, deliveries, 1)
+			assert.EqualValues(t, received[0].payload.Delivery, deliveries[0].ID)
+			assert.True(t, deliveries[0].Delivered)
+			assert.EqualValues(t, 1, deliveries[0].Attempts)
+		})
+	})
+
+	t.Run("when a change does not touch the subscribed stops", func(t *testing.T) {
+		stopID := int64(2)
+		_, err := store.deleteSchedules(ScheduleFilter{StopID: &stopID})
+		require.Nil(t, err)
+		dispatcher.wg.Wait()
+
+		t.Run("it will not be posted", func(t *testing.T) {
+			assert.Len(t, receiver.take(), 0)
+		})
+	})
+
+	t.Run("when a train calling at the stop is cancelled and the receiver fails", func(t *testing.T) {
+		receiver.answer(http.StatusInternalServerError, http.StatusBadGateway)
+		_, err := store.addCancellation(Cancellation{TrainID: "865a", ServiceDay: "Jul 04 2021"})
+		require.Nil(t, err)
+		dispatcher.wg.Wait()
+		received := receiver.take()
+
+		t.Run("it will retry until it is accepted", func(t *testing.T) {
+			require.Len(t, received, 3)
+			assert.EqualValues(t, changeOverrideAdded, received[2].event)
+			assert.EqualValues(t, cancellationDbName, received[2].payload.Collection)
+			assert.EqualValues(t, received[0].payload.Delivery, received[2].payload.Delivery)
+
+			deliveries, err := store.getDeliveries(hook.ID)
+			require.Nil(t, err)
+			require.Len(t, deliveries, 2)
+			assert.EqualValues(t, 3, deliveries[1].Attempts)
+			assert.True(t, deliveries[1].Delivered)
+		})
+	})
+
+	t.Run("when the receiver refuses a payload", func(t *testing.T) {
+		receiver.answer(http.StatusBadRequest)
+		_, err := store.addExtraService(Schedule{StopID: 1, Route: "C", TrainID: "999a", Time: "Jul 04 2021 09:00"})
+		require.Nil(t, err)
+		dispatcher.wg.Wait()
+
+		t.Run("it will not retry and log the failure", func(t *testing.T) {
+			assert.Len(t, receiver.take(), 1)
+			deliveries, err := store.getDeliveries(hook.ID)
+			require.Nil(t, err)
+			require.Len(t, deliveries, 3)
+			assert.False(t, deliveries[2].Delivered)
+			assert.EqualValues(t, http.StatusBadRequest, deliveries[2].StatusCode)
+			assert.EqualValues(t, "Webhook answered 400", deliveries[2].Error)
+		})
+	})
+
+	t.Run("when webhooks are managed over the server", func(t *testing.T) {
+		api := httptest.NewServer(newServer(store))
+		defer api.Close()
+
+		res, err := http.Post(api.URL+"/webhooks", "application/json", strings.NewReader(`{"url": "ftp://example.com"}`))
+		require.Nil(t, err)
+		res.Body.Close()
+
+		t.Run("it will refuse a URL that is not http", func(t *testing.T) {
+			assert.EqualValues(t, http.StatusBadRequest, res.StatusCode)
+		})
+
+		t.Run("it will refuse a private address that is not allowed", func(t *testing.T) {
+			res, err := http.Post(api.URL+"/webhooks", "application/json", strings.NewReader(`{"url": "http://10.1.2.3/hook"}`))
+			require.Nil(t, err)
+			res.Body.Close()
+			assert.EqualValues(t, http.StatusBadRequest, res.StatusCode)
+		})
+
+		t.Run("it will list webhooks without their secret", func(t *testing.T) {
+			res, err := http.Get(api.URL + "/webhooks")
+			require.Nil(t, err)
+			defer res.Body.Close()
+			hooks := []Webhook{}
+			require.Nil(t, json.NewDecoder(res.Body).Decode(&hooks))
+			require.Len(t, hooks, 1)
+			assert.EqualValues(t, hook.ID, hooks[0].ID)
+			assert.Empty(t, hooks[0].Secret)
+		})
+
+		t.Run("it will return the delivery log and delete the webhook", func(t *testing.T) {
+			res, err := http.Get(api.URL + "/webhooks/" + hook.ID + "/deliveries")
+			require.Nil(t, err)
+			defer res.Body.Close()
+			deliveries := []WebhookDelivery{}
+			require.Nil(t, json.NewDecoder(res.Body).Decode(&deliveries))
+			assert.Len(t, deliveries, 3)
+
+			req, _ := http.NewRequest(http.MethodDelete, api.URL+"/webhooks/"+hook.ID, nil)
+			res, err = http.DefaultClient.Do(req)
+			require.Nil(t, err)
+			res.Body.Close()
+			assert.EqualValues(t, http.StatusNoContent, res.StatusCode)
+		})
+	})
+}
+
+func TestWebhookAddresses(t *testing.T) {
+	t.Run("when a webhook is sent to a private address", func(t *testing.T) {
+		t.Run("it will be refused unless allowed", func(t *testing.T) {
+			for _, url := range []string{"http://127.0.0.1:8080/", "http://localhost/", "http://[::1]/", "http://169.254.169.254/latest", "http://192.168.1.10/", "http://0.0.0.0/"} {
+				err := Webhook{URL: url}.validate(nil)
+				require.Error(t, err, url)
+				assert.Contains(t, err.Error(), "Webhook host is a private address", url)
+			}
+
+			allow, err := parseWebhookAllowlist("127.0.0.1, 192.168.1.0/24")
+			require.Nil(t, err)
+			assert.Nil(t, Webhook{URL: "http://127.0.0.1:8080/"}.validate(allow))
+			assert.Nil(t, Webhook{URL: "http://192.168.1.10/"}.validate(allow))
+			assert.Error(t, Webhook{URL: "http://10.0.0.1/"}.validate(allow))
+		})
+
+		t.Run("it will let public addresses through", func(t *testing.T) {
+			assert.Nil(t, Webhook{URL: "https://93.184.216.34/hook"}.validate(nil))
+		})
+
+		t.Run("it will not connect when the host resolves to one later", func(t *testing.T) {
+			srv := httptest.NewServer(&webhookReceiver{})
+			defer srv.Close()
+
+			_, err := WebhookAllowlist(nil).client(time.Second).Get(srv.URL)
+			require.Error(t, err)
+			assert.Contains(t, err.Error(), "Webhook address is not allowed: 127.0.0.1")
+		})
+	})
+
+	t.Run("when the allowlist is not a network", func(t *testing.T) {
+		_, err := parseWebhookAllowlist("10.0.0.0/8,intranet")
+		require.Error(t, err)
+		assert.EqualValues(t, "Network must be an address or CIDR, got: intranet", err.Error())
+	})
+}
+
+func TestWebhookLimits(t *testing.T) {
+	store := initTestStore(t)
+	defer tearDownStore(store)
+	store.webhookAllowlist = WebhookAllowlist(mustParseNetworks("127.0.0.1"))
+
+	receiver := &webhookReceiver{}
+	srv := httptest.NewServer(receiver)
+	defer srv.Close()
+	hook, err := store.addWebhook(Webhook{URL: srv.URL})
+	require.Nil(t, err)
+
+	t.Run("when more deliveries are logged than are kept", func(t *testing.T) {
+		retention := webhookDeliveryRetention
+		webhookDeliveryRetention = 2
+		defer func() { webhookDeliveryRetention = retention }()
+
+		for _, at := range []string{"2021-07-04T07:00:00.000000000Z", "2021-07-04T08:00:00.000000000Z", "2021-07-04T09:00:00.000000000Z"} {
+			require.Nil(t, store.logDelivery(WebhookDelivery{ID: newID(), WebhookID: hook.ID, Event: changeImported, At: at}))
+		}
+
+		t.Run("it will delete the oldest", func(t *testing.T) {
+			deliveries, err := store.getDeliveries(hook.ID)
+			require.Nil(t, err)
+			require.Len(t, deliveries, 2)
+			assert.EqualValues(t, "2021-07-04T08:00:00.000000000Z", deliveries[0].At)
+		})
+	})
+
+	t.Run("when the queue is full", func(t *testing.T) {
+		workers, queue := webhookWorkers, webhookQueue
+		webhookWorkers, webhookQueue = 0, 0
+		defer func() { webhookWorkers, webhookQueue = workers, queue }()
+
+		dispatcher := startWebhooks(store)
+		require.Nil(t, store.csvHandler(`stopID,route,trainID,time
+1,"C","865a","Jul 04 2021 07:42"`))
+		dispatcher.close()
+
+		t.Run("it will drop the change rather than wait", func(t *testing.T) {
+			assert.Len(t, receiver.take(), 0)
+		})
+	})
+}
+
+func TestWebhookClose(t *testing.T) {
+	store := initTestStore(t)
+	defer tearDownStore(store)
+	store.webhookAllowlist = WebhookAllowlist(mustParseNetworks("127.0.0.1"))
+
+	release := make(chan struct{})
+	receiver := &webhookReceiver{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+		receiver.ServeHTTP(w, r)
+	}))
+	defer srv.Close()
+	_, err := store.addWebhook(Webhook{URL: srv.URL})
+	require.Nil(t, err)
+
+	t.Run("when a delivery is in flight", func(t *testing.T) {
+		dispatcher := startWebhooks(store)
+		require.Nil(t, store.csvHandler(`stopID,route,trainID,time
+1,"C","865a","Jul 04 2021 07:42"`))
+		go func() {
+			time.Sleep(20 * time.Millisecond)
+			close(release)
+		}()
+
+		t.Run("it will wait for it to finish", func(t *testing.T) {
+			assert.True(t, dispatcher.close())
+			assert.Len(t, receiver.take(), 1)
+		})
+	})
+
+	t.Run("when a delivery outlasts the drain timeout", func(t *testing.T) {
+		timeout := webhookDrainTimeout
+		webhookDrainTimeout = 20 * time.Millisecond
+		defer func() { webhookDrainTimeout = timeout }()
+
+		blocked := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			time.Sleep(500 * time.Millisecond)
+		}))
+		defer blocked.Close()
+		_, err := store.addWebhook(Webhook{URL: blocked.URL})
+		require.Nil(t, err)
+
+		dispatcher := startWebhooks(store)
+		require.Nil(t, store.csvHandler(`stopID,route,trainID,time
+2,"C","865a","Jul 04 2021 07:50"`))
+
+		t.Run("it will stop waiting", func(t *testing.T) {
+			started := time.Now()
+			assert.False(t, dispatcher.close())
+			assert.True(t, time.Since(started) < 500*time.Millisecond)
+		})
+		// lets the delivery finish before the store is torn down
+		dispatcher.wg.Wait()
+	})
+}